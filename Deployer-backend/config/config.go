@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 )
 
 type Config struct {
@@ -36,6 +37,13 @@ type Config struct {
 	FrontendURL  string
 	DeployDomain string
 	Port         string
+	SitePort     string
+
+	// Deploy workers processing queued deployments
+	DeployWorkers int
+
+	// JSON file configuring the default deployment validators
+	ValidationConfig string
 }
 
 // RequiredEnvVars lists all required environment variables
@@ -50,10 +58,13 @@ var RequiredEnvVars = []string{
 
 // OptionalEnvVars lists optional environment variables with their defaults
 var OptionalEnvVars = map[string]string{
-	"MINIO_USE_SSL": "false",
-	"AUTH_PAGE_URL": "http://localhost:3000",
-	"FRONTEND_URL":  "http://localhost:3000",
-	"PORT":          "8080",
+	"MINIO_USE_SSL":     "false",
+	"AUTH_PAGE_URL":     "http://localhost:3000",
+	"FRONTEND_URL":      "http://localhost:3000",
+	"PORT":              "8080",
+	"SITE_PORT":         "8081",
+	"DEPLOY_WORKERS":    "2",
+	"VALIDATION_CONFIG": "",
 }
 
 func Load() *Config {
@@ -93,6 +104,11 @@ func Load() *Config {
 		FrontendURL:  getEnvWithDefault("FRONTEND_URL", "http://localhost:3000"),
 		DeployDomain: getRequiredEnv("DEPLOY_DOMAIN"),
 		Port:         getEnvWithDefault("PORT", "8080"),
+		SitePort:     getEnvWithDefault("SITE_PORT", "8081"),
+
+		DeployWorkers: getIntEnvWithDefault("DEPLOY_WORKERS", 2),
+
+		ValidationConfig: os.Getenv("VALIDATION_CONFIG"),
 	}
 }
 
@@ -111,6 +127,14 @@ func getEnvWithDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getIntEnvWithDefault(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 1 {
+		return defaultValue
+	}
+	return value
+}
+
 func getEnvWithFallback(key, fallback string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
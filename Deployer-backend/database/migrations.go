@@ -126,6 +126,365 @@ func RunMigrations(db *sql.DB) error {
 				ALTER TABLE deployments ADD COLUMN commit_message TEXT;
 			END IF;
 		END $$`,
+
+		// Migration: content-addressed blob store with per-deployment manifests
+		`CREATE TABLE IF NOT EXISTS blobs (
+			project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+			hash CHAR(64) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (project_id, hash)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS deployment_files (
+			deployment_id UUID REFERENCES deployments(id) ON DELETE CASCADE,
+			path TEXT NOT NULL,
+			hash CHAR(64) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			content_type VARCHAR(255) NOT NULL,
+			PRIMARY KEY (deployment_id, path)
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_deployment_files_hash ON deployment_files (hash)`,
+
+		// Migration: add stored_bytes (unique bytes written) to deployments
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'stored_bytes'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN stored_bytes BIGINT DEFAULT 0;
+			END IF;
+		END $$`,
+
+		// Migration: resumable upload sessions
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'session_expires_at'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN session_expires_at TIMESTAMP;
+			END IF;
+		END $$`,
+
+		`CREATE TABLE IF NOT EXISTS upload_chunks (
+			deployment_id UUID REFERENCES deployments(id) ON DELETE CASCADE,
+			hash CHAR(64) NOT NULL,
+			offset_bytes BIGINT NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (deployment_id, hash, offset_bytes)
+		)`,
+
+		// Migration: queue of deployments waiting for a deploy worker
+		`CREATE TABLE IF NOT EXISTS deployment_jobs (
+			deployment_id UUID PRIMARY KEY REFERENCES deployments(id) ON DELETE CASCADE,
+			payload_key TEXT,
+			content_type TEXT,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT NOW(),
+			started_at TIMESTAMP
+		)`,
+
+		// Migration: append-only structured deployment logs
+		`CREATE TABLE IF NOT EXISTS deployment_log_lines (
+			id BIGSERIAL PRIMARY KEY,
+			deployment_id UUID REFERENCES deployments(id) ON DELETE CASCADE,
+			created_at TIMESTAMP DEFAULT NOW(),
+			level VARCHAR(10) NOT NULL,
+			phase VARCHAR(20) NOT NULL,
+			message TEXT NOT NULL
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_deployment_log_lines_deployment ON deployment_log_lines (deployment_id, id)`,
+
+		// Migration: per-file error report of failed deployments
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'file_errors'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN file_errors JSONB;
+			END IF;
+		END $$`,
+
+		// Migration: per-project version counter. Versions handed out twice by
+		// concurrent deploys are renumbered after the highest existing one.
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'projects' AND column_name = 'deploy_counter'
+			) THEN
+				ALTER TABLE projects ADD COLUMN deploy_counter INTEGER NOT NULL DEFAULT 0;
+
+				UPDATE deployments d SET version = r.new_version
+				FROM (
+					SELECT dup.id,
+						(SELECT MAX(x.version) FROM deployments x WHERE x.project_id = dup.project_id)
+						+ ROW_NUMBER() OVER (PARTITION BY dup.project_id ORDER BY dup.created_at, dup.id) AS new_version
+					FROM (
+						SELECT id, project_id, created_at,
+							ROW_NUMBER() OVER (PARTITION BY project_id, version ORDER BY created_at, id) AS n
+						FROM deployments
+					) dup
+					WHERE dup.n > 1
+				) r
+				WHERE d.id = r.id;
+
+				UPDATE projects p SET deploy_counter = COALESCE(
+					(SELECT MAX(version) FROM deployments d WHERE d.project_id = p.id), 0);
+			END IF;
+		END $$`,
+
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_deployments_project_version ON deployments (project_id, version)`,
+
+		// Migration: precompressed gzip and brotli variants of blobs
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'blobs' AND column_name = 'variants_generated'
+			) THEN
+				ALTER TABLE blobs ADD COLUMN variants_generated BOOLEAN NOT NULL DEFAULT FALSE;
+			END IF;
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'compressed_bytes'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN compressed_bytes BIGINT DEFAULT 0;
+			END IF;
+		END $$`,
+
+		`CREATE TABLE IF NOT EXISTS blob_variants (
+			project_id UUID NOT NULL,
+			hash CHAR(64) NOT NULL,
+			encoding VARCHAR(10) NOT NULL,
+			size_bytes BIGINT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (project_id, hash, encoding),
+			FOREIGN KEY (project_id, hash) REFERENCES blobs (project_id, hash) ON DELETE CASCADE
+		)`,
+
+		// Migration: per-path Cache-Control policies
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployment_files' AND column_name = 'cache_control'
+			) THEN
+				ALTER TABLE deployment_files ADD COLUMN cache_control TEXT;
+			END IF;
+		END $$`,
+
+		`CREATE TABLE IF NOT EXISTS project_cache_rules (
+			project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			pattern TEXT NOT NULL,
+			cache_control TEXT NOT NULL,
+			PRIMARY KEY (project_id, position)
+		)`,
+
+		// Migration: parsed _redirects and _headers rules of each deployment
+		`CREATE TABLE IF NOT EXISTS deployment_rules (
+			deployment_id UUID REFERENCES deployments(id) ON DELETE CASCADE,
+			kind VARCHAR(10) NOT NULL,
+			position INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			destination TEXT,
+			status INTEGER,
+			forced BOOLEAN NOT NULL DEFAULT FALSE,
+			query JSONB,
+			headers JSONB,
+			PRIMARY KEY (deployment_id, kind, position)
+		)`,
+
+		// Migration: single-page app fallback, set per project or detected
+		// per deployment
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'projects' AND column_name = 'spa_mode'
+			) THEN
+				ALTER TABLE projects ADD COLUMN spa_mode BOOLEAN;
+			END IF;
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'spa_mode'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN spa_mode BOOLEAN;
+			END IF;
+		END $$`,
+
+		// Migration: per-project validator overrides and the reason code of
+		// rejected deployments
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'projects' AND column_name = 'validation'
+			) THEN
+				ALTER TABLE projects ADD COLUMN validation JSONB;
+			END IF;
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'error_code'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN error_code VARCHAR(50);
+			END IF;
+		END $$`,
+
+		// Migration: broken link report of deployments, and per-project
+		// strict link checking
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'broken_links'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN broken_links JSONB;
+			END IF;
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'projects' AND column_name = 'strict_links'
+			) THEN
+				ALTER TABLE projects ADD COLUMN strict_links BOOLEAN NOT NULL DEFAULT FALSE;
+			END IF;
+		END $$`,
+
+		// Migration: secret scanning results cached per blob, and the audited
+		// overrides for false positives
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'blobs' AND column_name = 'secrets_scan_version'
+			) THEN
+				ALTER TABLE blobs ADD COLUMN secrets_scan_version INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE blobs ADD COLUMN secret_rules TEXT[];
+			END IF;
+		END $$`,
+
+		`CREATE TABLE IF NOT EXISTS secret_overrides (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			project_id UUID NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+			pattern TEXT NOT NULL,
+			rule VARCHAR(50) NOT NULL,
+			reason TEXT NOT NULL,
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			revoked_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			revoked_at TIMESTAMP
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_secret_overrides_project ON secret_overrides (project_id)`,
+
+		// Migration: content type sniffed from each blob's first bytes
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'blobs' AND column_name = 'sniffed_type'
+			) THEN
+				ALTER TABLE blobs ADD COLUMN sniffed_type VARCHAR(255);
+			END IF;
+		END $$`,
+
+		// Migration: per-project retention policy
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'projects' AND column_name = 'retention'
+			) THEN
+				ALTER TABLE projects ADD COLUMN retention JSONB;
+			END IF;
+		END $$`,
+
+		// Migration: deployments kept by every cleanup, or kept from deletion
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'pinned'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
+				ALTER TABLE deployments ADD COLUMN protected BOOLEAN NOT NULL DEFAULT FALSE;
+			END IF;
+		END $$`,
+
+		// Migration: named environments, each with its own live deployment.
+		// Production stays in projects.active_deployment_id.
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'environment'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN environment VARCHAR(32) NOT NULL DEFAULT 'production';
+			END IF;
+		END $$`,
+
+		`CREATE TABLE IF NOT EXISTS project_environments (
+			project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+			name VARCHAR(32) NOT NULL,
+			active_deployment_id UUID REFERENCES deployments(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			updated_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (project_id, name)
+		)`,
+
+		// Migration: branch previews. A preview deployment has a branch and
+		// no environment.
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'branch'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN branch VARCHAR(255);
+				ALTER TABLE deployments ALTER COLUMN environment DROP NOT NULL;
+			END IF;
+		END $$`,
+
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'projects' AND column_name = 'production_branch'
+			) THEN
+				ALTER TABLE projects ADD COLUMN production_branch VARCHAR(255) NOT NULL DEFAULT 'main';
+			END IF;
+		END $$`,
+
+		`CREATE TABLE IF NOT EXISTS branch_aliases (
+			project_id UUID REFERENCES projects(id) ON DELETE CASCADE,
+			branch VARCHAR(255) NOT NULL,
+			slug VARCHAR(63) NOT NULL,
+			active_deployment_id UUID REFERENCES deployments(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			updated_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (project_id, branch),
+			UNIQUE (project_id, slug)
+		)`,
+
+		// Migration: abandoned uploads are found by their last activity, and
+		// sessions that used to expire are cancelled instead
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = 'deployments' AND column_name = 'last_activity_at'
+			) THEN
+				ALTER TABLE deployments ADD COLUMN last_activity_at TIMESTAMP;
+			END IF;
+		END $$`,
+
+		`UPDATE deployments SET status = 'cancelled' WHERE status = 'expired'`,
 	}
 
 	for _, migration := range migrations {
@@ -3,11 +3,14 @@ module github.com/dhruvsingh/deployer-backend
 go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/dhruvsingh/deployer-shared v0.0.0
 	github.com/golang-jwt/jwt/v5 v5.3.1
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
 	github.com/minio/minio-go/v7 v7.0.66
 	github.com/rs/cors v1.11.1
+	golang.org/x/net v0.19.0
 )
 
 require (
@@ -23,8 +26,9 @@ require (
 	github.com/rs/xid v1.5.0 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	golang.org/x/crypto v0.18.0 // indirect
-	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
+
+replace github.com/dhruvsingh/deployer-shared => ../Deployer-shared
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+)
+
+// maxArchiveEntries caps the number of entries read from an uploaded archive
+const maxArchiveEntries = 10000
+
+// archiveFormat maps a request media type to the archive format it carries
+func archiveFormat(mediaType string) string {
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/x-tar+gzip", "application/x-compressed-tar":
+		return "tar.gz"
+	case "application/zip", "application/x-zip-compressed":
+		return "zip"
+	}
+	return ""
+}
+
+// ingestArchive adds the files of a .tar.gz or .zip deploy body. Every entry
+// goes through the same checks as a multipart upload; symlinks, special files
+// and path traversal are rejected.
+func ingestArchive(u *deploymentUpload, body io.Reader, format string) error {
+	var err error
+	if format == "zip" {
+		err = readZipArchive(body, u.addFileWithProgress)
+	} else {
+		err = readTarGzArchive(body, u.addFileWithProgress)
+	}
+	if err != nil {
+		return err
+	}
+
+	if u.filesCount == 0 && len(u.fileErrors) == 0 {
+		return archiveError("archive contains no files")
+	}
+	return nil
+}
+
+// readTarGzArchive streams the regular files of a gzipped tarball to add
+func readTarGzArchive(body io.Reader, add func(name, contentType string, r io.Reader) error) error {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return archiveError("not a valid gzip stream")
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return archiveError(fmt.Sprintf("corrupt tar archive: %v", err))
+		}
+		if entries >= maxArchiveEntries {
+			return archiveError(fmt.Sprintf("archive has more than %d entries", maxArchiveEntries))
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+			if err := add(hdr.Name, "", tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return archiveError(fmt.Sprintf("links are not allowed: %s", hdr.Name))
+		default:
+			return archiveError(fmt.Sprintf("unsupported entry type for %s", hdr.Name))
+		}
+	}
+}
+
+// readZipArchive adds the regular files of a zip archive. Zip needs random
+// access, so the body is spooled to a temporary file first.
+func readZipArchive(body io.Reader, add func(name, contentType string, r io.Reader) error) error {
+	tmp, err := os.CreateTemp("", "deployer-archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return archiveError(fmt.Sprintf("failed to read archive: %v", err))
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return archiveError("not a valid zip archive")
+	}
+	if len(zr.File) > maxArchiveEntries {
+		return archiveError(fmt.Sprintf("archive has more than %d entries", maxArchiveEntries))
+	}
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+			continue
+		case mode&os.ModeSymlink != 0:
+			return archiveError(fmt.Sprintf("links are not allowed: %s", f.Name))
+		case !mode.IsRegular():
+			return archiveError(fmt.Sprintf("unsupported entry type for %s", f.Name))
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return archiveError(fmt.Sprintf("failed to open %s: %v", f.Name, err))
+		}
+		err = add(f.Name, "", rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archiveError(reason string) error {
+	return &uploadError{
+		Status:  http.StatusBadRequest,
+		Code:    api.CodeInvalidArchive,
+		Message: "Invalid archive: " + reason,
+		Log:     "Archive rejected: " + reason,
+	}
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+)
+
+// archiveEntry is an entry of an archive built by a test
+type archiveEntry struct {
+	name string
+	body string
+	// link is the target of a symlink entry
+	link string
+	dir  bool
+}
+
+func tarGzArchive(t *testing.T, entries []archiveEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		switch {
+		case e.dir:
+			hdr.Typeflag, hdr.Size = tar.TypeDir, 0
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func zipArchive(t *testing.T, entries []archiveEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Store}
+		body := e.body
+		switch {
+		case e.dir:
+			hdr.SetMode(os.ModeDir | 0755)
+		case e.link != "":
+			hdr.SetMode(os.ModeSymlink | 0777)
+			body = e.link
+		default:
+			hdr.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// archiveReaders are the archive formats under test
+var archiveReaders = []struct {
+	format string
+	build  func(t *testing.T, entries []archiveEntry) *bytes.Buffer
+	read   func(body io.Reader, add func(name, contentType string, r io.Reader) error) error
+}{
+	{"tar.gz", tarGzArchive, readTarGzArchive},
+	{"zip", zipArchive, readZipArchive},
+}
+
+func TestReadArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		// files maps the paths added, after normalization, to their content
+		files map[string]string
+		// invalid lists the entry names the upload would reject as paths
+		invalid []string
+		// wantErr is set when the whole archive is rejected
+		wantErr bool
+	}{
+		{
+			name: "regular files and directories",
+			entries: []archiveEntry{
+				{name: "assets/", dir: true},
+				{name: "index.html", body: "<html>"},
+				{name: "assets/app.js", body: "app()"},
+			},
+			files: map[string]string{"index.html": "<html>", "assets/app.js": "app()"},
+		},
+		{
+			name: "path traversal",
+			entries: []archiveEntry{
+				{name: "index.html", body: "<html>"},
+				{name: "../outside.html", body: "x"},
+				{name: "assets/../../outside.html", body: "x"},
+				{name: "/etc/passwd", body: "x"},
+			},
+			files:   map[string]string{"index.html": "<html>"},
+			invalid: []string{"../outside.html", "assets/../../outside.html", "/etc/passwd"},
+		},
+		{
+			name: "symlink",
+			entries: []archiveEntry{
+				{name: "index.html", body: "<html>"},
+				{name: "secrets", link: "/etc/passwd"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, reader := range archiveReaders {
+		for _, tt := range tests {
+			t.Run(reader.format+"/"+tt.name, func(t *testing.T) {
+				files := map[string]string{}
+				var invalid []string
+				err := reader.read(reader.build(t, tt.entries), func(name, contentType string, r io.Reader) error {
+					data, err := io.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					// The upload normalizes every name the same way
+					cleaned, ok := manifest.NormalizePath(name)
+					if !ok {
+						invalid = append(invalid, name)
+						return nil
+					}
+					files[cleaned] = string(data)
+					return nil
+				})
+
+				if tt.wantErr {
+					checkArchiveError(t, err)
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(files, tt.files) {
+					t.Errorf("files = %v, want %v", files, tt.files)
+				}
+				if !reflect.DeepEqual(invalid, tt.invalid) {
+					t.Errorf("invalid paths = %v, want %v", invalid, tt.invalid)
+				}
+			})
+		}
+	}
+}
+
+func TestReadArchiveEntryCap(t *testing.T) {
+	for _, reader := range archiveReaders {
+		for _, count := range []int{maxArchiveEntries, maxArchiveEntries + 1} {
+			t.Run(fmt.Sprintf("%s/%d entries", reader.format, count), func(t *testing.T) {
+				entries := make([]archiveEntry, count)
+				for i := range entries {
+					entries[i] = archiveEntry{name: fmt.Sprintf("d%d/", i), dir: true}
+				}
+				err := reader.read(reader.build(t, entries), func(name, contentType string, r io.Reader) error {
+					return nil
+				})
+				if count <= maxArchiveEntries {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				checkArchiveError(t, err)
+			})
+		}
+	}
+}
+
+func TestReadArchiveCorrupt(t *testing.T) {
+	for _, reader := range archiveReaders {
+		t.Run(reader.format, func(t *testing.T) {
+			err := reader.read(bytes.NewBufferString("not an archive"), func(name, contentType string, r io.Reader) error {
+				return nil
+			})
+			checkArchiveError(t, err)
+		})
+	}
+}
+
+func checkArchiveError(t *testing.T, err error) {
+	t.Helper()
+	var uerr *uploadError
+	if !errors.As(err, &uerr) || uerr.Code != api.CodeInvalidArchive {
+		t.Fatalf("error = %v, want an %s rejection", err, api.CodeInvalidArchive)
+	}
+}
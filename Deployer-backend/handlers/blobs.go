@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+// Files are stored once per project bucket under _blobs/{sha256}. Each
+// deployment is a manifest (deployment_files) mapping paths to blob hashes, so
+// unchanged files cost nothing to redeploy and rollbacks only switch manifests.
+
+// blobKey returns the object key of a content-addressed blob
+func blobKey(hash string) string {
+	return "_blobs/" + hash
+}
+
+// spooledFile is an upload buffered on local disk while its hash is computed
+type spooledFile struct {
+	*os.File
+	Hash string
+	Size int64
+}
+
+// spoolUpload copies body to a temporary file, hashing it on the way. Only a
+// small copy buffer is held in memory regardless of the file size.
+func spoolUpload(body io.Reader) (*spooledFile, error) {
+	tmp, err := os.CreateTemp("", "deployer-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(tmp, io.TeeReader(body, hasher))
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &spooledFile{File: tmp, Hash: hex.EncodeToString(hasher.Sum(nil)), Size: size}, nil
+}
+
+// Close closes and deletes the temporary file
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// blobExists reports whether a project already stores the blob. A blob
+// being removed by removeUnreferencedBlobs is waited for and then reported
+// missing, so that it gets stored again.
+func blobExists(db *sql.DB, projectID, hash string) (bool, error) {
+	var one int
+	err := db.QueryRow(`
+		SELECT 1 FROM blobs WHERE project_id = $1 AND hash = $2
+		FOR SHARE
+	`, projectID, hash).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// putBlob uploads a blob to the project bucket and records it
+func putBlob(ctx context.Context, db *sql.DB, minioClient *minio.Client, projectID, bucket, hash string, body io.Reader, size int64, contentType string) error {
+	_, err := minioClient.PutObject(ctx, bucket, blobKey(hash), body, size,
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO blobs (project_id, hash, size_bytes)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (project_id, hash) DO NOTHING
+	`, projectID, hash, size)
+	return err
+}
+
+// addManifestEntry records a file in a deployment's manifest
+func addManifestEntry(db *sql.DB, deploymentID, path, hash string, size int64, contentType, cacheControl string) error {
+	_, err := db.Exec(`
+		INSERT INTO deployment_files (deployment_id, path, hash, size_bytes, content_type, cache_control)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (deployment_id, path) DO UPDATE
+		SET hash = EXCLUDED.hash, size_bytes = EXCLUDED.size_bytes, content_type = EXCLUDED.content_type,
+			cache_control = EXCLUDED.cache_control
+	`, deploymentID, path, hash, size, contentType, cacheControl)
+	return err
+}
+
+// manifestEntry is one file of a deployment's manifest
+type manifestEntry struct {
+	Hash        string
+	Size        int64
+	ContentType string
+	// CacheControl is empty for files deployed before cache rules existed
+	CacheControl string
+	// Encodings lists the precompressed variants of the blob
+	Encodings []string
+}
+
+// lookupManifestEntry resolves a path in a deployment's manifest
+func lookupManifestEntry(db *sql.DB, deploymentID, path string) (manifestEntry, bool, error) {
+	var entry manifestEntry
+	err := db.QueryRow(`
+		SELECT f.hash, f.size_bytes, f.content_type, COALESCE(f.cache_control, ''),
+			ARRAY(
+				SELECT v.encoding FROM blob_variants v
+				JOIN deployments d ON d.project_id = v.project_id
+				WHERE d.id = f.deployment_id AND v.hash = f.hash
+			)
+		FROM deployment_files f
+		WHERE f.deployment_id = $1 AND f.path = $2
+	`, deploymentID, path).Scan(&entry.Hash, &entry.Size, &entry.ContentType, &entry.CacheControl, pq.Array(&entry.Encodings))
+	if err == sql.ErrNoRows {
+		return entry, false, nil
+	}
+	return entry, err == nil, err
+}
+
+// hasManifest reports whether a deployment was stored as a manifest
+func hasManifest(db *sql.DB, deploymentID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM deployment_files WHERE deployment_id = $1)
+	`, deploymentID).Scan(&exists)
+	return exists, err
+}
+
+// discardDeploymentFiles drops the manifest and upload chunks of a deployment
+// that will never go live, along with any of its blobs nothing else uses
+func discardDeploymentFiles(ctx context.Context, db *sql.DB, minioClient *minio.Client, projectID, bucket, deploymentID string) {
+	removeObjectsUnder(ctx, minioClient, bucket, chunkPrefix(deploymentID))
+	db.Exec("DELETE FROM upload_chunks WHERE deployment_id = $1", deploymentID)
+
+	rows, err := db.Query(`
+		DELETE FROM deployment_files WHERE deployment_id = $1
+		RETURNING hash
+	`, deploymentID)
+	if err != nil {
+		log.Printf("Failed to discard manifest of deployment %s: %v", deploymentID, err)
+		return
+	}
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	rows.Close()
+
+	removeUnreferencedBlobs(ctx, db, minioClient, projectID, bucket, hashes)
+}
+
+// removeObjectsUnder deletes every object under prefix
+func removeObjectsUnder(ctx context.Context, minioClient *minio.Client, bucket, prefix string) {
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for obj := range minioClient.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+			Prefix:    prefix,
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				log.Printf("Error listing %s/%s: %v", bucket, prefix, obj.Err)
+				continue
+			}
+			objectsCh <- obj
+		}
+	}()
+
+	for rErr := range minioClient.RemoveObjects(ctx, bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		log.Printf("Failed to remove %s: %v", rErr.ObjectName, rErr.Err)
+	}
+}
+
+// removeUnreferencedBlobs deletes the given blobs of a project unless a
+// deployment manifest still references them. The deleted rows stay locked
+// until the objects are gone, so an upload of the same hash meanwhile waits
+// in blobExists instead of relying on an object about to be removed.
+func removeUnreferencedBlobs(ctx context.Context, db *sql.DB, minioClient *minio.Client, projectID, bucket string, hashes []string) {
+	if len(hashes) == 0 {
+		return
+	}
+
+	// Not tied to ctx: rolling back after some objects are gone would leave
+	// rows pointing at them
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM blobs b
+		WHERE b.project_id = $1 AND b.hash = ANY($2)
+		AND NOT EXISTS (
+			SELECT 1 FROM deployment_files f
+			JOIN deployments d ON f.deployment_id = d.id
+			WHERE d.project_id = b.project_id AND f.hash = b.hash
+		)
+		RETURNING b.hash
+	`, projectID, pq.Array(hashes))
+	if err != nil {
+		return
+	}
+
+	var removed []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			continue
+		}
+		removed = append(removed, hash)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return
+	}
+
+	for _, hash := range removed {
+		minioClient.RemoveObject(ctx, bucket, blobKey(hash), minio.RemoveObjectOptions{})
+		for _, encoding := range variantEncodings {
+			minioClient.RemoveObject(ctx, bucket, variantKey(hash, encoding), minio.RemoveObjectOptions{})
+		}
+	}
+	tx.Commit()
+}
+
+// userStorageUsed returns the unique bytes stored across a user's projects.
+// Deployments from before the blob store still count their full size.
+func userStorageUsed(db *sql.DB, userID string) int64 {
+	var used int64
+	db.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(b.size_bytes), 0)
+			 FROM blobs b
+			 JOIN projects p ON b.project_id = p.id
+			 WHERE p.user_id = $1)
+			+
+			(SELECT COALESCE(SUM(d.size_bytes), 0)
+			 FROM deployments d
+			 JOIN projects p ON d.project_id = p.id
+			 WHERE p.user_id = $1 AND d.status = 'success'
+			 AND NOT EXISTS (SELECT 1 FROM deployment_files f WHERE f.deployment_id = d.id))
+	`, userID).Scan(&used)
+	return used
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/dhruvsingh/deployer-backend/config"
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// A deployment made from a branch other than the project's production branch
+// is a preview: it goes live in the branch's alias (branch_aliases) instead of
+// an environment, served at {slug}--{project}.{DeployDomain}. The slug is
+// chosen when the branch is first deployed and stays the same, so every
+// branch keeps a stable URL. Reporting a branch deleted removes its alias and
+// its preview deployments.
+
+// branchSeparator separates a branch slug from the project name in a preview
+// hostname
+const branchSeparator = "--"
+
+// maxLabelLength is the longest a hostname label may be
+const maxLabelLength = 63
+
+// minSlugLength is the shortest slug a preview hostname gets
+const minSlugLength = 4
+
+// errNoRoomForSlug means the project name leaves no room for a branch slug
+// in a preview hostname
+var errNoRoomForSlug = errors.New("project name too long for branch previews")
+
+var slugUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// validBranch reports whether name can be a git branch name
+func validBranch(name string) bool {
+	if name == "" || len(name) > 255 {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// branchSlug turns a branch name into a hostname label short enough to go in
+// front of the project name. With unique set it ends in a hash of the branch,
+// for branches whose plain slug is taken; when there's no room for both, the
+// slug is the hash alone. It reports false if the project name leaves less
+// than minSlugLength characters.
+func branchSlug(branch, projectName string, unique bool) (string, bool) {
+	limit := maxLabelLength - len(branchSeparator) - len(projectName)
+	if limit < minSlugLength {
+		return "", false
+	}
+
+	slug := strings.Trim(slugUnsafe.ReplaceAllString(strings.ToLower(branch), "-"), "-")
+	if slug == "" {
+		slug = "branch"
+	}
+
+	sum := sha256.Sum256([]byte(branch))
+	suffix := ""
+	if unique {
+		suffix = "-" + hex.EncodeToString(sum[:3])
+		if limit-len(suffix) < minSlugLength {
+			return hex.EncodeToString(sum[:])[:limit], true
+		}
+	}
+
+	if len(slug) > limit-len(suffix) {
+		slug = strings.TrimRight(slug[:limit-len(suffix)], "-")
+	}
+	return slug + suffix, true
+}
+
+// branchURL returns the address a branch preview of a project is served at
+func branchURL(slug, projectName, domain string) string {
+	return fmt.Sprintf("http://%s%s%s.%s", slug, branchSeparator, projectName, domain)
+}
+
+// ensureBranchAlias returns the slug of a branch's alias, creating the alias
+// on the branch's first deployment. It returns errNoRoomForSlug if the
+// project's name is too long for a preview hostname.
+func ensureBranchAlias(db *sql.DB, projectID, projectName, branch string) (string, error) {
+	var slug string
+	err := db.QueryRow("SELECT slug FROM branch_aliases WHERE project_id = $1 AND branch = $2", projectID, branch).Scan(&slug)
+	if err != sql.ErrNoRows {
+		return slug, err
+	}
+
+	slug, ok := branchSlug(branch, projectName, false)
+	if !ok {
+		return "", errNoRoomForSlug
+	}
+	var taken bool
+	if err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM branch_aliases WHERE project_id = $1 AND slug = $2)
+	`, projectID, slug).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		slug, _ = branchSlug(branch, projectName, true)
+	}
+
+	// A concurrent first deployment of the same branch may have won the race
+	err = db.QueryRow(`
+		INSERT INTO branch_aliases (project_id, branch, slug)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (project_id, branch) DO UPDATE SET branch = EXCLUDED.branch
+		RETURNING slug
+	`, projectID, branch, slug).Scan(&slug)
+	return slug, err
+}
+
+// setBranchDeployment makes a deployment the live one of a branch's alias.
+// An alias removed while the deployment was processing stays removed.
+func setBranchDeployment(ex execer, projectID, branch, deploymentID string) error {
+	_, err := ex.Exec(`
+		UPDATE branch_aliases SET active_deployment_id = $1, updated_at = NOW()
+		WHERE project_id = $2 AND branch = $3
+	`, deploymentID, projectID, branch)
+	return err
+}
+
+// ListBranches returns the branch aliases of a project
+func ListBranches(db *sql.DB, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT b.branch, b.slug, b.active_deployment_id, d.version, b.updated_at, p.name
+			FROM branch_aliases b
+			JOIN projects p ON b.project_id = p.id
+			LEFT JOIN deployments d ON d.id = b.active_deployment_id
+			WHERE b.project_id = $1
+			ORDER BY b.updated_at DESC
+		`, projectID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		branches := []api.BranchAlias{}
+		for rows.Next() {
+			var b api.BranchAlias
+			var version sql.NullInt64
+			var projectName string
+			if err := rows.Scan(&b.Branch, &b.Slug, &b.DeploymentID, &version, &b.UpdatedAt, &projectName); err != nil {
+				continue
+			}
+			if version.Valid {
+				v := int(version.Int64)
+				b.Version = &v
+			}
+			b.URL = branchURL(b.Slug, projectName, cfg.DeployDomain)
+			branches = append(branches, b)
+		}
+
+		respondJSON(w, branches, http.StatusOK)
+	}
+}
+
+// DeleteBranch is how a deleted branch is reported: its alias goes away
+// along with the branch's preview deployments. Pinned and protected previews
+// are kept.
+func DeleteBranch(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		branch := vars["branch"]
+		var projectName string
+		err := db.QueryRow(`
+			DELETE FROM branch_aliases b
+			USING projects p
+			WHERE b.project_id = p.id AND b.project_id = $1 AND b.branch = $2
+			RETURNING p.name
+		`, projectID, branch).Scan(&projectName)
+		if err == sql.ErrNoRows {
+			respondError(w, fmt.Sprintf("Branch '%s' has no preview", branch), http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Failed to delete branch preview", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id FROM deployments
+			WHERE project_id = $1 AND branch = $2 AND environment IS NULL
+			AND status IN ('success', 'failed', 'cancelled')
+		`, projectID, branch)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		removed := 0
+		for _, id := range ids {
+			ok, err := removeDeployment(context.Background(), db, minioClient, projectID, projectName, id)
+			if err != nil {
+				log.Printf("Failed to remove preview deployment %s of '%s': %v", id, projectName, err)
+				continue
+			}
+			if ok {
+				removed++
+			}
+		}
+
+		log.Printf("🌿 Branch '%s' of '%s' deleted: removed its preview and %d deployments", branch, projectName, removed)
+		respondJSON(w, map[string]interface{}{
+			"message":             fmt.Sprintf("Preview of branch '%s' deleted", branch),
+			"removed_deployments": removed,
+		}, http.StatusOK)
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBranchSlug(t *testing.T) {
+	longBranch := "feature/" + strings.Repeat("very-long-branch-name-", 5)
+
+	tests := []struct {
+		name    string
+		branch  string
+		project string
+		unique  bool
+		want    string
+		ok      bool
+	}{
+		{"plain", "feature/login", "shop", false, "feature-login", true},
+		{"case and symbols", "Fix/Issue_#42!", "shop", false, "fix-issue-42", true},
+		{"no letters or digits", "///", "shop", false, "branch", true},
+		{"unique", "feature/login", "shop", true, "feature-login-" + branchHash("feature/login", 6), true},
+		{"truncated", longBranch, "shop", false, "feature-very-long-branch-name-very-long-branch-name-very", true},
+		{"no trailing dash", "abcdefghi-jklmnop", strings.Repeat("p", 51), false, "abcdefghi", true},
+		{"short room", "feature/login", strings.Repeat("p", 55), false, "featur", true},
+		{"unique in short room", "feature/login", strings.Repeat("p", 55), true, branchHash("feature/login", 6), true},
+		{"minimum room", "feature/login", strings.Repeat("p", 57), true, branchHash("feature/login", 4), true},
+		{"no room", "feature/login", strings.Repeat("p", 58), false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slug, ok := branchSlug(tt.branch, tt.project, tt.unique)
+			if slug != tt.want || ok != tt.ok {
+				t.Fatalf("branchSlug = %q, %v, want %q, %v", slug, ok, tt.want, tt.ok)
+			}
+			if ok && len(slug+branchSeparator+tt.project) > maxLabelLength {
+				t.Errorf("label %q is longer than %d characters", slug+branchSeparator+tt.project, maxLabelLength)
+			}
+		})
+	}
+}
+
+// branchHash returns the first n hex digits of a branch's hash
+func branchHash(branch string, n int) string {
+	sum := sha256.Sum256([]byte(branch))
+	return hex.EncodeToString(sum[:])[:n]
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/gorilla/mux"
+)
+
+// Every file of a deployment gets a Cache-Control header, resolved from its
+// path when the file is added to the manifest and sent with every response.
+// A project's own rules are tried first, in order, then the defaults: the
+// first rule whose glob matches wins. In globs, * and ? stay within a path
+// segment and ** spans segments; a pattern without a slash matches the file
+// name in any directory.
+
+const (
+	cacheImmutable = "public, max-age=31536000, immutable"
+	cacheNoCache   = "no-cache"
+	// cacheRevalidate applies to files no rule matches
+	cacheRevalidate = "public, max-age=0, must-revalidate"
+
+	// maxCacheRules caps the rules of a single project
+	maxCacheRules = 50
+)
+
+// defaultCacheRules cache fingerprinted build output for good and make
+// browsers revalidate HTML on every visit
+var defaultCacheRules = []models.CacheRule{
+	{Pattern: "_next/static/**", CacheControl: cacheImmutable},
+	{Pattern: "assets/**", CacheControl: cacheImmutable},
+	{Pattern: "*.html", CacheControl: cacheNoCache},
+}
+
+// globToRegexp compiles a glob into an anchored regular expression
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	if !strings.Contains(pattern, "/") {
+		b.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// **/ matches zero or more directories
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// glob is a compiled glob. The zero glob matches nothing.
+type glob struct {
+	re *regexp.Regexp
+}
+
+// compileGlob compiles a glob, ignoring a leading slash
+func compileGlob(pattern string) (glob, error) {
+	re, err := globToRegexp(strings.TrimPrefix(pattern, "/"))
+	if err != nil {
+		return glob{}, err
+	}
+	return glob{re: re}, nil
+}
+
+// match reports whether a deployment path matches the glob
+func (g glob) match(p string) bool {
+	return g.re != nil && g.re.MatchString(p)
+}
+
+// cacheRule is a cache rule with its glob compiled
+type cacheRule struct {
+	glob         glob
+	cacheControl string
+}
+
+// compileCacheRules compiles the globs of cache rules. Rules with an invalid
+// pattern never match.
+func compileCacheRules(rules []models.CacheRule) []cacheRule {
+	compiled := make([]cacheRule, len(rules))
+	for i, rule := range rules {
+		compiled[i].glob, _ = compileGlob(rule.Pattern)
+		compiled[i].cacheControl = rule.CacheControl
+	}
+	return compiled
+}
+
+var defaultCacheGlobs = compileCacheRules(defaultCacheRules)
+
+// cacheControlFor resolves the Cache-Control header of a deployment path
+func cacheControlFor(rules []cacheRule, p string) string {
+	for _, rule := range rules {
+		if rule.glob.match(p) {
+			return rule.cacheControl
+		}
+	}
+	for _, rule := range defaultCacheGlobs {
+		if rule.glob.match(p) {
+			return rule.cacheControl
+		}
+	}
+	return cacheRevalidate
+}
+
+// cacheControl resolves the Cache-Control header of a file of the
+// deployment, loading the project's rules on first use
+func (u *deploymentUpload) cacheControl(p string) string {
+	if u.cacheRules == nil {
+		rules, err := loadCacheRules(u.db, u.projectID)
+		if err != nil {
+			u.logf(logWarn, "Could not load cache rules, using the defaults: %v", err)
+		}
+		u.cacheRules = compileCacheRules(rules)
+	}
+	return cacheControlFor(u.cacheRules, p)
+}
+
+// loadCacheRules returns a project's cache rules in order
+func loadCacheRules(db *sql.DB, projectID string) ([]models.CacheRule, error) {
+	rows, err := db.Query(`
+		SELECT pattern, cache_control FROM project_cache_rules
+		WHERE project_id = $1
+		ORDER BY position
+	`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []models.CacheRule{}
+	for rows.Next() {
+		var rule models.CacheRule
+		if err := rows.Scan(&rule.Pattern, &rule.CacheControl); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// userProjectID checks that a project belongs to the user
+func userProjectID(db *sql.DB, projectID, email string) error {
+	var id string
+	return db.QueryRow(`
+		SELECT p.id FROM projects p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.id = $1 AND u.email = $2
+	`, projectID, email).Scan(&id)
+}
+
+// GetCacheRules returns a project's cache rules along with the defaults
+// applied after them
+func GetCacheRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		rules, err := loadCacheRules(db, projectID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"rules":    rules,
+			"defaults": defaultCacheRules,
+			"fallback": cacheRevalidate,
+		}, http.StatusOK)
+	}
+}
+
+// SetCacheRules replaces a project's cache rules. They apply to deployments
+// made from now on.
+func SetCacheRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var req struct {
+			Rules []models.CacheRule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(req.Rules) > maxCacheRules {
+			respondError(w, fmt.Sprintf("A project can have at most %d cache rules", maxCacheRules), http.StatusBadRequest)
+			return
+		}
+		for i, rule := range req.Rules {
+			if msg := validateCacheRule(rule); msg != "" {
+				respondError(w, fmt.Sprintf("Rule %d: %s", i+1, msg), http.StatusBadRequest)
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM project_cache_rules WHERE project_id = $1", projectID); err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for i, rule := range req.Rules {
+			if _, err := tx.Exec(`
+				INSERT INTO project_cache_rules (project_id, position, pattern, cache_control)
+				VALUES ($1, $2, $3, $4)
+			`, projectID, i, strings.TrimPrefix(rule.Pattern, "/"), rule.CacheControl); err != nil {
+				respondError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		rules, _ := loadCacheRules(db, projectID)
+		respondJSON(w, map[string]interface{}{"rules": rules}, http.StatusOK)
+	}
+}
+
+// validateCacheRule returns why a rule is invalid, or "" if it is fine
+func validateCacheRule(rule models.CacheRule) string {
+	pattern := strings.TrimPrefix(rule.Pattern, "/")
+	if pattern == "" {
+		return "pattern is required"
+	}
+	if path.Clean(pattern) != pattern {
+		return "pattern must be a clean relative path"
+	}
+	if _, err := globToRegexp(pattern); err != nil {
+		return "invalid pattern"
+	}
+	if strings.TrimSpace(rule.CacheControl) == "" {
+		return "cache_control is required"
+	}
+	if strings.ContainsAny(rule.CacheControl, "\r\n") || len(rule.CacheControl) > 256 {
+		return "invalid cache_control"
+	}
+	return ""
+}
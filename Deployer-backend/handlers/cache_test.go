@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/dhruvsingh/deployer-backend/models"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// Without a slash, the file name in any directory
+		{"*.html", "index.html", true},
+		{"*.html", "blog/post.html", true},
+		{"*.html", "index.htm", false},
+		{"favicon.ico", "favicon.ico", true},
+		{"favicon.ico", "img/favicon.ico", true},
+		// With a slash, from the root
+		{"assets/*", "assets/app.js", true},
+		{"assets/*", "assets/js/app.js", false},
+		{"assets/**", "assets/js/app.js", true},
+		{"/assets/**", "assets/js/app.js", true},
+		{"assets/**", "static/assets/app.js", false},
+		{"**/*.map", "app.js.map", true},
+		{"**/*.map", "js/vendor/app.js.map", true},
+		{"img/?.png", "img/a.png", true},
+		{"img/?.png", "img/ab.png", false},
+		{"img/?.png", "img//.png", false},
+		// Regular expression syntax is literal
+		{"a+b.txt", "a+b.txt", true},
+		{"a+b.txt", "aab.txt", false},
+		{"(x).js", "(x).js", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			g, err := compileGlob(tt.pattern)
+			if err != nil {
+				t.Fatalf("compileGlob(%q): %v", tt.pattern, err)
+			}
+			if got := g.match(tt.path); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZeroGlobMatchesNothing(t *testing.T) {
+	if (glob{}).match("index.html") {
+		t.Error("the zero glob matched")
+	}
+}
+
+func TestCacheControlFor(t *testing.T) {
+	rules := compileCacheRules([]models.CacheRule{
+		{Pattern: "assets/legacy/**", CacheControl: "public, max-age=60"},
+		{Pattern: "*.json", CacheControl: cacheNoCache},
+	})
+
+	tests := []struct {
+		rules []cacheRule
+		path  string
+		want  string
+	}{
+		{nil, "index.html", cacheNoCache},
+		{nil, "assets/app.3f2a.js", cacheImmutable},
+		{nil, "_next/static/chunks/main.js", cacheImmutable},
+		{nil, "robots.txt", cacheRevalidate},
+		// Project rules come before the defaults
+		{rules, "assets/legacy/app.js", "public, max-age=60"},
+		{rules, "assets/app.js", cacheImmutable},
+		{rules, "data/feed.json", cacheNoCache},
+		{rules, "robots.txt", cacheRevalidate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := cacheControlFor(tt.rules, tt.path); got != tt.want {
+				t.Errorf("cacheControlFor(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// A deployment can be cancelled until it has finished. Cancelling an upload
+// session or a queued deployment discards its files right away. A deployment
+// that is processing is stopped by cancelling its worker's context: directly
+// if the worker runs in this process, otherwise the worker notices the
+// status change at its next progress update or when it tries to activate.
+
+// abandonedUploadAge is how long a deployment without a session may sit in
+// uploading without activity before it is considered abandoned by its client
+const abandonedUploadAge = time.Hour
+
+var errDeploymentCancelled = errors.New("deployment was cancelled")
+
+// runningJobs holds the cancel functions of the jobs this process is running
+var runningJobs = struct {
+	sync.Mutex
+	cancel map[string]context.CancelFunc
+}{cancel: make(map[string]context.CancelFunc)}
+
+func trackRunningJob(deploymentID string, cancel context.CancelFunc) {
+	runningJobs.Lock()
+	runningJobs.cancel[deploymentID] = cancel
+	runningJobs.Unlock()
+}
+
+func untrackRunningJob(deploymentID string) {
+	runningJobs.Lock()
+	delete(runningJobs.cancel, deploymentID)
+	runningJobs.Unlock()
+}
+
+// stopRunningJob cancels the job of a deployment if this process runs it
+func stopRunningJob(deploymentID string) {
+	runningJobs.Lock()
+	cancel, ok := runningJobs.cancel[deploymentID]
+	runningJobs.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// CancelDeployment stops a deployment that hasn't finished yet
+func CancelDeployment(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		deploymentID := mux.Vars(r)["id"]
+		status, err := userDeploymentStatus(db, deploymentID, user.Email)
+		if err == sql.ErrNoRows {
+			respondError(w, "Deployment not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		previous, err := markCancelled(db, deploymentID, "Cancelled by user")
+		if err == sql.ErrNoRows {
+			respondError(w, "Deployment is "+status+" and can no longer be cancelled", http.StatusConflict)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🛑 Deployment %s cancelled (was %s)", deploymentID, previous)
+
+		// A processing job cleans up after itself once it has stopped
+		if previous == "processing" {
+			stopRunningJob(deploymentID)
+		} else {
+			discardCancelledDeployment(db, minioClient, deploymentID)
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"deployment_id": deploymentID,
+			"status":        "cancelled",
+		}, http.StatusOK)
+	}
+}
+
+// deploymentCancelled reports whether a deployment has been cancelled
+func deploymentCancelled(db *sql.DB, deploymentID string) bool {
+	var status string
+	err := db.QueryRow("SELECT status FROM deployments WHERE id = $1", deploymentID).Scan(&status)
+	return err == nil && status == "cancelled"
+}
+
+// abort ends a deployment whose request couldn't be completed. If the client
+// went away, the deployment is cancelled rather than failed.
+func (u *deploymentUpload) abort(err error) error {
+	if u.ctx.Err() == nil {
+		return u.fail(err)
+	}
+
+	if _, cancelErr := markCancelled(u.db, u.deploymentID, "Client disconnected before the upload finished"); cancelErr == nil {
+		discardCancelledDeployment(u.db, u.minioClient, u.deploymentID)
+	}
+	return err
+}
+
+// markCancelled moves an unfinished deployment to cancelled and returns the
+// status it had. It returns sql.ErrNoRows if the deployment already finished.
+func markCancelled(db *sql.DB, deploymentID, reason string) (string, error) {
+	var previous string
+	err := db.QueryRow(`
+		WITH old AS (
+			SELECT id, status FROM deployments
+			WHERE id = $1 AND status IN ('uploading', 'queued', 'processing')
+			FOR UPDATE
+		), logged AS (
+			INSERT INTO deployment_log_lines (deployment_id, level, phase, message)
+			SELECT id, 'warn', $3, $2 FROM old
+		)
+		UPDATE deployments d SET status = 'cancelled', logs = $2, session_expires_at = NULL
+		FROM old
+		WHERE d.id = old.id
+		RETURNING old.status
+	`, deploymentID, reason, phaseCancel).Scan(&previous)
+	return previous, err
+}
+
+// discardCancelledDeployment removes everything a cancelled deployment left
+// behind: its queued job and payload, upload chunks, manifest and any blobs
+// only it referenced
+func discardCancelledDeployment(db *sql.DB, minioClient *minio.Client, deploymentID string) {
+	var projectID, projectName string
+	err := db.QueryRow(`
+		SELECT p.id, p.name FROM deployments d
+		JOIN projects p ON d.project_id = p.id
+		WHERE d.id = $1
+	`, deploymentID).Scan(&projectID, &projectName)
+	if err != nil {
+		log.Printf("Failed to clean up cancelled deployment %s: %v", deploymentID, err)
+		return
+	}
+
+	ctx := context.Background()
+	appendDeploymentLog(db, deploymentID, logInfo, phaseCleanup, "Discarding uploaded files")
+	minioClient.RemoveObject(ctx, projectName, jobPayloadKey(deploymentID), minio.RemoveObjectOptions{})
+	db.Exec("DELETE FROM deployment_jobs WHERE deployment_id = $1", deploymentID)
+	discardDeploymentFiles(ctx, db, minioClient, projectID, projectName, deploymentID)
+}
+
+// CollectAbandonedUploads cancels uploads whose client went away: upload
+// sessions that saw no activity before they expired, and deployments without
+// a session that saw none for abandonedUploadAge. An upload that is still
+// receiving files keeps extending its session and is never collected.
+func CollectAbandonedUploads(db *sql.DB, minioClient *minio.Client) {
+	rows, err := db.Query(`
+		SELECT id FROM deployments
+		WHERE status = 'uploading'
+		AND (session_expires_at < NOW()
+			OR (session_expires_at IS NULL AND COALESCE(last_activity_at, created_at) < NOW() - $1 * INTERVAL '1 second'))
+	`, int(abandonedUploadAge.Seconds()))
+	if err != nil {
+		log.Printf("Failed to find abandoned uploads: %v", err)
+		return
+	}
+
+	var abandoned []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			abandoned = append(abandoned, id)
+		}
+	}
+	rows.Close()
+
+	collected := 0
+	for _, id := range abandoned {
+		if _, err := markCancelled(db, id, "Upload abandoned: the client stopped sending files"); err != nil {
+			continue
+		}
+		discardCancelledDeployment(db, minioClient, id)
+		collected++
+	}
+
+	if collected > 0 {
+		log.Printf("🧹 Cancelled %d abandoned uploads", collected)
+	}
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/minio/minio-go/v7"
+)
+
+// Compressible blobs get precompressed variants at deploy time, stored next
+// to the blob as _blobs/{sha256}.gz and _blobs/{sha256}.br and recorded in
+// blob_variants. The site server picks one according to Accept-Encoding. A
+// variant is only kept if it is smaller than the original.
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+
+	// minCompressSize is the smallest file worth compressing
+	minCompressSize = 1 << 10
+	// maxCompressSize bounds the files compressed in memory
+	maxCompressSize = 32 << 20
+)
+
+// compressibleTypes are the content types that get precompressed variants
+var compressibleTypes = map[string]bool{
+	"text/html":              true,
+	"text/css":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/json":       true,
+	"image/svg+xml":          true,
+	"application/wasm":       true,
+}
+
+// variantEncodings lists the supported encodings in order of preference
+var variantEncodings = []string{encodingBrotli, encodingGzip}
+
+// variantKey returns the object key of a blob's precompressed variant
+func variantKey(hash, encoding string) string {
+	if encoding == encodingBrotli {
+		return blobKey(hash) + ".br"
+	}
+	return blobKey(hash) + ".gz"
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && compressibleTypes[mediaType]
+}
+
+// compressVariants creates the missing precompressed variants of the
+// deployment's files and records how many bytes they take. A file that can't
+// be compressed is still served, just uncompressed.
+func (u *deploymentUpload) compressVariants() error {
+	rows, err := u.db.Query(`
+		SELECT DISTINCT f.hash, f.size_bytes, f.content_type
+		FROM deployment_files f
+		JOIN blobs b ON b.project_id = $2 AND b.hash = f.hash
+		WHERE f.deployment_id = $1 AND NOT b.variants_generated
+		AND f.size_bytes BETWEEN $3 AND $4
+	`, u.deploymentID, u.projectID, minCompressSize, maxCompressSize)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		hash, contentType string
+	}
+	var blobs []pending
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var p pending
+		var size int64
+		if err := rows.Scan(&p.hash, &size, &p.contentType); err != nil {
+			rows.Close()
+			return err
+		}
+		if isCompressible(p.contentType) && !seen[p.hash] {
+			seen[p.hash] = true
+			blobs = append(blobs, p)
+		}
+	}
+	rows.Close()
+
+	if len(blobs) > 0 {
+		u.enterPhase(phaseCompress, "Compressing %d files", len(blobs))
+	}
+	for _, b := range blobs {
+		if err := u.compressBlob(b.hash, b.contentType); err != nil {
+			if u.ctx.Err() != nil {
+				return u.ctx.Err()
+			}
+			log.Printf("Compression error for blob %s: %v", b.hash, err)
+			u.logf(logWarn, "Could not compress %s, it will be served uncompressed", b.hash[:12])
+		}
+	}
+
+	err = u.db.QueryRow(`
+		UPDATE deployments SET compressed_bytes = (
+			SELECT COALESCE(SUM(v.size_bytes), 0)
+			FROM deployment_files f
+			JOIN blob_variants v ON v.project_id = $2 AND v.hash = f.hash
+			WHERE f.deployment_id = $1
+		)
+		WHERE id = $1
+		RETURNING compressed_bytes
+	`, u.deploymentID, u.projectID).Scan(&u.compressedSize)
+	if err != nil {
+		return err
+	}
+
+	if u.compressedSize > 0 {
+		u.logf(logInfo, "Precompressed variants take %d bytes", u.compressedSize)
+	}
+	return nil
+}
+
+// compressBlob stores the gzip and brotli variants of one blob
+func (u *deploymentUpload) compressBlob(hash, contentType string) error {
+	obj, err := u.minioClient.GetObject(u.ctx, u.projectName, blobKey(hash), minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	original, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, encoding := range variantEncodings {
+		compressed, err := compressBytes(original, encoding)
+		if err != nil {
+			return err
+		}
+		if len(compressed) >= len(original) {
+			continue
+		}
+
+		if err := putVariant(u.ctx, u.db, u.minioClient, u.projectID, u.projectName, hash, encoding, compressed, contentType); err != nil {
+			return err
+		}
+	}
+
+	_, err = u.db.Exec(`
+		UPDATE blobs SET variants_generated = TRUE WHERE project_id = $1 AND hash = $2
+	`, u.projectID, hash)
+	return err
+}
+
+// compressBytes compresses data with the best level of an encoding
+func compressBytes(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == encodingBrotli {
+		w = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	} else {
+		gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = gz
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// putVariant uploads a precompressed variant of a blob and records it
+func putVariant(ctx context.Context, db *sql.DB, minioClient *minio.Client, projectID, bucket, hash, encoding string, data []byte, contentType string) error {
+	_, err := minioClient.PutObject(ctx, bucket, variantKey(hash, encoding), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO blob_variants (project_id, hash, encoding, size_bytes)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (project_id, hash, encoding) DO UPDATE SET size_bytes = EXCLUDED.size_bytes
+	`, projectID, hash, encoding, len(data))
+	return err
+}
+
+// negotiateEncoding picks the encoding with the highest qvalue the client
+// accepts among the available variants, or "" to serve the original. As in
+// RFC 9110 §12.5.3, "*" stands for the encodings not listed and q=0 rules an
+// encoding out. Ties go to the order of variantEncodings, and the original
+// wins over a variant the client likes less than identity.
+func negotiateEncoding(acceptEncoding string, available []string) string {
+	if len(available) == 0 || acceptEncoding == "" {
+		return ""
+	}
+
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			}
+		}
+		qvalues[name] = q
+	}
+
+	qvalue := func(encoding string) (float64, bool) {
+		if q, ok := qvalues[encoding]; ok {
+			return q, true
+		}
+		q, ok := qvalues["*"]
+		return q, ok
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range variantEncodings {
+		q, ok := qvalue(encoding)
+		if !ok || q <= bestQ {
+			continue
+		}
+		for _, a := range available {
+			if a == encoding {
+				best, bestQ = encoding, q
+				break
+			}
+		}
+	}
+
+	if q, ok := qvalue("identity"); ok && q > bestQ {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import "testing"
+
+func TestNegotiateEncoding(t *testing.T) {
+	both := []string{encodingGzip, encodingBrotli}
+
+	tests := []struct {
+		acceptEncoding string
+		available      []string
+		want           string
+	}{
+		{"", both, ""},
+		{"gzip, deflate, br", both, encodingBrotli},
+		{"gzip, deflate, br", []string{encodingGzip}, encodingGzip},
+		{"gzip, br", nil, ""},
+		{"GZIP", both, encodingGzip},
+		{"deflate", both, ""},
+		{"br;q=0.5, gzip", both, encodingGzip},
+		{"br;q=0, gzip", both, encodingGzip},
+		{"br;q=0", []string{encodingBrotli}, ""},
+		{"*", both, encodingBrotli},
+		{"*;q=0", both, ""},
+		{"gzip, *;q=0", both, encodingGzip},
+		{"br;q=0, *", both, encodingGzip},
+		{"identity;q=1, *;q=0", both, ""},
+		{"identity, gzip", both, encodingGzip},
+		{"identity;q=1, gzip;q=0.5", both, ""},
+		{"gzip;q=0.5, *;q=0.8", both, encodingBrotli},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			if got := negotiateEncoding(tt.acceptEncoding, tt.available); got != tt.want {
+				t.Errorf("negotiateEncoding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,30 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"path/filepath"
-	"strings"
-	"io"
 
 	"github.com/dhruvsingh/deployer-backend/config"
 	"github.com/dhruvsingh/deployer-backend/middleware"
 	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/dhruvsingh/deployer-shared/manifest"
 	"github.com/gorilla/mux"
 	"github.com/minio/minio-go/v7"
 )
 
-func DeployProject(db *sql.DB, minioClient *minio.Client, cfg *config.Config) http.HandlerFunc {
+// DeployProject accepts a deployment and queues it for processing. The body is
+// either a multipart form (one part per file) or a single .tar.gz / .zip
+// archive; it is spooled to disk, stored as the job payload and processed by
+// a deploy worker. Clients poll GET /api/deployments/{id} for the outcome.
+func DeployProject(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUserFromContext(r)
 		if user == nil {
@@ -26,273 +32,145 @@ func DeployProject(db *sql.DB, minioClient *minio.Client, cfg *config.Config) ht
 			return
 		}
 
-		// Parse multipart form (max 500MB)
-		if err := r.ParseMultipartForm(500 << 20); err != nil {
-			respondError(w, "Failed to parse form", http.StatusBadRequest)
-			return
-		}
-
-		projectName := r.FormValue("project_name")
-		if projectName == "" {
-			respondError(w, "project_name is required", http.StatusBadRequest)
+		contentType := r.Header.Get("Content-Type")
+		mediaType, params, _ := mime.ParseMediaType(contentType)
+		if mediaType != "multipart/form-data" && archiveFormat(mediaType) == "" {
+			respondError(w, "Unsupported content type: send multipart/form-data, a .tar.gz or a .zip archive", http.StatusUnsupportedMediaType)
 			return
 		}
 
-		repoURL := r.FormValue("repo_url")
-		source := r.FormValue("source")
-		if source == "" {
-			source = "cli"
-		}
-		commitHash := r.FormValue("commit_hash")
-		commitMsg := r.FormValue("commit_message")
-
-		// Get user ID
-		var userID string
-		err := db.QueryRow("SELECT id FROM users WHERE email = $1", user.Email).Scan(&userID)
+		payload, err := spoolUpload(http.MaxBytesReader(w, r.Body, requestLimit()))
 		if err != nil {
-			respondError(w, "User not found", http.StatusNotFound)
-			return
-		}
-
-		// Get or create project
-		var projectID string
-		err = db.QueryRow("SELECT id FROM projects WHERE name = $1 AND user_id = $2", projectName, userID).Scan(&projectID)
-
-		if err == sql.ErrNoRows {
-			err = db.QueryRow(`
-				INSERT INTO projects (user_id, name, repo_url)
-				VALUES ($1, $2, $3)
-				RETURNING id
-			`, userID, projectName, sql.NullString{String: repoURL, Valid: repoURL != ""}).Scan(&projectID)
-
-			if err != nil {
-				respondError(w, "Failed to create project", http.StatusInternalServerError)
-				return
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				tooLarge := manifest.DeploymentTooLarge(instanceValidation["size"].MaxDeploymentBytes)
+				respondUploadError(w, &uploadError{Status: http.StatusRequestEntityTooLarge, Code: tooLarge.Code, Message: tooLarge.Message})
+			} else {
+				respondError(w, "Failed to read upload", http.StatusBadRequest)
 			}
-		} else if err != nil {
-			respondError(w, "Database error", http.StatusInternalServerError)
 			return
-		} else if repoURL != "" {
-			// Update repo_url if provided for existing project
-			_, _ = db.Exec("UPDATE projects SET repo_url = $1 WHERE id = $2", repoURL, projectID)
 		}
+		defer payload.Close()
 
-		// Calculate next version number
-		var nextVersion int
-		err = db.QueryRow(`
-			SELECT COALESCE(MAX(version), 0) + 1
-			FROM deployments WHERE project_id = $1
-		`, projectID).Scan(&nextVersion)
-		if err != nil {
-			nextVersion = 1
+		var meta deploymentMeta
+		if mediaType == "multipart/form-data" {
+			meta, err = readMultipartMeta(payload, params["boundary"])
+			if err == nil {
+				_, err = payload.Seek(0, io.SeekStart)
+			}
+		} else {
+			query := r.URL.Query()
+			meta = deploymentMeta{
+				ProjectName:   query.Get("project_name"),
+				RepoURL:       query.Get("repo_url"),
+				Source:        query.Get("source"),
+				CommitHash:    query.Get("commit_hash"),
+				CommitMessage: query.Get("commit_message"),
+				Environment:   query.Get("environment"),
+				Branch:        query.Get("branch"),
+				SPAMode:       parseSPAMode(query.Get("spa")),
+			}
 		}
-
-		// Create deployment record
-		var deploymentID string
-		err = db.QueryRow(`
-			INSERT INTO deployments (project_id, status, version, source, commit_hash, commit_message)
-			VALUES ($1, 'uploading', $2, $3, $4, $5)
-			RETURNING id
-		`, projectID, nextVersion, source, 
-			sql.NullString{String: commitHash, Valid: commitHash != ""},
-			sql.NullString{String: commitMsg, Valid: commitMsg != ""}).Scan(&deploymentID)
-
 		if err != nil {
-			respondError(w, "Failed to create deployment", http.StatusInternalServerError)
+			respondUploadError(w, err)
 			return
 		}
 
-		log.Printf("📦 Deployment v%d started for project '%s' (deployment=%s)", nextVersion, projectName, deploymentID)
-
-		// Create bucket if it doesn't exist
-		ctx := context.Background()
-		bucketExists, err := minioClient.BucketExists(ctx, projectName)
+		upload, err := startDeployment(r.Context(), db, minioClient, user.Email, meta, "queued")
 		if err != nil {
-			updateDeploymentStatus(db, deploymentID, "failed", fmt.Sprintf("Bucket check error: %v", err))
-			respondError(w, "MinIO error", http.StatusInternalServerError)
+			respondUploadError(w, err)
 			return
 		}
 
-		if !bucketExists {
-			err = minioClient.MakeBucket(ctx, projectName, minio.MakeBucketOptions{})
-			if err != nil {
-				updateDeploymentStatus(db, deploymentID, "failed", fmt.Sprintf("Bucket creation error: %v", err))
-				respondError(w, "Failed to create bucket", http.StatusInternalServerError)
-				return
-			}
-
-			policy := fmt.Sprintf(`{
-				"Version": "2012-10-17",
-				"Statement": [{
-					"Effect": "Allow",
-					"Principal": {"AWS": ["*"]},
-					"Action": ["s3:GetObject"],
-					"Resource": ["arn:aws:s3:::%s/*"]
-				}]
-			}`, projectName)
-
-			err = minioClient.SetBucketPolicy(ctx, projectName, policy)
-			if err != nil {
-				log.Printf("Warning: Failed to set bucket policy: %v", err)
-			}
+		if err := upload.enqueue(payload, payload.Size, contentType); err != nil {
+			respondUploadError(w, upload.abort(err))
+			return
 		}
 
-		// Validate uploaded files before processing
-		files := r.MultipartForm.File["files"]
-
-		// Pre-validation: check all files before uploading anything
-		hasIndexHTML := false
-		var preValidationSize int64
-		var rejectedFiles []string
-
-		for _, fileHeader := range files {
-			objectName := fileHeader.Header.Get("X-File-Path")
-			if objectName == "" {
-				objectName = fileHeader.Filename
-			}
-
-			// Check for index.html
-			if objectName == "index.html" || strings.HasSuffix(objectName, "/index.html") {
-				hasIndexHTML = true
-			}
-
-			// Validate file extension
-			if !isAllowedFileType(objectName) {
-				rejectedFiles = append(rejectedFiles, objectName)
-			}
+		respondJSON(w, upload.queuedResult(), http.StatusAccepted)
+	}
+}
 
-			// Check individual file size (50MB max)
-			if fileHeader.Size > 50<<20 {
-				updateDeploymentStatus(db, deploymentID, "failed", fmt.Sprintf("File too large: %s (%d bytes)", objectName, fileHeader.Size))
-				respondError(w, fmt.Sprintf("File '%s' exceeds 50MB limit", objectName), http.StatusBadRequest)
-				return
-			}
+// readMultipartMeta reads the form fields of a multipart deploy body. Fields
+// must precede the files, so reading stops at the first file.
+func readMultipartMeta(body io.Reader, boundary string) (deploymentMeta, error) {
+	var meta deploymentMeta
+	if boundary == "" {
+		return meta, &uploadError{Status: http.StatusBadRequest, Message: "Failed to parse form"}
+	}
 
-			preValidationSize += fileHeader.Size
+	reader := multipart.NewReader(body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return meta, &uploadError{Status: http.StatusBadRequest, Message: "No files uploaded"}
 		}
-
-		// Reject if disallowed file types found
-		if len(rejectedFiles) > 0 {
-			updateDeploymentStatus(db, deploymentID, "failed", fmt.Sprintf("Disallowed file types: %v", rejectedFiles))
-			respondError(w, fmt.Sprintf("Upload rejected: unsupported file types: %s. Only static web assets are allowed (html, css, js, images, fonts, media).", strings.Join(rejectedFiles, ", ")), http.StatusBadRequest)
-			return
+		if err != nil {
+			return meta, &uploadError{Status: http.StatusBadRequest, Message: "Failed to parse form"}
+		}
+
+		if part.FormName() == "files" {
+			part.Close()
+			return meta, nil
+		}
+
+		value, _ := io.ReadAll(io.LimitReader(part, maxFieldSize))
+		part.Close()
+		switch part.FormName() {
+		case "project_name":
+			meta.ProjectName = string(value)
+		case "repo_url":
+			meta.RepoURL = string(value)
+		case "source":
+			meta.Source = string(value)
+		case "commit_hash":
+			meta.CommitHash = string(value)
+		case "commit_message":
+			meta.CommitMessage = string(value)
+		case "environment":
+			meta.Environment = string(value)
+		case "branch":
+			meta.Branch = string(value)
+		case "spa":
+			meta.SPAMode = parseSPAMode(string(value))
 		}
+	}
+}
 
-		// Require at least one HTML file
-		if !hasIndexHTML {
-			updateDeploymentStatus(db, deploymentID, "failed", "No index.html found")
-			respondError(w, "Deployment must contain an index.html file. Only static websites can be deployed.", http.StatusBadRequest)
-			return
-		}
+// ingestMultipart streams the files of a multipart deploy body part by part
+// to add. Form fields were read when the deployment was queued.
+func ingestMultipart(body io.Reader, boundary string, add func(name, contentType string, r io.Reader) error) error {
+	reader := multipart.NewReader(body, boundary)
 
-		// Check total deployment size (200MB max)
-		if preValidationSize > 200<<20 {
-			updateDeploymentStatus(db, deploymentID, "failed", fmt.Sprintf("Total size too large: %d bytes", preValidationSize))
-			respondError(w, fmt.Sprintf("Total deployment size exceeds 200MB limit (%d MB)", preValidationSize>>20), http.StatusBadRequest)
-			return
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
 		}
-
-		// Check per-user storage quota (500MB across all projects)
-		var userTotalStorage int64
-		db.QueryRow(`
-			SELECT COALESCE(SUM(d.size_bytes), 0)
-			FROM deployments d
-			JOIN projects p ON d.project_id = p.id
-			WHERE p.user_id = $1 AND d.status = 'success'
-		`, userID).Scan(&userTotalStorage)
-
-		if userTotalStorage+preValidationSize > 500<<20 {
-			updateDeploymentStatus(db, deploymentID, "failed", "User storage quota exceeded")
-			respondError(w, fmt.Sprintf("Storage quota exceeded. You're using %d MB of 500 MB. This deployment needs %d MB.", userTotalStorage>>20, preValidationSize>>20), http.StatusForbidden)
-			return
+		if err != nil {
+			return &uploadError{Status: http.StatusBadRequest, Message: "Failed to parse form", Log: fmt.Sprintf("Corrupt upload: %v", err)}
 		}
 
-		log.Printf("✅ Validation passed: %d files, %d bytes, index.html present", len(files), preValidationSize)
-
-		// Upload files to both root (live) and _deployments/{id}/ (versioned)
-		filesCount := 0
-		var totalSize int64
-		versionPrefix := fmt.Sprintf("_deployments/%s/", deploymentID)
-
-		for _, fileHeader := range files {
-			file, err := fileHeader.Open()
-			if err != nil {
-				continue
-			}
-
-			objectName := fileHeader.Header.Get("X-File-Path")
-			if objectName == "" {
-				objectName = fileHeader.Filename
-			}
-
-			contentType := fileHeader.Header.Get("Content-Type")
-			if contentType == "" {
-				contentType = getContentType(objectName)
-			}
-
-			// Read file content into memory for dual upload
-			fileBytes, err := io.ReadAll(file)
-			file.Close()
-			if err != nil {
-				log.Printf("Failed to read file %s: %v", objectName, err)
-				continue
-			}
-
-			// Upload to root (live serving)
-			_, err = minioClient.PutObject(ctx, projectName, objectName,
-				bytes.NewReader(fileBytes), int64(len(fileBytes)),
-				minio.PutObjectOptions{ContentType: contentType})
-			if err != nil {
-				log.Printf("Failed to upload %s to root: %v", objectName, err)
-				continue
-			}
-
-			// Upload to versioned path (_deployments/{deployment-id}/...)
-			_, err = minioClient.PutObject(ctx, projectName, versionPrefix+objectName,
-				bytes.NewReader(fileBytes), int64(len(fileBytes)),
-				minio.PutObjectOptions{ContentType: contentType})
-			if err != nil {
-				log.Printf("Failed to upload %s to version store: %v", objectName, err)
-			}
-
-			filesCount++
-			totalSize += int64(len(fileBytes))
+		if part.FormName() != "files" {
+			part.Close()
+			continue
 		}
 
-		// Update deployment record
-		_, err = db.Exec(`
-			UPDATE deployments
-			SET status = 'success', files_count = $1, size_bytes = $2
-			WHERE id = $3
-		`, filesCount, totalSize, deploymentID)
-
-		if err != nil {
-			log.Printf("Failed to update deployment: %v", err)
+		objectName := part.Header.Get("X-File-Path")
+		if objectName == "" {
+			objectName = part.FileName()
 		}
 
-		// Set this deployment as the active one for the project
-		_, err = db.Exec(`
-			UPDATE projects SET active_deployment_id = $1, updated_at = NOW()
-			WHERE id = $2
-		`, deploymentID, projectID)
+		err = add(objectName, part.Header.Get("Content-Type"), part)
+		part.Close()
 		if err != nil {
-			log.Printf("Failed to set active deployment: %v", err)
+			return err
 		}
-
-		log.Printf("✅ Deployment v%d complete: %d files, %d bytes", nextVersion, filesCount, totalSize)
-
-		respondJSON(w, map[string]interface{}{
-			"deployment_id": deploymentID,
-			"project_name":  projectName,
-			"version":       nextVersion,
-			"files_count":   filesCount,
-			"size_bytes":    totalSize,
-			"url":           fmt.Sprintf("http://%s.%s", projectName, cfg.DeployDomain),
-		}, http.StatusOK)
 	}
 }
 
-// RollbackDeployment restores a previous deployment version to the bucket root
+// RollbackDeployment makes a previous deployment version the live one again
+// in the environment it was deployed to, or in its branch preview
 func RollbackDeployment(db *sql.DB, minioClient *minio.Client, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUserFromContext(r)
@@ -325,10 +203,13 @@ func RollbackDeployment(db *sql.DB, minioClient *minio.Client, cfg *config.Confi
 		}
 
 		var deployVersion int
+		var environment, branch, branchSlug string
 		err = db.QueryRow(`
-			SELECT version FROM deployments
-			WHERE id = $1 AND project_id = $2 AND status = 'success'
-		`, deploymentID, projectID).Scan(&deployVersion)
+			SELECT d.version, COALESCE(d.environment, ''), COALESCE(d.branch, ''), COALESCE(b.slug, '')
+			FROM deployments d
+			LEFT JOIN branch_aliases b ON b.project_id = d.project_id AND b.branch = d.branch
+			WHERE d.id = $1 AND d.project_id = $2 AND d.status = 'success'
+		`, deploymentID, projectID).Scan(&deployVersion, &environment, &branch, &branchSlug)
 		if err == sql.ErrNoRows {
 			respondError(w, "Deployment not found or not successful", http.StatusNotFound)
 			return
@@ -337,86 +218,58 @@ func RollbackDeployment(db *sql.DB, minioClient *minio.Client, cfg *config.Confi
 			return
 		}
 
-		log.Printf("🔄 Rolling back project '%s' to v%d (deployment=%s)", projectName, deployVersion, deploymentID)
-
-		ctx := context.Background()
-		versionPrefix := fmt.Sprintf("_deployments/%s/", deploymentID)
-
-		// Pre-check: verify versioned files exist before wiping root
-		hasVersionedFiles := false
-		preCheckCh := minioClient.ListObjects(ctx, projectName, minio.ListObjectsOptions{
-			Prefix:    versionPrefix,
-			Recursive: true,
-		})
-		for obj := range preCheckCh {
-			if obj.Err == nil && obj.Key != "" {
-				hasVersionedFiles = true
-				// drain the channel
+		// A preview goes back onto its branch's alias, never into an environment
+		target, url := environment, environmentURL(projectName, environment, cfg.DeployDomain)
+		if environment == "" {
+			if branchSlug == "" {
+				respondError(w, fmt.Sprintf("Cannot rollback to v%d: the preview of branch '%s' was deleted", deployVersion, branch), http.StatusConflict)
+				return
 			}
+			target, url = fmt.Sprintf("the preview of branch '%s'", branch), branchURL(branchSlug, projectName, cfg.DeployDomain)
 		}
 
-		if !hasVersionedFiles {
-			log.Printf("❌ Rollback aborted: no versioned files found under %s", versionPrefix)
-			respondError(w, fmt.Sprintf("Cannot rollback to v%d: no versioned snapshot exists for this deployment (pre-versioning deployment)", deployVersion), http.StatusBadRequest)
+		log.Printf("🔄 Rolling back %s of project '%s' to v%d (deployment=%s)", target, projectName, deployVersion, deploymentID)
+
+		// Verify the deployment's files still exist before switching to it:
+		// either a manifest or, for older deployments, a versioned snapshot
+		snapshotExists, err := hasManifest(db, deploymentID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
 			return
 		}
-
-		// Step 1: Delete all root-level files (not under _deployments/)
-		objectsCh := minioClient.ListObjects(ctx, projectName, minio.ListObjectsOptions{Recursive: true})
-		for obj := range objectsCh {
-			if obj.Err != nil {
-				continue
-			}
-			if strings.HasPrefix(obj.Key, "_deployments/") {
-				continue
-			}
-			minioClient.RemoveObject(ctx, projectName, obj.Key, minio.RemoveObjectOptions{})
+		if !snapshotExists {
+			snapshotExists = hasObjectsUnder(context.Background(), minioClient, projectName, deploymentPrefix(deploymentID))
 		}
 
-		// Step 2: Copy versioned files back to root
-		copiedFiles := 0
-		versionObjects := minioClient.ListObjects(ctx, projectName, minio.ListObjectsOptions{
-			Prefix:    versionPrefix,
-			Recursive: true,
-		})
-
-		for obj := range versionObjects {
-			if obj.Err != nil {
-				log.Printf("Error listing versioned object: %v", obj.Err)
-				continue
-			}
-
-			originalPath := obj.Key[len(versionPrefix):]
-
-			_, err := minioClient.CopyObject(ctx,
-				minio.CopyDestOptions{Bucket: projectName, Object: originalPath},
-				minio.CopySrcOptions{Bucket: projectName, Object: obj.Key},
-			)
-			if err != nil {
-				log.Printf("Failed to copy %s: %v", originalPath, err)
-				continue
-			}
-			copiedFiles++
+		if !snapshotExists {
+			log.Printf("❌ Rollback aborted: no manifest or versioned files for deployment %s", deploymentID)
+			appendDeploymentLog(db, deploymentID, logWarn, phaseRollback, "Rollback aborted: no manifest or versioned files exist for this deployment")
+			respondError(w, fmt.Sprintf("Cannot rollback to v%d: no versioned snapshot exists for this deployment (pre-versioning deployment)", deployVersion), http.StatusBadRequest)
+			return
 		}
 
-		// Step 3: Update active deployment in database
-		_, err = db.Exec(`
-			UPDATE projects SET active_deployment_id = $1, updated_at = NOW()
-			WHERE id = $2
-		`, deploymentID, projectID)
+		// Switch the live deployment; the site server picks it up on the next
+		// request
+		if environment == "" {
+			err = setBranchDeployment(db, projectID, branch, deploymentID)
+		} else {
+			err = setEnvironmentDeployment(db, projectID, environment, deploymentID)
+		}
 		if err != nil {
 			respondError(w, "Failed to update active deployment", http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("✅ Rollback complete: %d files restored to v%d", copiedFiles, deployVersion)
+		log.Printf("✅ Rollback complete: %s of project '%s' now serving v%d", target, projectName, deployVersion)
+		appendDeploymentLog(db, deploymentID, logInfo, phaseRollback, fmt.Sprintf("Rolled back: %s of project '%s' is serving v%d again", target, projectName, deployVersion))
 
 		respondJSON(w, map[string]interface{}{
 			"message":       fmt.Sprintf("Rolled back to v%d", deployVersion),
 			"deployment_id": deploymentID,
 			"version":       deployVersion,
-			"files_copied":  copiedFiles,
-			"url":           fmt.Sprintf("http://%s.%s", projectName, cfg.DeployDomain),
+			"environment":   environment,
+			"branch":        branch,
+			"url":           url,
 		}, http.StatusOK)
 	}
 }
@@ -453,7 +306,7 @@ func ListProjectDeployments(db *sql.DB) http.HandlerFunc {
 		}
 
 		rows, err := db.Query(`
-			SELECT id, project_id, version, status, source, commit_hash, commit_message, files_count, size_bytes, logs, created_at
+			SELECT id, project_id, version, status, COALESCE(environment, ''), COALESCE(branch, ''), source, commit_hash, commit_message, files_count, size_bytes, stored_bytes, compressed_bytes, logs, pinned, protected, created_at
 			FROM deployments
 			WHERE project_id = $1
 			ORDER BY version DESC
@@ -468,8 +321,8 @@ func ListProjectDeployments(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var d models.Deployment
 			var commitHash, commitMsg sql.NullString
-			if err := rows.Scan(&d.ID, &d.ProjectID, &d.Version, &d.Status, &d.Source, &commitHash, &commitMsg,
-				&d.FilesCount, &d.SizeBytes, &d.Logs, &d.CreatedAt); err != nil {
+			if err := rows.Scan(&d.ID, &d.ProjectID, &d.Version, &d.Status, &d.Environment, &d.Branch, &d.Source, &commitHash, &commitMsg,
+				&d.FilesCount, &d.SizeBytes, &d.StoredBytes, &d.CompressedBytes, &d.Logs, &d.Pinned, &d.Protected, &d.CreatedAt); err != nil {
 				continue
 			}
 			if commitHash.Valid {
@@ -488,7 +341,9 @@ func ListProjectDeployments(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetDeploymentStatus(db *sql.DB) http.HandlerFunc {
+// GetDeploymentStatus returns a deployment. Clients poll it after a deploy
+// was queued until the status is success, failed or cancelled.
+func GetDeploymentStatus(db *sql.DB, cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUserFromContext(r)
 		if user == nil {
@@ -501,15 +356,18 @@ func GetDeploymentStatus(db *sql.DB) http.HandlerFunc {
 
 		var deployment models.Deployment
 		var commitHash, commitMsg sql.NullString
+		var projectName, branchSlug string
+		var fileErrors, brokenLinks []byte
 		err := db.QueryRow(`
-			SELECT d.id, d.project_id, d.version, d.status, d.source, d.commit_hash, d.commit_message, d.files_count, d.size_bytes, d.logs, d.created_at
+			SELECT d.id, d.project_id, p.name, d.version, d.status, COALESCE(d.environment, ''), COALESCE(d.branch, ''), COALESCE(b.slug, ''), d.source, d.commit_hash, d.commit_message, d.files_count, d.size_bytes, d.stored_bytes, d.compressed_bytes, d.logs, d.error_code, d.file_errors, d.broken_links, d.pinned, d.protected, d.created_at
 			FROM deployments d
 			JOIN projects p ON d.project_id = p.id
 			JOIN users u ON p.user_id = u.id
+			LEFT JOIN branch_aliases b ON b.project_id = d.project_id AND b.branch = d.branch
 			WHERE d.id = $1 AND u.email = $2
 		`, deploymentID, user.Email).Scan(
-			&deployment.ID, &deployment.ProjectID, &deployment.Version, &deployment.Status, &deployment.Source, &commitHash, &commitMsg,
-			&deployment.FilesCount, &deployment.SizeBytes, &deployment.Logs, &deployment.CreatedAt,
+			&deployment.ID, &deployment.ProjectID, &projectName, &deployment.Version, &deployment.Status, &deployment.Environment, &deployment.Branch, &branchSlug, &deployment.Source, &commitHash, &commitMsg,
+			&deployment.FilesCount, &deployment.SizeBytes, &deployment.StoredBytes, &deployment.CompressedBytes, &deployment.Logs, &deployment.ErrorCode, &fileErrors, &brokenLinks, &deployment.Pinned, &deployment.Protected, &deployment.CreatedAt,
 		)
 
 		if err == sql.ErrNoRows {
@@ -526,11 +384,24 @@ func GetDeploymentStatus(db *sql.DB) http.HandlerFunc {
 		if commitMsg.Valid {
 			deployment.CommitMessage = &commitMsg.String
 		}
+		if fileErrors != nil {
+			json.Unmarshal(fileErrors, &deployment.FileErrors)
+		}
+		if brokenLinks != nil {
+			json.Unmarshal(brokenLinks, &deployment.BrokenLinks)
+		}
+		if deployment.Status == "success" && deployment.Environment != "" {
+			deployment.URL = environmentURL(projectName, deployment.Environment, cfg.DeployDomain)
+		} else if deployment.Status == "success" && branchSlug != "" {
+			deployment.URL = branchURL(branchSlug, projectName, cfg.DeployDomain)
+		}
 
 		respondJSON(w, deployment, http.StatusOK)
 	}
 }
 
+// GetDeploymentLogs returns a deployment's log lines along with its final
+// failure message, if any
 func GetDeploymentLogs(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUserFromContext(r)
@@ -542,14 +413,15 @@ func GetDeploymentLogs(db *sql.DB) http.HandlerFunc {
 		vars := mux.Vars(r)
 		deploymentID := vars["id"]
 
+		var id string
 		var logs sql.NullString
 		err := db.QueryRow(`
-			SELECT d.logs
+			SELECT d.id, d.logs
 			FROM deployments d
 			JOIN projects p ON d.project_id = p.id
 			JOIN users u ON p.user_id = u.id
 			WHERE d.id = $1 AND u.email = $2
-		`, deploymentID, user.Email).Scan(&logs)
+		`, deploymentID, user.Email).Scan(&id, &logs)
 
 		if err == sql.ErrNoRows {
 			respondError(w, "Deployment not found", http.StatusNotFound)
@@ -564,7 +436,16 @@ func GetDeploymentLogs(db *sql.DB) http.HandlerFunc {
 			logStr = logs.String
 		}
 
-		respondJSON(w, map[string]string{"logs": logStr}, http.StatusOK)
+		lines, err := deploymentLogLines(db, id, 0)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"logs":  logStr,
+			"lines": lines,
+		}, http.StatusOK)
 	}
 }
 
@@ -572,7 +453,7 @@ func updateDeploymentStatus(db *sql.DB, deploymentID, status, logs string) {
 	_, err := db.Exec(`
 		UPDATE deployments
 		SET status = $1, logs = $2
-		WHERE id = $3
+		WHERE id = $3 AND status <> 'cancelled'
 	`, status, logs, deploymentID)
 
 	if err != nil {
@@ -580,101 +461,68 @@ func updateDeploymentStatus(db *sql.DB, deploymentID, status, logs string) {
 	}
 }
 
-func getContentType(filename string) string {
-	ext := strings.ToLower(filepath.Ext(filename))
-	contentTypes := map[string]string{
-		// Markup & Data
-		".html": "text/html",
-		".htm":  "text/html",
-		".css":  "text/css",
-		".js":   "application/javascript",
-		".mjs":  "application/javascript",
-		".json": "application/json",
-		".xml":  "application/xml",
-		".txt":  "text/plain",
-		".md":   "text/markdown",
-		".csv":  "text/csv",
-		".map":  "application/json",
-		// Images
-		".png":  "image/png",
-		".jpg":  "image/jpeg",
-		".jpeg": "image/jpeg",
-		".gif":  "image/gif",
-		".svg":  "image/svg+xml",
-		".ico":  "image/x-icon",
-		".webp": "image/webp",
-		".avif": "image/avif",
-		".bmp":  "image/bmp",
-		".tiff": "image/tiff",
-		".tif":  "image/tiff",
-		// Fonts
-		".woff":  "font/woff",
-		".woff2": "font/woff2",
-		".ttf":   "font/ttf",
-		".otf":   "font/otf",
-		".eot":   "application/vnd.ms-fontobject",
-		// Audio
-		".mp3":  "audio/mpeg",
-		".ogg":  "audio/ogg",
-		".wav":  "audio/wav",
-		".flac": "audio/flac",
-		".aac":  "audio/aac",
-		".m4a":  "audio/mp4",
-		// Video
-		".mp4":  "video/mp4",
-		".webm": "video/webm",
-		".ogv":  "video/ogg",
-		// 3D & Misc
-		".glb":  "model/gltf-binary",
-		".gltf": "model/gltf+json",
-		".pdf":  "application/pdf",
-		".wasm": "application/wasm",
-		// Web manifest & config
-		".webmanifest": "application/manifest+json",
-		".manifest":    "text/cache-manifest",
+// activateDeployment marks a fully uploaded deployment as successful and makes
+// it the live version of its environment or, without one, of its branch
+// preview. Visitors switch over in a single step.
+func activateDeployment(db *sql.DB, projectID, deploymentID, environment, branch string, filesCount int, totalSize, storedSize int64, liveMessage string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	if ct, ok := contentTypes[ext]; ok {
-		return ct
+	// A deployment cancelled while it was processing must not go live
+	result, err := tx.Exec(`
+		UPDATE deployments
+		SET status = 'success', files_count = $1, size_bytes = $2, stored_bytes = $3
+		WHERE id = $4 AND status = 'processing'
+	`, filesCount, totalSize, storedSize, deploymentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errDeploymentCancelled
 	}
-	return "application/octet-stream"
-}
-
-// isAllowedFileType checks if a filename has a whitelisted static web extension
-func isAllowedFileType(filename string) bool {
-	ext := strings.ToLower(filepath.Ext(filename))
 
-	// Files with no extension are allowed (e.g. CNAME, LICENSE)
-	if ext == "" {
-		return true
+	if environment == "" {
+		err = setBranchDeployment(tx, projectID, branch, deploymentID)
+	} else {
+		err = setEnvironmentDeployment(tx, projectID, environment, deploymentID)
+	}
+	if err != nil {
+		return err
 	}
 
-	allowed := map[string]bool{
-		// Markup & Data
-		".html": true, ".htm": true, ".css": true, ".scss": true, ".less": true,
-		".js": true, ".mjs": true, ".jsx": true, ".ts": true, ".tsx": true,
-		".json": true, ".xml": true, ".txt": true, ".md": true, ".csv": true,
-		".map": true, ".yaml": true, ".yml": true, ".toml": true,
-		// Images
-		".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true,
-		".ico": true, ".webp": true, ".avif": true, ".bmp": true,
-		".tiff": true, ".tif": true, ".cur": true,
-		// Fonts
-		".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
-		// Audio
-		".mp3": true, ".ogg": true, ".wav": true, ".flac": true,
-		".aac": true, ".m4a": true, ".opus": true,
-		// Video
-		".mp4": true, ".webm": true, ".ogv": true, ".mov": true,
-		// 3D Models
-		".glb": true, ".gltf": true, ".obj": true, ".fbx": true, ".stl": true,
-		// Documents & Misc
-		".pdf": true, ".wasm": true,
-		// Web manifest & config
-		".webmanifest": true, ".manifest": true,
-		// Source maps & misc web
-		".LICENSE": true, ".license": true,
+	// Log streams end once the status is final, so the last line must be
+	// written before it is
+	if _, err := tx.Exec(`
+		INSERT INTO deployment_log_lines (deployment_id, level, phase, message)
+		VALUES ($1, $2, $3, $4)
+	`, deploymentID, logInfo, phaseActivate, liveMessage); err != nil {
+		return err
 	}
 
-	return allowed[ext]
+	return tx.Commit()
+}
+
+// deploymentPrefix returns the object prefix that held a deployment's files
+// before the blob store. Deployments without a manifest are served from it.
+func deploymentPrefix(deploymentID string) string {
+	return fmt.Sprintf("_deployments/%s/", deploymentID)
+}
+
+// hasObjectsUnder reports whether at least one object exists under prefix
+func hasObjectsUnder(ctx context.Context, minioClient *minio.Client, bucket, prefix string) bool {
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for obj := range minioClient.ListObjects(listCtx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if obj.Err == nil && obj.Key != "" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// Two deployments of a project are compared by their manifests: paths only
+// in one of them were added or removed, paths whose hash changed were
+// modified. Modified text files also get a unified diff of their content,
+// within limits on the size of the files and of the whole comparison.
+
+const (
+	// maxDiffFileSize bounds the files whose content is diffed
+	maxDiffFileSize = 256 << 10
+	// maxDiffBytes bounds the content read for a single comparison
+	maxDiffBytes = 4 << 20
+	// maxDiffCells bounds the line comparison table of a single file
+	maxDiffCells = 1 << 22
+	// diffContext is the number of unchanged lines around each hunk
+	diffContext = 3
+)
+
+// Reasons a modified file has no content diff
+const (
+	diffOmittedBinary   = "binary"
+	diffOmittedTooLarge = "too_large"
+	diffOmittedLimit    = "limit_reached"
+	diffOmittedError    = "unavailable"
+)
+
+// DiffDeployments lists the files added, removed and modified between two
+// deployments of a project. Each side is a deployment ID, a version number
+// or "active".
+func DiffDeployments(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		sides := make([]api.DeploymentRef, 2)
+		files := make([][]manifest.File, 2)
+		for i, ref := range []string{vars["from"], vars["to"]} {
+			d, err := resolveDeploymentRef(db, projectID, ref)
+			if err == sql.ErrNoRows {
+				respondError(w, fmt.Sprintf("Deployment %s not found", ref), http.StatusNotFound)
+				return
+			} else if err != nil {
+				respondError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+
+			f, err := deploymentManifest(db, d.ID)
+			if err != nil {
+				respondError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if len(f) == 0 {
+				respondError(w, fmt.Sprintf("v%d has no file manifest to compare (deployed before incremental deploys)", d.Version), http.StatusConflict)
+				return
+			}
+			sides[i], files[i] = d, f
+		}
+
+		var bucket string
+		if err := db.QueryRow("SELECT name FROM projects WHERE id = $1", projectID).Scan(&bucket); err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		diff := manifest.Diff(files[0], files[1])
+		diff.From, diff.To = sides[0], sides[1]
+		addContentDiffs(r.Context(), minioClient, bucket, diff.Modified, files[0], files[1])
+
+		respondJSON(w, diff, http.StatusOK)
+	}
+}
+
+// ListDeploymentFiles returns the manifest of a deployment of a project. The
+// deployment is a deployment ID, a version number or "active".
+func ListDeploymentFiles(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		d, err := resolveDeploymentRef(db, projectID, vars["deployment"])
+		if err == sql.ErrNoRows {
+			respondError(w, fmt.Sprintf("Deployment %s not found", vars["deployment"]), http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		files, err := deploymentManifest(db, d.ID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(files) == 0 {
+			respondError(w, fmt.Sprintf("v%d has no file manifest (deployed before incremental deploys)", d.Version), http.StatusConflict)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"deployment": d,
+			"files":      files,
+		}, http.StatusOK)
+	}
+}
+
+// resolveDeploymentRef finds a deployment of a project by ID, by version
+// (with or without a leading "v"), as "active" or by the environment it is
+// live in. It returns sql.ErrNoRows when there is no such deployment.
+func resolveDeploymentRef(db *sql.DB, projectID, ref string) (api.DeploymentRef, error) {
+	var d api.DeploymentRef
+	var err error
+	if ref == "active" || ref == productionEnvironment {
+		err = db.QueryRow(`
+			SELECT d.id, d.version FROM projects p
+			JOIN deployments d ON d.id = p.active_deployment_id
+			WHERE p.id = $1
+		`, projectID).Scan(&d.ID, &d.Version)
+	} else if version, convErr := strconv.Atoi(strings.TrimPrefix(ref, "v")); convErr == nil {
+		err = db.QueryRow(`
+			SELECT id, version FROM deployments WHERE project_id = $1 AND version = $2
+		`, projectID, version).Scan(&d.ID, &d.Version)
+	} else if validEnvironment(ref) {
+		// Too short to be a deployment ID
+		err = db.QueryRow(`
+			SELECT d.id, d.version FROM project_environments e
+			JOIN deployments d ON d.id = e.active_deployment_id
+			WHERE e.project_id = $1 AND e.name = $2
+		`, projectID, ref).Scan(&d.ID, &d.Version)
+	} else {
+		err = db.QueryRow(`
+			SELECT id, version FROM deployments WHERE project_id = $1 AND id::text = $2
+		`, projectID, ref).Scan(&d.ID, &d.Version)
+	}
+	return d, err
+}
+
+// deploymentManifest returns the files of a deployment sorted by path
+func deploymentManifest(db *sql.DB, deploymentID string) ([]manifest.File, error) {
+	rows, err := db.Query(`
+		SELECT path, hash, size_bytes, content_type FROM deployment_files
+		WHERE deployment_id = $1
+		ORDER BY path
+	`, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []manifest.File{}
+	for rows.Next() {
+		var f manifest.File
+		if err := rows.Scan(&f.Path, &f.Hash, &f.Size, &f.ContentType); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// addContentDiffs fills in the unified diffs of the modified text files, in
+// path order until maxDiffBytes of content has been read
+func addContentDiffs(ctx context.Context, minioClient *minio.Client, bucket string, modified []api.FileChange, from, to []manifest.File) {
+	oldFiles := make(map[string]manifest.File, len(from))
+	for _, f := range from {
+		oldFiles[f.Path] = f
+	}
+	newFiles := make(map[string]manifest.File, len(to))
+	for _, f := range to {
+		newFiles[f.Path] = f
+	}
+
+	var budget int64 = maxDiffBytes
+	for i := range modified {
+		c := &modified[i]
+		a, b := oldFiles[c.Path], newFiles[c.Path]
+
+		switch {
+		case !mimetype.IsText(a.ContentType) || !mimetype.IsText(b.ContentType):
+			c.DiffOmitted = diffOmittedBinary
+			continue
+		case a.Size > maxDiffFileSize || b.Size > maxDiffFileSize:
+			c.DiffOmitted = diffOmittedTooLarge
+			continue
+		case a.Size+b.Size > budget:
+			c.DiffOmitted = diffOmittedLimit
+			continue
+		}
+		budget -= a.Size + b.Size
+
+		oldText, err := readBlob(ctx, minioClient, bucket, a.Hash)
+		if err == nil {
+			var newText []byte
+			if newText, err = readBlob(ctx, minioClient, bucket, b.Hash); err == nil {
+				c.Diff, c.DiffOmitted = contentDiff(c.Path, oldText, newText)
+				continue
+			}
+		}
+		log.Printf("Diff error for %s: %v", c.Path, err)
+		c.DiffOmitted = diffOmittedError
+	}
+}
+
+// readBlob reads a blob of a project, which must fit maxDiffFileSize
+func readBlob(ctx context.Context, minioClient *minio.Client, bucket, hash string) ([]byte, error) {
+	obj, err := minioClient.GetObject(ctx, bucket, blobKey(hash), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(io.LimitReader(obj, maxDiffFileSize))
+}
+
+// contentDiff returns the unified diff of two versions of a text file, or
+// why there is none
+func contentDiff(p string, oldText, newText []byte) (string, string) {
+	if bytes.IndexByte(oldText, 0) >= 0 || bytes.IndexByte(newText, 0) >= 0 {
+		return "", diffOmittedBinary
+	}
+	ops, ok := diffLines(splitLines(string(oldText)), splitLines(string(newText)))
+	if !ok {
+		return "", diffOmittedTooLarge
+	}
+	return unifiedDiff(p, ops), ""
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffOp is one line of an edit script: kept (' '), removed ('-') or
+// added ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines computes an edit script from a to b through their longest common
+// subsequence of lines. It gives up when the changed middle of the files is
+// too large to compare.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		return nil, false
+	}
+
+	// lcs[i*(len(y)+1)+j] is the length of the LCS of x[i:] and y[j:]
+	width := len(y) + 1
+	lcs := make([]int32, (len(x)+1)*width)
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+				lcs[i*width+j] = lcs[(i+1)*width+j]
+			} else {
+				lcs[i*width+j] = lcs[i*width+j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(y))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ops = append(ops, diffOp{' ', x[i]})
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[(i+1)*width+j] >= lcs[i*width+j+1]):
+			ops = append(ops, diffOp{'-', x[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', y[j]})
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops, true
+}
+
+// unifiedDiff formats an edit script as a unified diff with diffContext
+// lines of context
+func unifiedDiff(p string, ops []diffOp) string {
+	// oldLine[i] and newLine[i] count the lines before ops[i]
+	oldLine := make([]int, len(ops)+1)
+	newLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.kind != '+' {
+			oldLine[i+1]++
+		}
+		if op.kind != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", p, p)
+	for i := 0; ; {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end = min(run, end+diffContext)
+				break
+			}
+			end = run
+		}
+
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]))
+		for _, op := range ops[start:end] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.line)
+			b.WriteByte('\n')
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// hunkRange formats the range of a hunk from the number of lines before it
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/config"
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/gorilla/mux"
+)
+
+// A project has named environments, each with its own live deployment and
+// hostname. Production is the project's active deployment, served at
+// {project}.{DeployDomain}; every other environment lives in
+// project_environments and is served at {environment}.{project}.{DeployDomain}.
+// An environment is created by the first deployment to it, and a deployment
+// moves between environments by promotion, without being uploaded again.
+
+// productionEnvironment is the environment deployments go to by default
+const productionEnvironment = "production"
+
+// environmentPattern keeps environment names usable as a hostname label
+var environmentPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,30}[a-z0-9])?$`)
+
+// validEnvironment reports whether name can name an environment
+func validEnvironment(name string) bool {
+	return environmentPattern.MatchString(name)
+}
+
+// liveDeployment is an SQL condition on a deployment aliased d that holds
+// while it is live in any environment or branch preview of its project
+const liveDeployment = `(EXISTS (SELECT 1 FROM projects lp WHERE lp.active_deployment_id = d.id)
+	OR EXISTS (SELECT 1 FROM project_environments le WHERE le.active_deployment_id = d.id)
+	OR EXISTS (SELECT 1 FROM branch_aliases lb WHERE lb.active_deployment_id = d.id))`
+
+// environmentURL returns the address an environment of a project is served at
+func environmentURL(projectName, environment, domain string) string {
+	if environment == productionEnvironment {
+		return fmt.Sprintf("http://%s.%s", projectName, domain)
+	}
+	return fmt.Sprintf("http://%s.%s.%s", environment, projectName, domain)
+}
+
+// environmentDeployment returns the deployment live in an environment of a
+// project, or sql.ErrNoRows if the environment doesn't exist
+func environmentDeployment(db *sql.DB, projectID, environment string) (sql.NullString, error) {
+	var deploymentID sql.NullString
+	var err error
+	if environment == productionEnvironment {
+		err = db.QueryRow("SELECT active_deployment_id FROM projects WHERE id = $1", projectID).Scan(&deploymentID)
+	} else {
+		err = db.QueryRow(`
+			SELECT active_deployment_id FROM project_environments
+			WHERE project_id = $1 AND name = $2
+		`, projectID, environment).Scan(&deploymentID)
+	}
+	return deploymentID, err
+}
+
+// execer is what setEnvironmentDeployment needs of a *sql.DB or *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// setEnvironmentDeployment makes a deployment the live one of an environment,
+// creating the environment if it doesn't exist yet
+func setEnvironmentDeployment(ex execer, projectID, environment, deploymentID string) error {
+	if environment == productionEnvironment {
+		_, err := ex.Exec(`
+			UPDATE projects SET active_deployment_id = $1, updated_at = NOW()
+			WHERE id = $2
+		`, deploymentID, projectID)
+		return err
+	}
+
+	_, err := ex.Exec(`
+		INSERT INTO project_environments (project_id, name, active_deployment_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (project_id, name)
+		DO UPDATE SET active_deployment_id = EXCLUDED.active_deployment_id, updated_at = NOW()
+	`, projectID, environment, deploymentID)
+	return err
+}
+
+// ListEnvironments returns the environments of a project, production first
+func ListEnvironments(db *sql.DB, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var projectName string
+		production := api.Environment{Name: productionEnvironment}
+		var version sql.NullInt64
+		err := db.QueryRow(`
+			SELECT p.name, p.active_deployment_id, d.version
+			FROM projects p
+			LEFT JOIN deployments d ON d.id = p.active_deployment_id
+			WHERE p.id = $1
+		`, projectID).Scan(&projectName, &production.DeploymentID, &version)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		production.URL = environmentURL(projectName, productionEnvironment, cfg.DeployDomain)
+		if version.Valid {
+			v := int(version.Int64)
+			production.Version = &v
+		}
+		environments := []api.Environment{production}
+
+		rows, err := db.Query(`
+			SELECT e.name, e.active_deployment_id, d.version, e.updated_at
+			FROM project_environments e
+			LEFT JOIN deployments d ON d.id = e.active_deployment_id
+			WHERE e.project_id = $1
+			ORDER BY e.name
+		`, projectID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var env api.Environment
+			var version sql.NullInt64
+			var updatedAt time.Time
+			if err := rows.Scan(&env.Name, &env.DeploymentID, &version, &updatedAt); err != nil {
+				continue
+			}
+			if version.Valid {
+				v := int(version.Int64)
+				env.Version = &v
+			}
+			env.UpdatedAt = &updatedAt
+			env.URL = environmentURL(projectName, env.Name, cfg.DeployDomain)
+			environments = append(environments, env)
+		}
+
+		respondJSON(w, environments, http.StatusOK)
+	}
+}
+
+// PromoteDeployment makes the deployment live in one environment of a
+// project live in another, "production" unless the body names it. Nothing is
+// uploaded again: both environments serve the same deployment afterwards.
+func PromoteDeployment(db *sql.DB, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var req struct {
+			To string `json:"to"`
+		}
+		switch err := json.NewDecoder(r.Body).Decode(&req); {
+		case err == io.EOF:
+			// No body: promote to production
+		case err != nil:
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.To == "" {
+			req.To = productionEnvironment
+		}
+
+		from := vars["env"]
+		if !validEnvironment(req.To) {
+			respondError(w, fmt.Sprintf("Invalid environment name '%s': use lowercase letters, digits and dashes", req.To), http.StatusBadRequest)
+			return
+		}
+		if from == req.To {
+			respondError(w, "An environment can't be promoted to itself", http.StatusBadRequest)
+			return
+		}
+
+		deploymentID, err := environmentDeployment(db, projectID, from)
+		if err == sql.ErrNoRows || (err == nil && !deploymentID.Valid) {
+			respondError(w, fmt.Sprintf("Environment '%s' has no live deployment", from), http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var version int
+		var projectName string
+		err = db.QueryRow(`
+			SELECT d.version, p.name
+			FROM deployments d
+			JOIN projects p ON d.project_id = p.id
+			WHERE d.id = $1 AND d.status = 'success'
+		`, deploymentID.String).Scan(&version, &projectName)
+		if err == sql.ErrNoRows {
+			respondError(w, fmt.Sprintf("The deployment live in '%s' is not successful", from), http.StatusConflict)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// The site server picks the new deployment up on the next request
+		if err := setEnvironmentDeployment(db, projectID, req.To, deploymentID.String); err != nil {
+			respondError(w, "Failed to promote deployment", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🚀 Promoted v%d of '%s' from %s to %s", version, projectName, from, req.To)
+		appendDeploymentLog(db, deploymentID.String, logInfo, phasePromote, fmt.Sprintf("Promoted from %s to %s", from, req.To))
+
+		now := time.Now()
+		respondJSON(w, api.Environment{
+			Name:         req.To,
+			DeploymentID: &deploymentID.String,
+			Version:      &version,
+			URL:          environmentURL(projectName, req.To, cfg.DeployDomain),
+			UpdatedAt:    &now,
+		}, http.StatusOK)
+	}
+}
+
+// DeleteEnvironment removes an environment of a project. Its deployment is
+// kept, but no longer live there. Production can't be deleted.
+func DeleteEnvironment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		env := vars["env"]
+		if env == productionEnvironment {
+			respondError(w, "The production environment can't be deleted", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec("DELETE FROM project_environments WHERE project_id = $1 AND name = $2", projectID, env)
+		if err != nil {
+			respondError(w, "Failed to delete environment", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			respondError(w, fmt.Sprintf("Environment '%s' not found", env), http.StatusNotFound)
+			return
+		}
+
+		log.Printf("🗑️ Deleted environment '%s' of project %s", env, projectID)
+		respondJSON(w, map[string]string{"message": fmt.Sprintf("Environment '%s' deleted", env)}, http.StatusOK)
+	}
+}
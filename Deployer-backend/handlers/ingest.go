@@ -0,0 +1,563 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// userStorageQuota is the storage available to a user across all projects
+	userStorageQuota = 500 << 20
+	// maxManifestSize caps the JSON body of an incremental deploy manifest
+	maxManifestSize = 16 << 20
+	// maxFieldSize caps a single non-file form field
+	maxFieldSize = 64 << 10
+	// uploadPartSize bounds the buffer used per streamed object upload
+	uploadPartSize = 5 << 20
+)
+
+// uploadError is a deployment failure that should be reported to the client
+// with the given status and recorded in the deployment's logs. Code is the
+// machine-readable reason of a rejection. Files lists the individual files
+// that failed, if the failure is about files.
+type uploadError struct {
+	Status  int
+	Code    string
+	Message string
+	Log     string
+	Files   []models.FileError
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+// respondUploadError writes an uploadError (or a generic failure) to the client
+func respondUploadError(w http.ResponseWriter, err error) {
+	var upErr *uploadError
+	if !errors.As(err, &upErr) {
+		respondError(w, "Deployment failed", http.StatusInternalServerError)
+		return
+	}
+	body := map[string]interface{}{"error": upErr.Message}
+	if upErr.Code != "" {
+		body["code"] = upErr.Code
+	}
+	if len(upErr.Files) > 0 {
+		body["files"] = upErr.Files
+	}
+	respondJSON(w, body, upErr.Status)
+}
+
+// deploymentUpload tracks a deployment while its files stream into storage.
+// Validation runs incrementally as each file arrives so memory stays bounded
+// regardless of deployment size.
+type deploymentUpload struct {
+	db          *sql.DB
+	minioClient *minio.Client
+	ctx         context.Context
+
+	userID       string
+	projectID    string
+	projectName  string
+	deploymentID string
+	version      int
+	// environment is where the deployment goes live; empty for a preview of
+	// branch
+	environment string
+	branch      string
+
+	quotaRemaining int64
+	filesCount     int
+	totalSize      int64
+	storedSize     int64
+	compressedSize int64
+	fileErrors     []models.FileError
+	cacheRules     []cacheRule
+	siteRules      *siteRules
+	pipeline       *validationPipeline
+	lastProgress   time.Time
+	phase          string
+	queuePosition  int
+}
+
+// deploymentMeta holds the form fields describing a deployment
+type deploymentMeta struct {
+	ProjectName   string
+	RepoURL       string
+	Source        string
+	CommitHash    string
+	CommitMessage string
+	// Environment is where the deployment goes live. Without one, a branch
+	// other than the production branch goes to its preview and anything
+	// else to production.
+	Environment string
+	Branch      string
+	// SPAMode is the client's guess whether the build is a single-page app
+	SPAMode sql.NullBool
+}
+
+// parseSPAMode reads the spa form field or query parameter; anything but a
+// boolean leaves the mode unset
+func parseSPAMode(value string) sql.NullBool {
+	spa, err := strconv.ParseBool(value)
+	return sql.NullBool{Bool: spa, Valid: err == nil}
+}
+
+// startDeployment resolves the user and project, creates the deployment record
+// with the given initial status and makes sure the project bucket exists
+func startDeployment(ctx context.Context, db *sql.DB, minioClient *minio.Client, email string, meta deploymentMeta, status string) (*deploymentUpload, error) {
+	if meta.ProjectName == "" {
+		return nil, &uploadError{Status: http.StatusBadRequest, Message: "project_name is required"}
+	}
+	if meta.Source == "" {
+		meta.Source = "cli"
+	}
+	if meta.Environment != "" && !validEnvironment(meta.Environment) {
+		return nil, &uploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid environment name '%s': use lowercase letters, digits and dashes", meta.Environment)}
+	}
+	if meta.Branch != "" && !validBranch(meta.Branch) {
+		return nil, &uploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid branch name '%s'", meta.Branch)}
+	}
+
+	u := &deploymentUpload{
+		db:          db,
+		minioClient: minioClient,
+		ctx:         ctx,
+		projectName: meta.ProjectName,
+		environment: meta.Environment,
+		branch:      meta.Branch,
+	}
+
+	// Get user ID
+	err := db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&u.userID)
+	if err != nil {
+		return nil, &uploadError{Status: http.StatusNotFound, Message: "User not found"}
+	}
+
+	// Get or create project
+	err = db.QueryRow("SELECT id FROM projects WHERE name = $1 AND user_id = $2", meta.ProjectName, u.userID).Scan(&u.projectID)
+
+	if err == sql.ErrNoRows {
+		if !validProjectName(meta.ProjectName) {
+			return nil, &uploadError{Status: http.StatusBadRequest, Message: invalidProjectName}
+		}
+		err = db.QueryRow(`
+			INSERT INTO projects (user_id, name, repo_url)
+			VALUES ($1, $2, $3)
+			RETURNING id
+		`, u.userID, meta.ProjectName, sql.NullString{String: meta.RepoURL, Valid: meta.RepoURL != ""}).Scan(&u.projectID)
+
+		if err != nil {
+			return nil, &uploadError{Status: http.StatusInternalServerError, Message: "Failed to create project"}
+		}
+	} else if err != nil {
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+	} else if meta.RepoURL != "" {
+		// Update repo_url if provided for existing project
+		_, _ = db.Exec("UPDATE projects SET repo_url = $1 WHERE id = $2", meta.RepoURL, u.projectID)
+	}
+
+	if err := u.resolveTarget(); err != nil {
+		return nil, err
+	}
+
+	if err := u.createDeploymentRecord(status, meta); err != nil {
+		log.Printf("Failed to create deployment: %v", err)
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: "Failed to create deployment"}
+	}
+
+	log.Printf("📦 Deployment v%d created for project '%s' (deployment=%s)", u.version, u.projectName, u.deploymentID)
+	u.enterPhase(phaseUpload, "Deployment v%d of '%s' created for %s (source: %s)", u.version, u.projectName, u.target(), meta.Source)
+
+	if err := ensureProjectBucket(ctx, minioClient, u.projectName); err != nil {
+		return nil, u.fail(err)
+	}
+
+	// Per-user storage quota, counted in unique bytes across all projects
+	u.quotaRemaining = userStorageQuota - userStorageUsed(db, u.userID)
+
+	return u, nil
+}
+
+// resolveTarget decides where the deployment goes live: the environment it
+// names, production for the project's production branch or no branch, or
+// else the branch's preview
+func (u *deploymentUpload) resolveTarget() error {
+	if u.environment != "" || u.branch == "" {
+		if u.environment == "" {
+			u.environment = productionEnvironment
+		}
+		return nil
+	}
+
+	var productionBranch string
+	if err := u.db.QueryRow("SELECT production_branch FROM projects WHERE id = $1", u.projectID).Scan(&productionBranch); err != nil {
+		return &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+	}
+	if u.branch == productionBranch {
+		u.environment = productionEnvironment
+		return nil
+	}
+
+	if _, err := ensureBranchAlias(u.db, u.projectID, u.projectName, u.branch); err == errNoRoomForSlug {
+		return &uploadError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("Project name '%s' is too long for branch previews, deploy to an environment instead", u.projectName),
+		}
+	} else if err != nil {
+		log.Printf("Failed to create preview of branch '%s': %v", u.branch, err)
+		return &uploadError{Status: http.StatusInternalServerError, Message: "Failed to create branch preview"}
+	}
+	return nil
+}
+
+// target describes where the deployment goes live
+func (u *deploymentUpload) target() string {
+	if u.environment == "" {
+		return fmt.Sprintf("the preview of branch '%s'", u.branch)
+	}
+	return u.environment
+}
+
+// createDeploymentRecord takes the project's next version number and inserts
+// the deployment in one transaction. The row lock on the project makes
+// concurrent deploys get distinct, gapless versions.
+func (u *deploymentUpload) createDeploymentRecord(status string, meta deploymentMeta) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		UPDATE projects SET deploy_counter = deploy_counter + 1
+		WHERE id = $1
+		RETURNING deploy_counter
+	`, u.projectID).Scan(&u.version)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO deployments (project_id, status, version, source, commit_hash, commit_message, spa_mode, environment, branch)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`, u.projectID, status, u.version, meta.Source,
+		sql.NullString{String: meta.CommitHash, Valid: meta.CommitHash != ""},
+		sql.NullString{String: meta.CommitMessage, Valid: meta.CommitMessage != ""},
+		meta.SPAMode, sql.NullString{String: u.environment, Valid: u.environment != ""},
+		sql.NullString{String: u.branch, Valid: u.branch != ""}).Scan(&u.deploymentID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ensureProjectBucket creates the project bucket if it doesn't exist yet and
+// sets its public-read policy
+func ensureProjectBucket(ctx context.Context, minioClient *minio.Client, projectName string) error {
+	bucketExists, err := minioClient.BucketExists(ctx, projectName)
+	if err != nil {
+		return &uploadError{Status: http.StatusInternalServerError, Message: "MinIO error", Log: fmt.Sprintf("Bucket check error: %v", err)}
+	}
+	if !bucketExists {
+		err = minioClient.MakeBucket(ctx, projectName, minio.MakeBucketOptions{})
+		if err != nil {
+			return &uploadError{Status: http.StatusInternalServerError, Message: "Failed to create bucket", Log: fmt.Sprintf("Bucket creation error: %v", err)}
+		}
+	}
+
+	// Set on existing buckets too, which may still have the policy from
+	// before uploads were staged in the bucket
+	err = minioClient.SetBucketPolicy(ctx, projectName, bucketPolicy(projectName))
+	if err != nil {
+		log.Printf("Warning: Failed to set bucket policy: %v", err)
+	}
+	return nil
+}
+
+// privatePrefixes hold queued deploy requests and partial uploads, which
+// haven't been checked yet and must not be readable without auth
+var privatePrefixes = []string{"_jobs/", "_uploads/"}
+
+// bucketPolicy allows public reads of a project bucket except under
+// privatePrefixes
+func bucketPolicy(bucket string) string {
+	denied := make([]string, len(privatePrefixes))
+	for i, prefix := range privatePrefixes {
+		denied[i] = fmt.Sprintf(`"arn:aws:s3:::%s/%s*"`, bucket, prefix)
+	}
+	return fmt.Sprintf(`{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"AWS": ["*"]},
+			"Action": ["s3:GetObject"],
+			"Resource": ["arn:aws:s3:::%s/*"]
+		}, {
+			"Effect": "Deny",
+			"Principal": {"AWS": ["*"]},
+			"Action": ["s3:GetObject"],
+			"Resource": [%s]
+		}]
+	}`, bucket, strings.Join(denied, ", "))
+}
+
+// addFile validates a single file and adds it to the deployment manifest. The
+// content is hashed while it streams in and only uploaded if the project
+// doesn't already store a blob with the same hash. A file that can't be
+// deployed is drained and recorded, so the client gets a report of every
+// failed path once the upload finishes; only failures that affect the whole
+// deployment (size, quota, a broken stream) stop it right away.
+func (u *deploymentUpload) addFile(objectName, contentType string, body io.Reader) error {
+	objectName = u.checkPath(objectName)
+	if objectName == "" {
+		io.Copy(io.Discard, body)
+		return nil
+	}
+
+	if contentType == "" {
+		contentType = mimetype.ForPath(objectName)
+	}
+
+	pipeline := u.validation()
+	limited := &limitedReader{r: body, fileLimit: pipeline.maxFileBytes, totalLimit: pipeline.maxDeploymentBytes - u.totalSize}
+	spool, err := spoolUpload(limited)
+
+	switch {
+	case limited.fileExceeded:
+		u.checkFile(objectName, limited.n)
+		io.Copy(io.Discard, body)
+		return nil
+	case limited.totalExceeded:
+		return rejectionError(manifest.DeploymentTooLarge(pipeline.maxDeploymentBytes))
+	case err != nil:
+		u.failFile(objectName, api.CodeUploadInterrupted, "upload interrupted")
+		return &uploadError{
+			Status:  http.StatusBadRequest,
+			Code:    api.CodeUploadInterrupted,
+			Message: fmt.Sprintf("Failed to read '%s'", objectName),
+			Log:     fmt.Sprintf("Read error for %s: %v", objectName, err),
+			Files:   u.fileErrors,
+		}
+	}
+	defer spool.Close()
+
+	if !u.checkFile(objectName, spool.Size) {
+		return nil
+	}
+
+	// The manifest entry goes in first: from then on the blob counts as
+	// referenced and removeUnreferencedBlobs leaves it alone
+	if err := addManifestEntry(u.db, u.deploymentID, objectName, spool.Hash, spool.Size, contentType, u.cacheControl(objectName)); err != nil {
+		log.Printf("Manifest error for %s: %v", objectName, err)
+		u.failFile(objectName, api.CodeStorageError, "failed to record file")
+		return nil
+	}
+
+	exists, err := blobExists(u.db, u.projectID, spool.Hash)
+	if err != nil {
+		log.Printf("Blob lookup error for %s: %v", objectName, err)
+		u.failFile(objectName, api.CodeStorageError, "storage lookup failed")
+		return nil
+	}
+
+	if !exists {
+		if u.storedSize+spool.Size > u.quotaRemaining {
+			return u.quotaError()
+		}
+
+		err := putBlob(u.ctx, u.db, u.minioClient, u.projectID, u.projectName, spool.Hash, spool, spool.Size, contentType)
+		if err != nil {
+			// Retry once from the spooled copy before giving up on the file
+			if _, seekErr := spool.Seek(0, io.SeekStart); seekErr == nil {
+				err = putBlob(u.ctx, u.db, u.minioClient, u.projectID, u.projectName, spool.Hash, spool, spool.Size, contentType)
+			}
+		}
+		if err != nil && u.ctx.Err() != nil {
+			// Cancelled or timed out: the remaining files would fail too
+			return u.ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Upload error for %s: %v", objectName, err)
+			u.failFile(objectName, api.CodeStorageError, "failed to store file")
+			return nil
+		}
+		u.storedSize += spool.Size
+	}
+
+	u.filesCount++
+	u.totalSize += spool.Size
+	return nil
+}
+
+// checkPath normalizes a file path. It returns an empty path for a path that
+// can't be deployed; such files are recorded and reported together by finish.
+func (u *deploymentUpload) checkPath(objectName string) string {
+	cleaned, ok := manifest.NormalizePath(objectName)
+	if !ok {
+		u.failFile(objectName, api.CodeInvalidPath, "invalid file path")
+		return ""
+	}
+	return cleaned
+}
+
+// failFile records a file that can't be deployed
+func (u *deploymentUpload) failFile(path, code, reason string) {
+	u.logf(logError, "%s: %s", path, reason)
+	u.fileErrors = append(u.fileErrors, models.FileError{Path: path, Code: code, Error: reason})
+}
+
+// fileErrorsError reports every file of the deployment that failed
+func (u *deploymentUpload) fileErrorsError() error {
+	paths := make([]string, 0, len(u.fileErrors))
+	for _, f := range u.fileErrors {
+		paths = append(paths, f.Path)
+	}
+
+	listed := paths
+	if len(listed) > 10 {
+		listed = append(listed[:10:10], fmt.Sprintf("and %d more", len(paths)-10))
+	}
+
+	return &uploadError{
+		Status:  http.StatusBadRequest,
+		Code:    api.CodeInvalidFiles,
+		Message: fmt.Sprintf("%d files could not be deployed: %s", len(paths), strings.Join(listed, ", ")),
+		Log:     fmt.Sprintf("Failed files: %s", strings.Join(paths, ", ")),
+		Files:   u.fileErrors,
+	}
+}
+
+func (u *deploymentUpload) quotaError() error {
+	used := userStorageQuota - u.quotaRemaining
+	return &uploadError{
+		Status:  http.StatusForbidden,
+		Code:    api.CodeQuotaExceeded,
+		Message: fmt.Sprintf("Storage quota exceeded. You're using %d MB of 500 MB. This deployment needs more than %d MB of new storage.", used>>20, u.quotaRemaining>>20),
+		Log:     "User storage quota exceeded",
+	}
+}
+
+// activate marks the deployment successful and makes it the live version of
+// its environment or branch preview
+func (u *deploymentUpload) activate() error {
+	u.enterPhase(phaseActivate, "Activating v%d in %s", u.version, u.target())
+	live := fmt.Sprintf("Deployment v%d is live in %s: %d files, %d bytes (%d bytes new)", u.version, u.target(), u.filesCount, u.totalSize, u.storedSize)
+	if err := activateDeployment(u.db, u.projectID, u.deploymentID, u.environment, u.branch, u.filesCount, u.totalSize, u.storedSize, live); err != nil {
+		if err == errDeploymentCancelled {
+			return err
+		}
+		log.Printf("Failed to activate deployment: %v", err)
+		return &uploadError{
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to activate deployment",
+			Log:     fmt.Sprintf("Activation error: %v", err),
+		}
+	}
+
+	log.Printf("✅ Deployment v%d complete in %s: %d files, %d bytes (%d bytes new)", u.version, u.target(), u.filesCount, u.totalSize, u.storedSize)
+	return nil
+}
+
+// finish runs the checks that need the whole deployment
+func (u *deploymentUpload) finish() error {
+	u.enterPhase(phaseValidate, "Validating %d files", u.filesCount)
+
+	// Every file must make it; a site never goes live with missing assets
+	if len(u.fileErrors) > 0 {
+		return u.fileErrorsError()
+	}
+
+	if r := u.validation().checkDeployment(u.filesCount, u.totalSize); r != nil {
+		return rejectionError(r)
+	}
+
+	u.logf(logInfo, "Validation passed")
+	return nil
+}
+
+// fail marks the deployment as failed, drops its manifest and any blobs it
+// uploaded that nothing else references, and returns the error to report to
+// the client
+func (u *deploymentUpload) fail(err error) error {
+	var upErr *uploadError
+	if !errors.As(err, &upErr) {
+		upErr = &uploadError{Status: http.StatusInternalServerError, Message: "Deployment failed", Log: err.Error()}
+	}
+	if upErr.Log == "" {
+		upErr.Log = upErr.Message
+	}
+
+	u.logf(logError, "%s", upErr.Log)
+	appendDeploymentLog(u.db, u.deploymentID, logInfo, phaseCleanup, "Discarding uploaded files")
+	if upErr.Code != "" || len(upErr.Files) > 0 {
+		recordRejection(u.db, u.deploymentID, upErr.Code, upErr.Files)
+	}
+	updateDeploymentStatus(u.db, u.deploymentID, "failed", upErr.Log)
+	discardDeploymentFiles(context.Background(), u.db, u.minioClient, u.projectID, u.projectName, u.deploymentID)
+
+	return upErr
+}
+
+// recordRejection stores the reason code and the per-file report of a failed
+// deployment
+func recordRejection(db *sql.DB, deploymentID, code string, files []models.FileError) {
+	var report []byte
+	var err error
+	if len(files) > 0 {
+		report, err = json.Marshal(files)
+	}
+	if err == nil {
+		_, err = db.Exec("UPDATE deployments SET error_code = $1, file_errors = $2 WHERE id = $3",
+			sql.NullString{String: code, Valid: code != ""}, report, deploymentID)
+	}
+	if err != nil {
+		log.Printf("Failed to record file errors: %v", err)
+	}
+}
+
+// limitedReader counts bytes and stops with an error once either the per-file
+// or the remaining deployment limit is exceeded
+type limitedReader struct {
+	r          io.Reader
+	n          int64
+	fileLimit  int64
+	totalLimit int64
+
+	fileExceeded  bool
+	totalExceeded bool
+}
+
+var errLimitExceeded = errors.New("upload size limit exceeded")
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.fileLimit {
+		l.fileExceeded = true
+		return n, errLimitExceeded
+	}
+	if l.n > l.totalLimit {
+		l.totalExceeded = true
+		return n, errLimitExceeded
+	}
+	return n, err
+}
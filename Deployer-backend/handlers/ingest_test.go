@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBucketPolicy(t *testing.T) {
+	var policy struct {
+		Statement []struct {
+			Effect   string
+			Resource []string
+		}
+	}
+	if err := json.Unmarshal([]byte(bucketPolicy("shop")), &policy); err != nil {
+		t.Fatalf("invalid policy: %v", err)
+	}
+
+	denied := map[string]bool{}
+	for _, s := range policy.Statement {
+		if s.Effect == "Deny" {
+			for _, r := range s.Resource {
+				denied[strings.TrimPrefix(r, "arn:aws:s3:::shop/")] = true
+			}
+		}
+	}
+	for _, prefix := range []string{"_jobs/*", "_uploads/*"} {
+		if !denied[prefix] {
+			t.Errorf("public reads of %s are not denied", prefix)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/minio/minio-go/v7"
+)
+
+// Deployments are processed in the background. A deploy request stores its
+// payload under _jobs/{id} in the project bucket, queues a deployment_jobs row
+// and returns 202 right away; finalizing an incremental deploy queues a job
+// without a payload. A pool of workers claims queued jobs with
+// FOR UPDATE SKIP LOCKED, so several backend instances can share the queue.
+// Deployments of one project run one at a time and in order: a job is only
+// claimed when no other deployment of its project is processing or queued
+// ahead of it, which a per-project advisory lock makes race-free.
+//
+// A deployment moves through: queued -> processing -> success | failed | cancelled
+// A job whose deployment gets cancelled stops at the next file or when it
+// tries to activate, and only discards what it had written.
+
+const (
+	// jobPollInterval is how often an idle worker checks for queued jobs
+	jobPollInterval = 2 * time.Second
+	// jobTimeout bounds the processing of a single deployment
+	jobTimeout = 15 * time.Minute
+	// maxJobAttempts is how often a job is retried after its worker died
+	maxJobAttempts = 3
+	// progressInterval throttles progress updates while a job runs
+	progressInterval = time.Second
+)
+
+// jobWake lets a request wake an idle worker instead of waiting for the poll
+var jobWake = make(chan struct{}, 1)
+
+// deploymentJob is a claimed deployment waiting to be processed
+type deploymentJob struct {
+	DeploymentID string
+	PayloadKey   sql.NullString
+	ContentType  sql.NullString
+	Attempts     int
+}
+
+// jobPayloadKey returns the object key holding a queued deploy request body
+func jobPayloadKey(deploymentID string) string {
+	return "_jobs/" + deploymentID
+}
+
+// enqueue queues the deployment for processing. The payload, if any, is the
+// raw deploy request body; incremental deploys have their files already.
+func (u *deploymentUpload) enqueue(payload io.Reader, size int64, contentType string) error {
+	var payloadKey sql.NullString
+	if payload != nil {
+		payloadKey = sql.NullString{String: jobPayloadKey(u.deploymentID), Valid: true}
+		_, err := u.minioClient.PutObject(u.ctx, u.projectName, payloadKey.String, payload, size,
+			minio.PutObjectOptions{ContentType: "application/octet-stream"})
+		if err != nil {
+			return &uploadError{Status: http.StatusInternalServerError, Message: "Failed to store upload", Log: fmt.Sprintf("Payload upload error: %v", err)}
+		}
+	}
+
+	u.enterPhase(phaseQueue, "Queued for processing")
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO deployment_jobs (deployment_id, payload_key, content_type)
+		VALUES ($1, $2, $3)
+	`, u.deploymentID, payloadKey, contentType); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE deployments SET status = 'queued', session_expires_at = NULL WHERE id = $1
+	`, u.deploymentID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("📥 Deployment v%d of '%s' queued (deployment=%s)", u.version, u.projectName, u.deploymentID)
+
+	// Tell the client when it has to wait for earlier deploys of the project
+	u.db.QueryRow(`
+		SELECT COUNT(*) FROM deployments d
+		JOIN deployment_jobs j ON j.deployment_id = d.id
+		WHERE d.project_id = $1 AND d.id <> $2 AND d.status IN ('queued', 'processing')
+	`, u.projectID, u.deploymentID).Scan(&u.queuePosition)
+	if u.queuePosition > 0 {
+		u.logf(logInfo, "Waiting for %d earlier deployments of '%s' to finish", u.queuePosition, u.projectName)
+	}
+
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// queuedResult is the response body for a deployment that was accepted
+func (u *deploymentUpload) queuedResult() api.QueuedDeployment {
+	return api.QueuedDeployment{
+		DeploymentID:  u.deploymentID,
+		ProjectName:   u.projectName,
+		Version:       u.version,
+		Status:        "queued",
+		QueuePosition: u.queuePosition,
+		StatusURL:     "/api/deployments/" + u.deploymentID,
+	}
+}
+
+// StartDeployWorkers starts the worker pool processing queued deployments
+func StartDeployWorkers(db *sql.DB, minioClient *minio.Client, workers int) {
+	for i := 0; i < workers; i++ {
+		go runDeployWorker(db, minioClient)
+	}
+
+	// Requeue jobs whose worker died mid-way
+	go func() {
+		for range time.Tick(time.Minute) {
+			requeueStaleJobs(db, minioClient)
+		}
+	}()
+
+	log.Printf("👷 Started %d deploy workers", workers)
+}
+
+func runDeployWorker(db *sql.DB, minioClient *minio.Client) {
+	for {
+		job, err := claimDeploymentJob(db)
+		if err != nil {
+			log.Printf("Failed to claim deployment job: %v", err)
+		}
+		if job != nil {
+			processDeploymentJob(db, minioClient, job)
+			continue
+		}
+
+		select {
+		case <-jobWake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// claimDeploymentJob moves the oldest queued deployment to processing. It
+// returns nil when the queue is empty.
+func claimDeploymentJob(db *sql.DB) (*deploymentJob, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	job := &deploymentJob{}
+	var projectID string
+	err = tx.QueryRow(`
+		SELECT j.deployment_id, d.project_id, j.payload_key, j.content_type, j.attempts
+		FROM deployment_jobs j
+		JOIN deployments d ON j.deployment_id = d.id
+		WHERE d.status = 'queued'
+		AND NOT EXISTS (
+			SELECT 1 FROM deployment_jobs oj
+			JOIN deployments od ON oj.deployment_id = od.id
+			WHERE od.project_id = d.project_id AND od.id <> d.id
+			AND (od.status = 'processing' OR (od.status = 'queued' AND oj.created_at < j.created_at))
+		)
+		ORDER BY j.created_at
+		LIMIT 1
+		FOR UPDATE OF j SKIP LOCKED
+	`).Scan(&job.DeploymentID, &projectID, &job.PayloadKey, &job.ContentType, &job.Attempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Two workers may pick jobs of the same project at once; the lock makes
+	// the second see the first one's claim and back off
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('deploy:' || $1))", projectID); err != nil {
+		return nil, err
+	}
+	var busy bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM deployments WHERE project_id = $1 AND status = 'processing')
+	`, projectID).Scan(&busy); err != nil {
+		return nil, err
+	}
+	if busy {
+		return nil, nil
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE deployment_jobs SET attempts = attempts + 1, started_at = NOW()
+		WHERE deployment_id = $1
+	`, job.DeploymentID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE deployments SET status = 'processing' WHERE id = $1
+	`, job.DeploymentID); err != nil {
+		return nil, err
+	}
+
+	job.Attempts++
+	return job, tx.Commit()
+}
+
+// processDeploymentJob ingests a claimed deployment and makes it live, or
+// marks it failed. The job and its payload are removed either way.
+func processDeploymentJob(db *sql.DB, minioClient *minio.Client, job *deploymentJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+	trackRunningJob(job.DeploymentID, cancel)
+	defer untrackRunningJob(job.DeploymentID)
+
+	upload, err := loadQueuedUpload(ctx, db, minioClient, job.DeploymentID)
+	if err != nil {
+		log.Printf("Failed to load deployment %s: %v", job.DeploymentID, err)
+		appendDeploymentLog(db, job.DeploymentID, logError, phaseQueue, "Failed to load deployment")
+		updateDeploymentStatus(db, job.DeploymentID, "failed", "Failed to load deployment")
+		db.Exec("DELETE FROM deployment_jobs WHERE deployment_id = $1", job.DeploymentID)
+		return
+	}
+
+	log.Printf("⚙️  Processing deployment v%d of '%s' (attempt %d)", upload.version, upload.projectName, job.Attempts)
+	upload.enterPhase(phaseIngest, "Processing started (attempt %d of %d)", job.Attempts, maxJobAttempts)
+
+	if job.PayloadKey.Valid {
+		err = upload.ingestPayload(job.PayloadKey.String, job.ContentType.String)
+		if err == nil {
+			upload.logf(logInfo, "Received %d files, %d bytes (%d bytes new)", upload.filesCount, upload.totalSize, upload.storedSize)
+			err = upload.finish()
+		}
+	} else {
+		err = upload.checkComplete()
+	}
+	if err == nil {
+		err = upload.verifyContentTypes()
+	}
+	if err == nil {
+		err = upload.scanSecrets()
+	}
+	if err == nil {
+		err = upload.parseSiteRules()
+	}
+	if err == nil {
+		err = upload.checkLinks()
+	}
+	if err == nil {
+		err = upload.compressVariants()
+	}
+	if err == nil {
+		err = upload.activate()
+	}
+	if err != nil && deploymentCancelled(db, job.DeploymentID) {
+		log.Printf("🛑 Deployment v%d of '%s' stopped after it was cancelled", upload.version, upload.projectName)
+		discardCancelledDeployment(db, minioClient, job.DeploymentID)
+		return
+	}
+	if err != nil {
+		upload.fail(err)
+		log.Printf("❌ Deployment v%d of '%s' failed: %v", upload.version, upload.projectName, err)
+	}
+
+	if job.PayloadKey.Valid {
+		minioClient.RemoveObject(context.Background(), upload.projectName, job.PayloadKey.String, minio.RemoveObjectOptions{})
+	}
+	db.Exec("DELETE FROM deployment_jobs WHERE deployment_id = $1", job.DeploymentID)
+}
+
+// loadQueuedUpload restores the state of a claimed deployment
+func loadQueuedUpload(ctx context.Context, db *sql.DB, minioClient *minio.Client, deploymentID string) (*deploymentUpload, error) {
+	u := &deploymentUpload{
+		db:           db,
+		minioClient:  minioClient,
+		ctx:          ctx,
+		deploymentID: deploymentID,
+	}
+
+	err := db.QueryRow(`
+		SELECT p.user_id, p.id, p.name, d.version, COALESCE(d.environment, ''), COALESCE(d.branch, ''), d.files_count, d.size_bytes, d.stored_bytes
+		FROM deployments d
+		JOIN projects p ON d.project_id = p.id
+		WHERE d.id = $1
+	`, deploymentID).Scan(&u.userID, &u.projectID, &u.projectName, &u.version, &u.environment, &u.branch,
+		&u.filesCount, &u.totalSize, &u.storedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	u.quotaRemaining = userStorageQuota - userStorageUsed(db, u.userID)
+	return u, nil
+}
+
+// ingestPayload adds the files of a queued deploy request body
+func (u *deploymentUpload) ingestPayload(payloadKey, contentType string) error {
+	obj, err := u.minioClient.GetObject(u.ctx, u.projectName, payloadKey, minio.GetObjectOptions{})
+	if err != nil {
+		return &uploadError{Status: http.StatusInternalServerError, Message: "Failed to read upload", Log: fmt.Sprintf("Payload read error: %v", err)}
+	}
+	defer obj.Close()
+
+	// A retried job starts over from the payload
+	u.filesCount, u.totalSize, u.storedSize = 0, 0, 0
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "multipart/form-data" {
+		return ingestMultipart(obj, params["boundary"], u.addFileWithProgress)
+	}
+	return ingestArchive(u, obj, archiveFormat(mediaType))
+}
+
+// addFileWithProgress adds a file and periodically records how far the
+// deployment got, so clients polling its status can show progress
+func (u *deploymentUpload) addFileWithProgress(name, contentType string, r io.Reader) error {
+	if err := u.addFile(name, contentType, r); err != nil {
+		return err
+	}
+
+	if time.Since(u.lastProgress) >= progressInterval {
+		u.lastProgress = time.Now()
+		result, err := u.db.Exec(`
+			UPDATE deployments SET files_count = $1, size_bytes = $2, stored_bytes = $3
+			WHERE id = $4 AND status = 'processing'
+		`, u.filesCount, u.totalSize, u.storedSize, u.deploymentID)
+		if err != nil {
+			return err
+		}
+		// Another instance may have cancelled the deployment
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errDeploymentCancelled
+		}
+	}
+	return nil
+}
+
+// checkComplete verifies that every hash of an incremental deploy is stored
+func (u *deploymentUpload) checkComplete() error {
+	missing, err := u.missingBlobs()
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return &uploadError{Status: http.StatusConflict, Message: fmt.Sprintf("%d files have not been uploaded", len(missing))}
+	}
+	return nil
+}
+
+// requeueStaleJobs puts jobs back in the queue whose worker stopped without
+// finishing them, and fails those that ran out of attempts
+func requeueStaleJobs(db *sql.DB, minioClient *minio.Client) {
+	staleAfter := int((2 * jobTimeout).Seconds())
+
+	result, err := db.Exec(`
+		WITH stale AS (
+			SELECT d.id FROM deployments d
+			JOIN deployment_jobs j ON j.deployment_id = d.id
+			WHERE d.status = 'processing'
+			AND j.started_at < NOW() - $1 * INTERVAL '1 second'
+			AND j.attempts < $2
+		), logged AS (
+			INSERT INTO deployment_log_lines (deployment_id, level, phase, message)
+			SELECT id, 'warn', 'queue', 'Worker stopped responding; deployment requeued' FROM stale
+		)
+		UPDATE deployments SET status = 'queued' WHERE id IN (SELECT id FROM stale)
+	`, staleAfter, maxJobAttempts)
+	if err != nil {
+		log.Printf("Failed to requeue stale deployment jobs: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("🔁 Requeued %d stale deployment jobs", n)
+	}
+
+	rows, err := db.Query(`
+		DELETE FROM deployment_jobs j
+		USING deployments d
+		WHERE j.deployment_id = d.id AND d.status = 'processing'
+		AND j.started_at < NOW() - $1 * INTERVAL '1 second'
+		AND j.attempts >= $2
+		RETURNING d.id
+	`, staleAfter, maxJobAttempts)
+	if err != nil {
+		log.Printf("Failed to collect abandoned deployment jobs: %v", err)
+		return
+	}
+
+	var abandoned []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			abandoned = append(abandoned, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range abandoned {
+		if upload, err := loadQueuedUpload(context.Background(), db, minioClient, id); err == nil {
+			upload.fail(fmt.Errorf("deployment did not finish after %d attempts", maxJobAttempts))
+			minioClient.RemoveObject(context.Background(), upload.projectName, jobPayloadKey(id), minio.RemoveObjectOptions{})
+		}
+	}
+
+	// Cancelled jobs whose worker died never cleaned up after themselves
+	rows, err = db.Query(`
+		SELECT j.deployment_id FROM deployment_jobs j
+		JOIN deployments d ON j.deployment_id = d.id
+		WHERE d.status = 'cancelled'
+		AND j.started_at < NOW() - $1 * INTERVAL '1 second'
+	`, staleAfter)
+	if err != nil {
+		log.Printf("Failed to collect cancelled deployment jobs: %v", err)
+		return
+	}
+
+	var cancelled []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			cancelled = append(cancelled, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range cancelled {
+		discardCancelledDeployment(db, minioClient, id)
+	}
+}
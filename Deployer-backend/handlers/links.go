@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/net/html"
+)
+
+// Before a deployment goes live its HTML pages are parsed and every href,
+// src and srcset pointing into the site is resolved against the
+// deployment's own files, the way the site server would resolve it. Links
+// that lead nowhere are recorded in deployments.broken_links as warnings;
+// projects with strict_links set fail the deployment instead. A link a
+// _redirects rule catches counts as resolved, and so does a link to a page
+// of a single-page app.
+
+const (
+	// maxLinkCheckSize bounds the HTML files parsed for links
+	maxLinkCheckSize = 5 << 20
+	// maxBrokenLinks caps the report of a single deployment
+	maxBrokenLinks = 500
+	// maxLoggedLinks caps the broken links written to the deployment's log
+	maxLoggedLinks = 20
+)
+
+// pageElements are the elements whose references lead to pages rather than
+// assets
+var pageElements = map[string]bool{"a": true, "area": true, "iframe": true, "frame": true}
+
+// pageRels are the rel values of <link> elements pointing to pages
+var pageRels = map[string]bool{"alternate": true, "canonical": true, "next": true, "prev": true}
+
+// pageReference is a reference found in an HTML page
+type pageReference struct {
+	url  string
+	kind string
+}
+
+// checkLinks reports the broken links and missing assets of the
+// deployment's HTML pages
+func (u *deploymentUpload) checkLinks() error {
+	var spa, strict bool
+	err := u.db.QueryRow(`
+		SELECT COALESCE(p.spa_mode, d.spa_mode, FALSE), p.strict_links
+		FROM deployments d
+		JOIN projects p ON d.project_id = p.id
+		WHERE d.id = $1
+	`, u.deploymentID).Scan(&spa, &strict)
+	if err != nil {
+		return err
+	}
+
+	rows, err := u.db.Query(`
+		SELECT path, hash, size_bytes FROM deployment_files WHERE deployment_id = $1
+	`, u.deploymentID)
+	if err != nil {
+		return err
+	}
+
+	type page struct {
+		path, hash string
+	}
+	var pages []page
+	files := make(map[string]bool)
+	for rows.Next() {
+		var p page
+		var size int64
+		if err := rows.Scan(&p.path, &p.hash, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		files[p.path] = true
+		if isHTMLPath(p.path) && size <= maxLinkCheckSize {
+			pages = append(pages, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return nil
+	}
+
+	u.enterPhase(phaseLinks, "Checking the links of %d pages", len(pages))
+
+	rules := u.siteRules
+	if rules == nil {
+		rules = &siteRules{}
+	}
+
+	resolves := func(target *url.URL, kind string) bool {
+		for _, candidate := range candidatePaths(target.Path) {
+			if files[candidate] {
+				return true
+			}
+		}
+		if rule, _ := rules.redirectFor(target.Path, target.Query(), target.RawQuery); rule != nil {
+			return true
+		}
+		return spa && kind == api.LinkKindPage && !looksLikeAsset(target.Path)
+	}
+
+	broken := []models.BrokenLink{}
+	for _, p := range pages {
+		if u.ctx.Err() != nil {
+			return u.ctx.Err()
+		}
+
+		base, refs, err := u.pageReferences(p.hash)
+		if err != nil {
+			log.Printf("Link check error for %s: %v", p.path, err)
+			u.logf(logWarn, "Could not check the links of %s", p.path)
+			continue
+		}
+
+		seen := make(map[string]bool)
+		for _, ref := range refs {
+			target, ok := resolveReference(p.path, base, ref.url)
+			if !ok || seen[target.Path] {
+				continue
+			}
+			seen[target.Path] = true
+
+			if !resolves(target, ref.kind) && len(broken) < maxBrokenLinks {
+				broken = append(broken, models.BrokenLink{Page: p.path, Link: ref.url, Kind: ref.kind})
+			}
+		}
+	}
+
+	if len(broken) == 0 {
+		u.logf(logInfo, "No broken links")
+		_, err := u.db.Exec("UPDATE deployments SET broken_links = NULL WHERE id = $1", u.deploymentID)
+		return err
+	}
+
+	for i, b := range broken {
+		if i == maxLoggedLinks {
+			u.logf(logWarn, "... and %d more", len(broken)-maxLoggedLinks)
+			break
+		}
+		u.logf(logWarn, "%s: %s", b.Page, describeBrokenLink(b))
+	}
+
+	report, _ := json.Marshal(broken)
+	if _, err := u.db.Exec("UPDATE deployments SET broken_links = $1 WHERE id = $2", report, u.deploymentID); err != nil {
+		return err
+	}
+
+	if !strict {
+		u.logf(logWarn, "%d broken links or missing assets; the deployment goes live anyway", len(broken))
+		return nil
+	}
+
+	fileErrors := make([]models.FileError, 0, len(broken))
+	for _, b := range broken {
+		code := api.CodeBrokenLink
+		if b.Kind == api.LinkKindAsset {
+			code = api.CodeMissingAsset
+		}
+		fileErrors = append(fileErrors, models.FileError{Path: b.Page, Code: code, Error: describeBrokenLink(b)})
+	}
+	return &uploadError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    api.CodeBrokenLinks,
+		Message: fmt.Sprintf("%d broken links or missing assets (strict link checking is on)", len(broken)),
+		Files:   fileErrors,
+	}
+}
+
+func describeBrokenLink(b models.BrokenLink) string {
+	if b.Kind == api.LinkKindAsset {
+		return "missing asset " + b.Link
+	}
+	return "broken link to " + b.Link
+}
+
+func isHTMLPath(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	return ext == ".html" || ext == ".htm"
+}
+
+// pageReferences reads a page of the deployment and returns its <base> href
+// and the references it makes
+func (u *deploymentUpload) pageReferences(hash string) (string, []pageReference, error) {
+	obj, err := u.minioClient.GetObject(u.ctx, u.projectName, blobKey(hash), minio.GetObjectOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+	defer obj.Close()
+
+	base, refs := extractReferences(io.LimitReader(obj, maxLinkCheckSize))
+	return base, refs, nil
+}
+
+// extractReferences collects the href, src and srcset references of an HTML
+// document along with the href of its first <base> element
+func extractReferences(r io.Reader) (string, []pageReference) {
+	var base string
+	var refs []pageReference
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return base, refs
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		t := z.Token()
+		kind := api.LinkKindAsset
+		if pageElements[t.Data] || (t.Data == "link" && hasPageRel(t.Attr)) {
+			kind = api.LinkKindPage
+		}
+
+		for _, a := range t.Attr {
+			switch a.Key {
+			case "href":
+				if t.Data == "base" {
+					if base == "" {
+						base = a.Val
+					}
+					continue
+				}
+				refs = append(refs, pageReference{url: a.Val, kind: kind})
+			case "src":
+				refs = append(refs, pageReference{url: a.Val, kind: kind})
+			case "srcset":
+				for _, candidate := range parseSrcset(a.Val) {
+					refs = append(refs, pageReference{url: candidate, kind: api.LinkKindAsset})
+				}
+			}
+		}
+	}
+}
+
+func hasPageRel(attrs []html.Attribute) bool {
+	for _, a := range attrs {
+		if a.Key != "rel" {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.ToLower(a.Val)) {
+			if pageRels[rel] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseSrcset returns the URLs of a srcset attribute
+func parseSrcset(srcset string) []string {
+	// A data: URL may itself contain commas
+	if strings.Contains(srcset, "data:") {
+		return nil
+	}
+
+	var urls []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 {
+			urls = append(urls, fields[0])
+		}
+	}
+	return urls
+}
+
+// resolveReference resolves a reference of a page against the site root. It
+// returns false for references that don't point into the site, such as
+// external URLs, fragments and mailto: links.
+func resolveReference(page, base, ref string) (*url.URL, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+
+	refURL, err := url.Parse(ref)
+	if err != nil || refURL.Scheme != "" || refURL.Host != "" {
+		return nil, false
+	}
+
+	pageURL := &url.URL{Path: "/" + page}
+	if base != "" {
+		baseURL, err := url.Parse(strings.TrimSpace(base))
+		if err != nil || baseURL.Scheme != "" || baseURL.Host != "" {
+			// Relative references resolve against another site
+			if !strings.HasPrefix(ref, "/") {
+				return nil, false
+			}
+		} else {
+			pageURL = pageURL.ResolveReference(baseURL)
+		}
+	}
+
+	target := pageURL.ResolveReference(refURL)
+	target.Fragment = ""
+	return target, true
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/config"
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/gorilla/mux"
+)
+
+// Every step of a deployment appends to deployment_log_lines. The lines are
+// returned by GET /api/deployments/{id}/logs and can be tailed while the
+// deployment runs from GET /api/deployments/{id}/logs/stream (Server-Sent
+// Events). Browsers, which can't authenticate an EventSource with a header,
+// get a stream ticket first. deployments.logs keeps only the final failure
+// message.
+
+// Log levels
+const (
+	logInfo  = "info"
+	logWarn  = "warn"
+	logError = "error"
+)
+
+// Deployment phases
+const (
+	phaseUpload   = "upload"
+	phaseQueue    = "queue"
+	phaseIngest   = "ingest"
+	phaseScan     = "scan"
+	phaseValidate = "validate"
+	phaseLinks    = "links"
+	phaseCompress = "compress"
+	phaseActivate = "activate"
+	phaseRollback = "rollback"
+	phasePromote  = "promote"
+	phaseCancel   = "cancel"
+	phaseCleanup  = "cleanup"
+)
+
+const (
+	// logStreamPollInterval is how often the stream checks for new lines
+	logStreamPollInterval = 500 * time.Millisecond
+	// logStreamHeartbeat keeps idle streams open through proxies
+	logStreamHeartbeat = 15 * time.Second
+)
+
+// appendDeploymentLog adds a line to a deployment's log
+func appendDeploymentLog(db *sql.DB, deploymentID, level, phase, message string) {
+	_, err := db.Exec(`
+		INSERT INTO deployment_log_lines (deployment_id, level, phase, message)
+		VALUES ($1, $2, $3, $4)
+	`, deploymentID, level, phase, message)
+	if err != nil {
+		log.Printf("Failed to write deployment log: %v", err)
+	}
+}
+
+// logf adds a line in the deployment's current phase
+func (u *deploymentUpload) logf(level, format string, args ...interface{}) {
+	appendDeploymentLog(u.db, u.deploymentID, level, u.phase, fmt.Sprintf(format, args...))
+}
+
+// enterPhase switches the deployment to a new phase and logs why
+func (u *deploymentUpload) enterPhase(phase, format string, args ...interface{}) {
+	u.phase = phase
+	u.logf(logInfo, format, args...)
+}
+
+// deploymentLogLines returns the lines of a deployment's log after afterID
+func deploymentLogLines(db *sql.DB, deploymentID string, afterID int64) ([]api.LogLine, error) {
+	rows, err := db.Query(`
+		SELECT id, created_at, level, phase, message
+		FROM deployment_log_lines
+		WHERE deployment_id = $1 AND id > $2
+		ORDER BY id
+	`, deploymentID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []api.LogLine{}
+	for rows.Next() {
+		var l api.LogLine
+		if err := rows.Scan(&l.ID, &l.Timestamp, &l.Level, &l.Phase, &l.Message); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// isFinalStatus reports whether a deployment will not change anymore
+func isFinalStatus(status string) bool {
+	switch status {
+	case "success", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+// StreamDeploymentLogs streams a deployment's log as Server-Sent Events. Each
+// line is a "log" event whose id can be sent back in Last-Event-ID to resume.
+// A final "done" event carries the deployment status once it has finished.
+func StreamDeploymentLogs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		deploymentID := mux.Vars(r)["id"]
+		status, err := userDeploymentStatus(db, deploymentID, user.Email)
+		if err == sql.ErrNoRows {
+			respondError(w, "Deployment not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		poll := time.NewTicker(logStreamPollInterval)
+		defer poll.Stop()
+		lastWrite := time.Now()
+
+		for {
+			lines, err := deploymentLogLines(db, deploymentID, lastID)
+			if err != nil {
+				return
+			}
+			for _, l := range lines {
+				data, _ := json.Marshal(l)
+				fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", l.ID, data)
+				lastID = l.ID
+			}
+			if len(lines) > 0 {
+				lastWrite = time.Now()
+				rc.Flush()
+			}
+
+			// Lines are written before the status changes, so once the
+			// deployment has finished everything has been sent
+			if isFinalStatus(status) {
+				data, _ := json.Marshal(map[string]string{"status": status})
+				fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+				rc.Flush()
+				return
+			}
+
+			if time.Since(lastWrite) >= logStreamHeartbeat {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				rc.Flush()
+				lastWrite = time.Now()
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-poll.C:
+			}
+
+			if status, err = userDeploymentStatus(db, deploymentID, user.Email); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// CreateLogStreamTicket issues a short-lived ticket for streaming a
+// deployment's log from a client that can't send an Authorization header,
+// passed as ?ticket= to the stream
+func CreateLogStreamTicket(db *sql.DB, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		deploymentID := mux.Vars(r)["id"]
+		if _, err := userDeploymentStatus(db, deploymentID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Deployment not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		ticket, expiresAt, err := middleware.NewStreamTicket(cfg.JWTSecret, user, deploymentID)
+		if err != nil {
+			respondError(w, "Failed to issue ticket", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"ticket":     ticket,
+			"expires_at": expiresAt,
+		}, http.StatusCreated)
+	}
+}
+
+// userDeploymentStatus returns the status of a deployment owned by the user
+func userDeploymentStatus(db *sql.DB, deploymentID, email string) (string, error) {
+	var status string
+	err := db.QueryRow(`
+		SELECT d.status
+		FROM deployments d
+		JOIN projects p ON d.project_id = p.id
+		JOIN users u ON p.user_id = u.id
+		WHERE d.id = $1 AND u.email = $2
+	`, deploymentID, email).Scan(&status)
+	return status, err
+}
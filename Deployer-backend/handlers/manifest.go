@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// Incremental deploys happen in three steps:
+//
+//  1. POST /api/deployments with the manifest (path, hash, size per file).
+//     This opens an upload session and lists the hashes the project doesn't
+//     store yet.
+//  2. PUT /api/deployments/{id}/blobs/{hash} for each missing hash, or send it
+//     in resumable chunks with PATCH (see sessions.go).
+//  3. POST /api/deployments/{id}/finalize to commit the session. The
+//     deployment is queued and a deploy worker makes it live (see jobs.go).
+
+// CreateDeployment starts an incremental deployment from a manifest and
+// answers with the hashes the client still has to upload
+func CreateDeployment(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req manifest.Request
+
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManifestSize)).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Files) == 0 {
+			respondError(w, "Manifest contains no files", http.StatusBadRequest)
+			return
+		}
+
+		upload, err := startDeployment(r.Context(), db, minioClient, user.Email, deploymentMeta{
+			ProjectName:   req.ProjectName,
+			RepoURL:       req.RepoURL,
+			Source:        req.Source,
+			CommitHash:    req.CommitHash,
+			CommitMessage: req.CommitMessage,
+			Environment:   req.Environment,
+			Branch:        req.Branch,
+			SPAMode:       sql.NullBool{Bool: req.SPA != nil && *req.SPA, Valid: req.SPA != nil},
+		}, "uploading")
+		if err != nil {
+			respondUploadError(w, err)
+			return
+		}
+
+		missing, err := upload.addManifest(req.Files)
+		if err != nil {
+			respondUploadError(w, upload.abort(err))
+			return
+		}
+
+		log.Printf("📋 Manifest received for deployment v%d: %d files, %d of %d bytes missing",
+			upload.version, upload.filesCount, upload.storedSize, upload.totalSize)
+		upload.enterPhase(phaseUpload, "Manifest received: %d files, %d new files to upload (%d bytes)",
+			upload.filesCount, len(missing), upload.storedSize)
+
+		respondJSON(w, api.DeploymentCreated{
+			DeploymentID: upload.deploymentID,
+			Version:      upload.version,
+			Missing:      missing,
+			ExpiresAt:    time.Now().Add(uploadSessionTTL),
+		}, http.StatusCreated)
+	}
+}
+
+// UploadBlob receives the content of one missing hash. The body is verified
+// against the hash before it is stored.
+func UploadBlob(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		hash := vars["hash"]
+		if !manifest.ValidHash(hash) {
+			respondError(w, "Invalid hash", http.StatusBadRequest)
+			return
+		}
+
+		upload, err := loadDeploymentUpload(r.Context(), db, minioClient, user.Email, vars["id"])
+		if err != nil {
+			respondUploadError(w, err)
+			return
+		}
+
+		var size int64
+		var contentType string
+		err = db.QueryRow(`
+			SELECT size_bytes, content_type FROM deployment_files
+			WHERE deployment_id = $1 AND hash = $2
+			LIMIT 1
+		`, upload.deploymentID, hash).Scan(&size, &contentType)
+		if err == sql.ErrNoRows {
+			respondError(w, "Hash is not part of this deployment's manifest", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := upload.putManifestBlob(hash, size, contentType, r.Body); err != nil {
+			respondUploadError(w, err)
+			return
+		}
+		upload.touchSession()
+
+		respondJSON(w, map[string]interface{}{
+			"hash":       hash,
+			"size_bytes": size,
+		}, http.StatusOK)
+	}
+}
+
+// FinalizeDeployment commits an upload session once every hash in its
+// manifest is stored and queues the deployment to go live
+func FinalizeDeployment(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		upload, err := loadDeploymentUpload(r.Context(), db, minioClient, user.Email, mux.Vars(r)["id"])
+		if err != nil {
+			respondUploadError(w, err)
+			return
+		}
+
+		missing, err := upload.missingBlobs()
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(missing) > 0 {
+			respondJSON(w, map[string]interface{}{
+				"error":   fmt.Sprintf("%d files have not been uploaded yet", len(missing)),
+				"missing": missing,
+			}, http.StatusConflict)
+			return
+		}
+
+		if err := upload.enqueue(nil, 0, ""); err != nil {
+			respondUploadError(w, upload.fail(err))
+			return
+		}
+
+		respondJSON(w, upload.queuedResult(), http.StatusAccepted)
+	}
+}
+
+// loadDeploymentUpload resumes a deployment of the user that is still
+// receiving files
+func loadDeploymentUpload(ctx context.Context, db *sql.DB, minioClient *minio.Client, email, deploymentID string) (*deploymentUpload, error) {
+	u := &deploymentUpload{
+		db:           db,
+		minioClient:  minioClient,
+		ctx:          ctx,
+		deploymentID: deploymentID,
+	}
+
+	var status string
+	err := db.QueryRow(`
+		SELECT p.user_id, p.id, p.name, d.version, COALESCE(d.environment, ''), COALESCE(d.branch, ''), d.status, d.files_count, d.size_bytes, d.stored_bytes
+		FROM deployments d
+		JOIN projects p ON d.project_id = p.id
+		JOIN users u ON p.user_id = u.id
+		WHERE d.id = $1 AND u.email = $2
+	`, deploymentID, email).Scan(&u.userID, &u.projectID, &u.projectName, &u.version, &u.environment, &u.branch, &status,
+		&u.filesCount, &u.totalSize, &u.storedSize)
+	if err == sql.ErrNoRows {
+		return nil, &uploadError{Status: http.StatusNotFound, Message: "Deployment not found"}
+	} else if err != nil {
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+	}
+
+	if status != "uploading" {
+		return nil, &uploadError{
+			Status:  http.StatusConflict,
+			Message: fmt.Sprintf("Deployment is %s and no longer accepts files", status),
+		}
+	}
+
+	return u, nil
+}
+
+// addManifest validates and records a client manifest. It returns the hashes
+// the project doesn't store yet; their total size is checked against the
+// user's quota and recorded as the deployment's stored bytes.
+func (u *deploymentUpload) addManifest(files []manifest.File) ([]string, error) {
+	seenPaths := make(map[string]bool, len(files))
+	hashSizes := make(map[string]int64)
+
+	for _, f := range files {
+		objectName := u.checkPath(f.Path)
+		if objectName == "" {
+			continue
+		}
+
+		if seenPaths[objectName] {
+			u.failFile(objectName, api.CodeDuplicatePath, "duplicate path in manifest")
+			continue
+		}
+		seenPaths[objectName] = true
+
+		if !manifest.ValidHash(f.Hash) {
+			u.failFile(objectName, api.CodeInvalidHash, "invalid hash")
+			continue
+		}
+		if size, ok := hashSizes[f.Hash]; ok && size != f.Size {
+			u.failFile(objectName, api.CodeSizeConflict, "size conflicts with another file of the same hash")
+			continue
+		}
+		hashSizes[f.Hash] = f.Size
+
+		if f.Size < 0 {
+			u.failFile(objectName, api.CodeInvalidSize, "invalid size")
+			continue
+		}
+		if !u.checkFile(objectName, f.Size) {
+			continue
+		}
+		if limit := u.validation().maxDeploymentBytes; u.totalSize+f.Size > limit {
+			return nil, rejectionError(manifest.DeploymentTooLarge(limit))
+		}
+
+		contentType := f.ContentType
+		if contentType == "" {
+			contentType = mimetype.ForPath(objectName)
+		}
+
+		if err := addManifestEntry(u.db, u.deploymentID, objectName, f.Hash, f.Size, contentType, u.cacheControl(objectName)); err != nil {
+			log.Printf("Manifest error for %s: %v", objectName, err)
+			u.failFile(objectName, api.CodeStorageError, "failed to record file")
+			continue
+		}
+
+		u.filesCount++
+		u.totalSize += f.Size
+	}
+
+	if err := u.finish(); err != nil {
+		return nil, err
+	}
+
+	missing, err := u.missingBlobs()
+	if err != nil {
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: "Database error", Log: fmt.Sprintf("Blob lookup error: %v", err)}
+	}
+
+	for _, hash := range missing {
+		u.storedSize += hashSizes[hash]
+	}
+	if u.storedSize > u.quotaRemaining {
+		return nil, u.quotaError()
+	}
+
+	_, err = u.db.Exec(`
+		UPDATE deployments
+		SET files_count = $1, size_bytes = $2, stored_bytes = $3,
+			session_expires_at = NOW() + $4 * INTERVAL '1 second', last_activity_at = NOW()
+		WHERE id = $5
+	`, u.filesCount, u.totalSize, u.storedSize, int(uploadSessionTTL.Seconds()), u.deploymentID)
+	if err != nil {
+		return nil, &uploadError{Status: http.StatusInternalServerError, Message: "Database error", Log: fmt.Sprintf("Deployment update error: %v", err)}
+	}
+
+	return missing, nil
+}
+
+// missingBlobs lists the hashes in the deployment's manifest that the
+// project doesn't store yet
+func (u *deploymentUpload) missingBlobs() ([]string, error) {
+	rows, err := u.db.Query(`
+		SELECT DISTINCT f.hash
+		FROM deployment_files f
+		WHERE f.deployment_id = $1
+		AND NOT EXISTS (SELECT 1 FROM blobs b WHERE b.project_id = $2 AND b.hash = f.hash)
+	`, u.deploymentID, u.projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missing := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		missing = append(missing, hash)
+	}
+	return missing, rows.Err()
+}
+
+// putManifestBlob stores the content of a declared hash after checking that
+// it has the declared size and hashes to the declared value
+func (u *deploymentUpload) putManifestBlob(hash string, size int64, contentType string, body io.Reader) error {
+	exists, err := blobExists(u.db, u.projectID, hash)
+	if err != nil {
+		return &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+	}
+	if exists {
+		return nil
+	}
+
+	limited := &limitedReader{r: body, fileLimit: size, totalLimit: size}
+	spool, err := spoolUpload(limited)
+	if limited.fileExceeded {
+		return &uploadError{Status: http.StatusBadRequest, Message: "Content is larger than the size declared in the manifest"}
+	}
+	if err != nil {
+		return &uploadError{Status: http.StatusBadRequest, Message: "Failed to read upload"}
+	}
+	defer spool.Close()
+
+	if spool.Hash != hash || spool.Size != size {
+		return &uploadError{Status: http.StatusBadRequest, Message: "Content does not match the declared hash"}
+	}
+
+	if err := putBlob(u.ctx, u.db, u.minioClient, u.projectID, u.projectName, hash, spool, spool.Size, contentType); err != nil {
+		log.Printf("Failed to store blob %s: %v", hash, err)
+		return &uploadError{Status: http.StatusInternalServerError, Message: "Failed to store upload"}
+	}
+
+	return nil
+}
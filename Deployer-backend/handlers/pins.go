@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// A deployment can be pinned, which keeps it from retention and any other
+// cleanup, and protected, which keeps it and its project from being
+// deleted. Deleting a pinned or protected deployment takes an explicit unpin
+// or unprotect first.
+
+// UpdateDeployment pins, unpins, protects or unprotects a deployment of a
+// project, given by ID, version number or "active"
+func UpdateDeployment(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var req struct {
+			Pinned    *bool `json:"pinned"`
+			Protected *bool `json:"protected"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Pinned == nil && req.Protected == nil {
+			respondError(w, "Nothing to update: set pinned or protected", http.StatusBadRequest)
+			return
+		}
+
+		d, err := resolveDeploymentRef(db, projectID, vars["deployment"])
+		if err == sql.ErrNoRows {
+			respondError(w, fmt.Sprintf("Deployment %s not found", vars["deployment"]), http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var pinned, protected bool
+		err = db.QueryRow(`
+			UPDATE deployments
+			SET pinned = COALESCE($1, pinned), protected = COALESCE($2, protected)
+			WHERE id = $3
+			RETURNING pinned, protected
+		`, req.Pinned, req.Protected, d.ID).Scan(&pinned, &protected)
+		if err != nil {
+			respondError(w, "Failed to update deployment", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("📌 v%d of project %s: pinned=%t protected=%t", d.Version, projectID, pinned, protected)
+		respondJSON(w, map[string]interface{}{
+			"id":        d.ID,
+			"version":   d.Version,
+			"pinned":    pinned,
+			"protected": protected,
+		}, http.StatusOK)
+	}
+}
+
+// DeleteDeployment removes a finished deployment of a project with
+// everything it stored. A deployment live in any environment or branch
+// preview can't be deleted, and pinned or protected ones need to be unpinned
+// or unprotected first.
+func DeleteDeployment(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		d, err := resolveDeploymentRef(db, projectID, vars["deployment"])
+		if err == sql.ErrNoRows {
+			respondError(w, fmt.Sprintf("Deployment %s not found", vars["deployment"]), http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var status, projectName string
+		var pinned, protected, active bool
+		err = db.QueryRow(`
+			SELECT d.status, d.pinned, d.protected, p.name, `+liveDeployment+`
+			FROM deployments d
+			JOIN projects p ON d.project_id = p.id
+			WHERE d.id = $1
+		`, d.ID).Scan(&status, &pinned, &protected, &projectName, &active)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case protected:
+			respondError(w, fmt.Sprintf("v%d is protected: unprotect it before deleting it", d.Version), http.StatusConflict)
+			return
+		case pinned:
+			respondError(w, fmt.Sprintf("v%d is pinned: unpin it before deleting it", d.Version), http.StatusConflict)
+			return
+		case active:
+			respondError(w, fmt.Sprintf("v%d is live in an environment or branch preview and can't be deleted", d.Version), http.StatusConflict)
+			return
+		case !isFinalStatus(status):
+			respondError(w, fmt.Sprintf("v%d is %s: cancel it instead", d.Version, status), http.StatusConflict)
+			return
+		}
+
+		removed, err := removeDeployment(context.Background(), db, minioClient, projectID, projectName, d.ID)
+		if err != nil {
+			respondError(w, "Failed to delete deployment", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			respondError(w, fmt.Sprintf("v%d changed while it was being deleted, try again", d.Version), http.StatusConflict)
+			return
+		}
+
+		log.Printf("🗑️ Deleted v%d of project '%s'", d.Version, projectName)
+		respondJSON(w, map[string]string{"message": fmt.Sprintf("Deployment v%d deleted", d.Version)}, http.StatusOK)
+	}
+}
@@ -3,7 +3,10 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/dhruvsingh/deployer-backend/middleware"
 	"github.com/dhruvsingh/deployer-backend/models"
@@ -28,7 +31,7 @@ func ListProjects(db *sql.DB) http.HandlerFunc {
 		}
 
 		rows, err := db.Query(`
-			SELECT id, user_id, name, repo_url, active_deployment_id, created_at
+			SELECT id, user_id, name, repo_url, active_deployment_id, spa_mode, strict_links, production_branch, created_at
 			FROM projects WHERE user_id = $1
 			ORDER BY created_at DESC
 		`, userID)
@@ -42,7 +45,7 @@ func ListProjects(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var p models.Project
 			var repoURL sql.NullString
-			if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &repoURL, &p.ActiveDeploymentID, &p.CreatedAt); err != nil {
+			if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &repoURL, &p.ActiveDeploymentID, &p.SPAMode, &p.StrictLinks, &p.ProductionBranch, &p.CreatedAt); err != nil {
 				continue
 			}
 			if repoURL.Valid {
@@ -55,6 +58,19 @@ func ListProjects(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// projectNamePattern keeps project names usable as a hostname label and a
+// bucket name
+var projectNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// invalidProjectName is the error message for a name validProjectName rejects
+var invalidProjectName = fmt.Sprintf("Project names can only contain lowercase letters, digits and dashes, and can't contain '%s'", branchSeparator)
+
+// validProjectName reports whether name can name a project. A dot or the
+// branch separator would make {project}.{domain} hosts ambiguous.
+func validProjectName(name string) bool {
+	return projectNamePattern.MatchString(name) && !strings.Contains(name, branchSeparator)
+}
+
 func CreateProject(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUserFromContext(r)
@@ -76,6 +92,10 @@ func CreateProject(db *sql.DB) http.HandlerFunc {
 			respondError(w, "Project name is required", http.StatusBadRequest)
 			return
 		}
+		if !validProjectName(req.Name) {
+			respondError(w, invalidProjectName, http.StatusBadRequest)
+			return
+		}
 
 		// Check if name is reserved
 		var exists bool
@@ -98,8 +118,8 @@ func CreateProject(db *sql.DB) http.HandlerFunc {
 		err = db.QueryRow(`
 			INSERT INTO projects (user_id, name)
 			VALUES ($1, $2)
-			RETURNING id, user_id, name, created_at
-		`, userID, req.Name).Scan(&project.ID, &project.UserID, &project.Name, &project.CreatedAt)
+			RETURNING id, user_id, name, production_branch, created_at
+		`, userID, req.Name).Scan(&project.ID, &project.UserID, &project.Name, &project.ProductionBranch, &project.CreatedAt)
 
 		if err != nil {
 			if err.Error() == `pq: duplicate key value violates unique constraint "projects_name_key"` {
@@ -136,9 +156,9 @@ func GetProject(db *sql.DB) http.HandlerFunc {
 		var project models.Project
 		var repoURL sql.NullString
 		err = db.QueryRow(`
-			SELECT id, user_id, name, repo_url, active_deployment_id, created_at
+			SELECT id, user_id, name, repo_url, active_deployment_id, spa_mode, strict_links, production_branch, created_at
 			FROM projects WHERE id = $1 AND user_id = $2
-		`, projectID, userID).Scan(&project.ID, &project.UserID, &project.Name, &repoURL, &project.ActiveDeploymentID, &project.CreatedAt)
+		`, projectID, userID).Scan(&project.ID, &project.UserID, &project.Name, &repoURL, &project.ActiveDeploymentID, &project.SPAMode, &project.StrictLinks, &project.ProductionBranch, &project.CreatedAt)
 
 		if err == sql.ErrNoRows {
 			respondError(w, "Project not found", http.StatusNotFound)
@@ -156,6 +176,88 @@ func GetProject(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+// UpdateProjectSettings changes a project's settings. spa_mode turns the
+// single-page app fallback on or off; null leaves it to each deployment's
+// auto-detection. strict_links fails deployments with broken links instead
+// of only reporting them. production_branch is the branch whose deployments
+// go to production rather than to a preview.
+func UpdateProjectSettings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var req map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if raw, ok := req["spa_mode"]; ok {
+			var spaMode *bool
+			if err := json.Unmarshal(raw, &spaMode); err != nil {
+				respondError(w, "spa_mode must be true, false or null", http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec("UPDATE projects SET spa_mode = $1, updated_at = NOW() WHERE id = $2", spaMode, projectID); err != nil {
+				respondError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if raw, ok := req["strict_links"]; ok {
+			var strict bool
+			if err := json.Unmarshal(raw, &strict); err != nil {
+				respondError(w, "strict_links must be true or false", http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec("UPDATE projects SET strict_links = $1, updated_at = NOW() WHERE id = $2", strict, projectID); err != nil {
+				respondError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if raw, ok := req["production_branch"]; ok {
+			var branch string
+			if err := json.Unmarshal(raw, &branch); err != nil || !validBranch(branch) {
+				respondError(w, "production_branch must be a branch name", http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec("UPDATE projects SET production_branch = $1, updated_at = NOW() WHERE id = $2", branch, projectID); err != nil {
+				respondError(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var project models.Project
+		var repoURL sql.NullString
+		err := db.QueryRow(`
+			SELECT id, user_id, name, repo_url, active_deployment_id, spa_mode, strict_links, production_branch, created_at
+			FROM projects WHERE id = $1
+		`, projectID).Scan(&project.ID, &project.UserID, &project.Name, &repoURL, &project.ActiveDeploymentID, &project.SPAMode, &project.StrictLinks, &project.ProductionBranch, &project.CreatedAt)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if repoURL.Valid {
+			project.RepoURL = &repoURL.String
+		}
+
+		respondJSON(w, project, http.StatusOK)
+	}
+}
+
 func DeleteProject(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := middleware.GetUserFromContext(r)
@@ -189,6 +291,19 @@ func DeleteProject(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
 			return
 		}
 
+		// Protected deployments outlive everything but an explicit unprotect
+		var protected int
+		if err := db.QueryRow(`
+			SELECT COUNT(*) FROM deployments WHERE project_id = $1 AND protected
+		`, projectID).Scan(&protected); err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if protected > 0 {
+			respondError(w, fmt.Sprintf("Project has %d protected deployments: unprotect them before deleting it", protected), http.StatusConflict)
+			return
+		}
+
 		// Delete from database (cascades to deployments)
 		_, err = db.Exec("DELETE FROM projects WHERE id = $1", projectID)
 		if err != nil {
@@ -214,6 +329,12 @@ func CheckBucketAvailability(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// The separator would make the name ambiguous in branch preview hosts
+		if strings.Contains(req.Name, branchSeparator) {
+			respondJSON(w, map[string]bool{"available": false}, http.StatusOK)
+			return
+		}
+
 		// Check reserved names
 		var reserved bool
 		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM reserved_names WHERE name = $1)", req.Name).Scan(&reserved)
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+// Each project may set a retention policy (projects.retention). A background
+// collector removes the finished deployments the policy doesn't keep: their
+// rows, logs, manifests, versioned snapshots and any blobs nothing else
+// references. Deployments live in any environment or branch preview, pinned
+// and protected deployments are always kept, and so is any deployment
+// younger than minRetentionAge, so that a failure can still be looked into.
+
+// minRetentionAge is how long a finished deployment is kept whatever the policy
+const minRetentionAge = 24 * time.Hour
+
+// loadRetentionPolicy returns a project's retention policy
+func loadRetentionPolicy(db *sql.DB, projectID string) (api.RetentionPolicy, error) {
+	var policy api.RetentionPolicy
+	var data []byte
+	if err := db.QueryRow("SELECT retention FROM projects WHERE id = $1", projectID).Scan(&data); err != nil {
+		return policy, err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &policy); err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// planRetention lists the deployments of a project a policy removes and the
+// bytes that frees
+func planRetention(db *sql.DB, projectID string, policy api.RetentionPolicy) (api.RetentionPlan, error) {
+	plan := api.RetentionPlan{Policy: policy, Deployments: []api.ExpiredDeployment{}}
+	if policy.KeepLast <= 0 && policy.KeepDays <= 0 {
+		return plan, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT d.id, d.version, d.status, d.created_at,
+			`+liveDeployment+` OR d.pinned OR d.protected
+		FROM deployments d
+		WHERE d.project_id = $1
+		ORDER BY d.version DESC
+	`, projectID)
+	if err != nil {
+		return plan, err
+	}
+	defer rows.Close()
+
+	var candidates []retentionCandidate
+	for rows.Next() {
+		var c retentionCandidate
+		var kept sql.NullBool
+		if err := rows.Scan(&c.deployment.ID, &c.deployment.Version, &c.deployment.Status, &c.deployment.CreatedAt, &kept); err != nil {
+			return plan, err
+		}
+		c.kept = kept.Bool
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return plan, err
+	}
+	plan.Deployments = expiredDeployments(candidates, policy, time.Now())
+	if len(plan.Deployments) == 0 {
+		return plan, nil
+	}
+
+	ids := make([]string, len(plan.Deployments))
+	for i, d := range plan.Deployments {
+		ids[i] = d.ID
+	}
+
+	// Blobs only expired deployments reference, with their variants, plus the
+	// versioned snapshots of deployments from before the blob store
+	err = db.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(b.size_bytes + COALESCE(
+				(SELECT SUM(v.size_bytes) FROM blob_variants v WHERE v.project_id = b.project_id AND v.hash = b.hash), 0)), 0)
+			 FROM blobs b
+			 WHERE b.project_id = $1
+			 AND EXISTS (
+				SELECT 1 FROM deployment_files f
+				WHERE f.deployment_id = ANY($2::uuid[]) AND f.hash = b.hash
+			 )
+			 AND NOT EXISTS (
+				SELECT 1 FROM deployment_files f
+				JOIN deployments d ON f.deployment_id = d.id
+				WHERE d.project_id = b.project_id AND f.hash = b.hash AND NOT d.id = ANY($2::uuid[])
+			 ))
+			+
+			(SELECT COALESCE(SUM(d.size_bytes), 0)
+			 FROM deployments d
+			 WHERE d.id = ANY($2::uuid[]) AND d.status = 'success'
+			 AND NOT EXISTS (SELECT 1 FROM deployment_files f WHERE f.deployment_id = d.id))
+	`, projectID, pq.Array(ids)).Scan(&plan.FreedBytes)
+	return plan, err
+}
+
+// retentionCandidate is a deployment of a project as seen by planRetention
+type retentionCandidate struct {
+	deployment api.ExpiredDeployment
+	// kept is set for deployments that are live, pinned or protected
+	kept bool
+}
+
+// expiredDeployments returns the candidates, newest first, that a policy
+// doesn't keep
+func expiredDeployments(candidates []retentionCandidate, policy api.RetentionPolicy, now time.Time) []api.ExpiredDeployment {
+	expired := []api.ExpiredDeployment{}
+	successful := 0
+	for _, c := range candidates {
+		d := c.deployment
+		if d.Status == "success" {
+			successful++
+		}
+		switch {
+		case !isFinalStatus(d.Status), c.kept:
+			continue
+		case now.Sub(d.CreatedAt) < minRetentionAge:
+			continue
+		case policy.KeepLast > 0 && d.Status == "success" && successful <= policy.KeepLast:
+			continue
+		case policy.KeepDays > 0 && now.Sub(d.CreatedAt) < time.Duration(policy.KeepDays)*24*time.Hour:
+			continue
+		}
+		expired = append(expired, d)
+	}
+	return expired
+}
+
+// removeDeployment deletes a finished deployment with everything it stored.
+// It returns false if the deployment is live, pinned, protected or
+// unfinished by now.
+func removeDeployment(ctx context.Context, db *sql.DB, minioClient *minio.Client, projectID, bucket, deploymentID string) (bool, error) {
+	rows, err := db.Query("SELECT DISTINCT hash FROM deployment_files WHERE deployment_id = $1", deploymentID)
+	if err != nil {
+		return false, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	rows.Close()
+
+	// The manifest, logs and rules go with the row
+	res, err := db.Exec(`
+		DELETE FROM deployments d
+		WHERE d.id = $1 AND d.status IN ('success', 'failed', 'cancelled')
+		AND NOT d.pinned AND NOT d.protected
+		AND NOT `+liveDeployment+`
+	`, deploymentID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	removeObjectsUnder(ctx, minioClient, bucket, deploymentPrefix(deploymentID))
+	removeObjectsUnder(ctx, minioClient, bucket, chunkPrefix(deploymentID))
+	removeUnreferencedBlobs(ctx, db, minioClient, projectID, bucket, hashes)
+	return true, nil
+}
+
+// CollectExpiredDeployments applies the retention policy of every project
+// that has one
+func CollectExpiredDeployments(db *sql.DB, minioClient *minio.Client) {
+	rows, err := db.Query("SELECT id, name FROM projects WHERE retention IS NOT NULL")
+	if err != nil {
+		log.Printf("Failed to find projects with a retention policy: %v", err)
+		return
+	}
+
+	type project struct {
+		id, name string
+	}
+	var projects []project
+	for rows.Next() {
+		var p project
+		if err := rows.Scan(&p.id, &p.name); err == nil {
+			projects = append(projects, p)
+		}
+	}
+	rows.Close()
+
+	ctx := context.Background()
+	for _, p := range projects {
+		policy, err := loadRetentionPolicy(db, p.id)
+		if err != nil {
+			log.Printf("Failed to load retention policy of '%s': %v", p.name, err)
+			continue
+		}
+		plan, err := planRetention(db, p.id, policy)
+		if err != nil {
+			log.Printf("Failed to plan retention of '%s': %v", p.name, err)
+			continue
+		}
+
+		removed := 0
+		for _, d := range plan.Deployments {
+			ok, err := removeDeployment(ctx, db, minioClient, p.id, p.name, d.ID)
+			if err != nil {
+				log.Printf("Failed to remove v%d of '%s': %v", d.Version, p.name, err)
+				continue
+			}
+			if ok {
+				removed++
+			}
+		}
+		if removed > 0 {
+			log.Printf("🧹 Removed %d expired deployments of '%s' (about %d bytes)", removed, p.name, plan.FreedBytes)
+		}
+	}
+}
+
+// GetRetentionPolicy returns a project's retention policy
+func GetRetentionPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		policy, err := loadRetentionPolicy(db, projectID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, policy, http.StatusOK)
+	}
+}
+
+// SetRetentionPolicy replaces a project's retention policy. A policy with
+// both rules off removes it.
+func SetRetentionPolicy(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var policy api.RetentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := checkRetentionPolicy(policy); err != nil {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var data []byte
+		if policy.KeepLast > 0 || policy.KeepDays > 0 {
+			data, _ = json.Marshal(policy)
+		}
+		if _, err := db.Exec("UPDATE projects SET retention = $1, updated_at = NOW() WHERE id = $2", data, projectID); err != nil {
+			respondError(w, "Failed to update retention policy", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🗂️ Retention policy of project %s set to keep_last=%d keep_days=%d", projectID, policy.KeepLast, policy.KeepDays)
+		respondJSON(w, policy, http.StatusOK)
+	}
+}
+
+func checkRetentionPolicy(policy api.RetentionPolicy) error {
+	if policy.KeepLast < 0 || policy.KeepDays < 0 {
+		return fmt.Errorf("keep_last and keep_days can't be negative")
+	}
+	return nil
+}
+
+// PreviewRetention shows what a retention policy would remove without
+// removing anything. The body may hold a policy to try instead of the
+// project's own.
+func PreviewRetention(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		policy, err := loadRetentionPolicy(db, projectID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var proposed api.RetentionPolicy
+		switch err := json.NewDecoder(r.Body).Decode(&proposed); {
+		case err == io.EOF:
+			// No body: preview the project's own policy
+		case err != nil:
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		default:
+			if err := checkRetentionPolicy(proposed); err != nil {
+				respondError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			policy = proposed
+		}
+
+		plan, err := planRetention(db, projectID, policy)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, plan, http.StatusOK)
+	}
+}
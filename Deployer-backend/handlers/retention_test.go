@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+)
+
+func TestExpiredDeployments(t *testing.T) {
+	now := time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC)
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+
+	// Newest first, as planRetention reads them
+	deployment := func(version int, status string, created time.Time, kept bool) retentionCandidate {
+		return retentionCandidate{
+			deployment: api.ExpiredDeployment{Version: version, Status: status, CreatedAt: created},
+			kept:       kept,
+		}
+	}
+	candidates := []retentionCandidate{
+		deployment(9, "processing", days(20), false),
+		deployment(8, "success", now.Add(-time.Hour), false),
+		deployment(7, "failed", now.Add(-time.Hour), false),
+		deployment(6, "success", days(3), false),
+		deployment(5, "failed", days(4), false),
+		deployment(4, "success", days(10), true),
+		deployment(3, "success", days(12), false),
+		deployment(2, "cancelled", days(15), false),
+		deployment(1, "success", days(30), false),
+	}
+
+	tests := []struct {
+		name   string
+		policy api.RetentionPolicy
+		want   []int
+	}{
+		{"keep last 2", api.RetentionPolicy{KeepLast: 2}, []int{5, 3, 2, 1}},
+		{"keep last 4", api.RetentionPolicy{KeepLast: 4}, []int{5, 2, 1}},
+		{"keep 7 days", api.RetentionPolicy{KeepDays: 7}, []int{3, 2, 1}},
+		{"keep 13 days", api.RetentionPolicy{KeepDays: 13}, []int{2, 1}},
+		// A deployment is kept if either rule keeps it
+		{"keep last 1 or 5 days", api.RetentionPolicy{KeepLast: 1, KeepDays: 5}, []int{3, 2, 1}},
+		{"keep last 4 or 5 days", api.RetentionPolicy{KeepLast: 4, KeepDays: 5}, []int{2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions := []int{}
+			for _, d := range expiredDeployments(candidates, tt.policy, now) {
+				versions = append(versions, d.Version)
+			}
+			if !reflect.DeepEqual(versions, tt.want) {
+				t.Errorf("expired versions = %v, want %v", versions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v7"
+)
+
+// Every deployment is scanned for secrets before it goes live: file names
+// like .env, and contents matching private keys, cloud access keys and
+// tokens. A match fails the deployment with the path and rule of each
+// finding. Content findings are cached per blob, tagged with the version of
+// the rule set, so unchanged files aren't read again on later deploys.
+//
+// False positives are allowed through per project with an override naming
+// a path glob, a rule and the reason. Overrides are never deleted, only
+// revoked, and every finding one lets through is written to the
+// deployment's log.
+
+const (
+	// secretRulesVersion must be bumped whenever secretRules change, so
+	// cached scan results are redone
+	secretRulesVersion = 1
+
+	// maxSecretScanSize bounds the files scanned for secrets
+	maxSecretScanSize = 10 << 20
+)
+
+// secretRule is one rule of the built-in rule set. Rules with a file name
+// pattern match paths, the others match file contents.
+type secretRule struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	fileName    *regexp.Regexp
+	content     *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{
+		ID:          "env_file",
+		Description: "environment file",
+		fileName:    regexp.MustCompile(`^\.env`),
+	},
+	{
+		ID:          "private_key",
+		Description: "private key",
+		content:     regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`),
+	},
+	{
+		ID:          "aws_access_key",
+		Description: "AWS access key",
+		content:     regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		ID:          "gcp_service_account",
+		Description: "Google Cloud service account key",
+		content:     regexp.MustCompile(`"type"\s*:\s*"service_account"`),
+	},
+	{
+		ID:          "google_api_key",
+		Description: "Google API key",
+		content:     regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`),
+	},
+	{
+		ID:          "github_token",
+		Description: "GitHub token",
+		content:     regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`),
+	},
+	{
+		ID:          "slack_token",
+		Description: "Slack token",
+		content:     regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`),
+	},
+	{
+		ID:          "stripe_secret_key",
+		Description: "Stripe secret key",
+		content:     regexp.MustCompile(`\b[sr]k_live_[0-9A-Za-z]{24,}\b`),
+	},
+	{
+		ID:          "jwt",
+		Description: "JSON Web Token",
+		content:     regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`),
+	},
+}
+
+// unscannedTypes are media types that never hold readable secrets
+var unscannedTypes = []string{"image/", "audio/", "video/", "font/", "model/", "application/pdf", "application/wasm", "application/vnd.ms-fontobject"}
+
+func findSecretRule(id string) (secretRule, bool) {
+	for _, rule := range secretRules {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return secretRule{}, false
+}
+
+// isScannable reports whether a file's contents are scanned for secrets
+func isScannable(contentType string, size int64) bool {
+	if size > maxSecretScanSize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range unscannedTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// scanSecrets fails the deployment if any of its files holds a secret that
+// no override allows
+func (u *deploymentUpload) scanSecrets() error {
+	rows, err := u.db.Query(`
+		SELECT f.path, f.hash, f.size_bytes, f.content_type, b.secrets_scan_version, b.secret_rules
+		FROM deployment_files f
+		JOIN blobs b ON b.project_id = $2 AND b.hash = f.hash
+		WHERE f.deployment_id = $1
+		ORDER BY f.path
+	`, u.deploymentID, u.projectID)
+	if err != nil {
+		return err
+	}
+
+	type scannedFile struct {
+		path, hash, contentType string
+		size                    int64
+		version                 int
+		rules                   []string
+	}
+	var files []scannedFile
+	for rows.Next() {
+		var f scannedFile
+		if err := rows.Scan(&f.path, &f.hash, &f.size, &f.contentType, &f.version, pq.Array(&f.rules)); err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	overrides, err := loadSecretOverrides(u.db, u.projectID, false)
+	if err != nil {
+		return err
+	}
+	overrideGlobs := make([]glob, len(overrides))
+	for i, o := range overrides {
+		overrideGlobs[i], _ = compileGlob(o.Pattern)
+	}
+
+	u.enterPhase(phaseScan, "Scanning %d files for secrets", len(files))
+
+	scanned := make(map[string][]string)
+	var findings []models.FileError
+	for _, f := range files {
+		var matches []string
+		for _, rule := range secretRules {
+			if rule.fileName != nil && rule.fileName.MatchString(path.Base(f.path)) {
+				matches = append(matches, rule.ID)
+			}
+		}
+
+		if isScannable(f.contentType, f.size) {
+			contentMatches, ok := scanned[f.hash]
+			if !ok && f.version == secretRulesVersion {
+				contentMatches, ok = f.rules, true
+			}
+			if !ok {
+				if contentMatches, err = u.scanBlob(f.hash); err != nil {
+					if u.ctx.Err() != nil {
+						return u.ctx.Err()
+					}
+					return fmt.Errorf("secret scan of %s: %w", f.path, err)
+				}
+			}
+			scanned[f.hash] = contentMatches
+			matches = append(matches, contentMatches...)
+		}
+
+		for _, id := range matches {
+			rule, _ := findSecretRule(id)
+			if o := matchSecretOverride(overrides, overrideGlobs, f.path, id); o != nil {
+				u.logf(logWarn, "%s: %s allowed by override %s (%s, by %s)", f.path, rule.Description, o.ID, o.Reason, o.CreatedBy)
+				continue
+			}
+			u.logf(logError, "%s: looks like a %s (rule %s)", f.path, rule.Description, id)
+			findings = append(findings, models.FileError{
+				Path:  f.path,
+				Code:  api.CodeSecretDetected,
+				Error: fmt.Sprintf("matches rule %s (%s)", id, rule.Description),
+			})
+		}
+	}
+
+	if len(findings) > 0 {
+		return &uploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    api.CodeSecretDetected,
+			Message: fmt.Sprintf("%d possible secrets found; remove them or add an override for false positives", len(findings)),
+			Files:   findings,
+		}
+	}
+
+	u.logf(logInfo, "No secrets found")
+	return nil
+}
+
+// scanBlob matches a blob's contents against the content rules and caches
+// the result on the blob
+func (u *deploymentUpload) scanBlob(hash string) ([]string, error) {
+	obj, err := u.minioClient.GetObject(u.ctx, u.projectName, blobKey(hash), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(obj, maxSecretScanSize))
+	obj.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []string{}
+	for _, rule := range secretRules {
+		if rule.content != nil && rule.content.Match(data) {
+			matches = append(matches, rule.ID)
+		}
+	}
+
+	_, err = u.db.Exec(`
+		UPDATE blobs SET secrets_scan_version = $1, secret_rules = $2
+		WHERE project_id = $3 AND hash = $4
+	`, secretRulesVersion, pq.Array(matches), u.projectID, hash)
+	if err != nil {
+		log.Printf("Failed to cache secret scan of blob %s: %v", hash, err)
+	}
+	return matches, nil
+}
+
+// matchSecretOverride returns the override allowing a finding, if any.
+// globs holds the compiled pattern of each override.
+func matchSecretOverride(overrides []models.SecretOverride, globs []glob, p, rule string) *models.SecretOverride {
+	for i, o := range overrides {
+		if o.Rule == rule && globs[i].match(p) {
+			return &overrides[i]
+		}
+	}
+	return nil
+}
+
+// loadSecretOverrides returns a project's overrides, newest first. Revoked
+// overrides are only included when asked for.
+func loadSecretOverrides(db *sql.DB, projectID string, withRevoked bool) ([]models.SecretOverride, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.pattern, o.rule, o.reason, COALESCE(c.email, ''), o.created_at, r.email, o.revoked_at
+		FROM secret_overrides o
+		LEFT JOIN users c ON c.id = o.created_by
+		LEFT JOIN users r ON r.id = o.revoked_by
+		WHERE o.project_id = $1 AND ($2 OR o.revoked_at IS NULL)
+		ORDER BY o.created_at DESC
+	`, projectID, withRevoked)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []models.SecretOverride{}
+	for rows.Next() {
+		var o models.SecretOverride
+		if err := rows.Scan(&o.ID, &o.Pattern, &o.Rule, &o.Reason, &o.CreatedBy, &o.CreatedAt, &o.RevokedBy, &o.RevokedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// ListSecretOverrides returns every override of a project, revoked ones
+// included, along with the rules that can be overridden
+func ListSecretOverrides(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		overrides, err := loadSecretOverrides(db, projectID, true)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"overrides": overrides,
+			"rules":     secretRules,
+		}, http.StatusOK)
+	}
+}
+
+// CreateSecretOverride lets the findings of a rule on the paths matching a
+// glob through. A reason is required.
+func CreateSecretOverride(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var req struct {
+			Pattern string `json:"pattern"`
+			Rule    string `json:"rule"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Pattern = strings.TrimPrefix(req.Pattern, "/")
+		req.Reason = strings.TrimSpace(req.Reason)
+
+		if req.Pattern == "" || path.Clean(req.Pattern) != req.Pattern {
+			respondError(w, "pattern must be a clean relative path", http.StatusBadRequest)
+			return
+		}
+		if _, err := globToRegexp(req.Pattern); err != nil {
+			respondError(w, "Invalid pattern", http.StatusBadRequest)
+			return
+		}
+		if _, ok := findSecretRule(req.Rule); !ok {
+			respondError(w, fmt.Sprintf("Unknown rule %q", req.Rule), http.StatusBadRequest)
+			return
+		}
+		if req.Reason == "" || len(req.Reason) > 500 {
+			respondError(w, "A reason of at most 500 characters is required", http.StatusBadRequest)
+			return
+		}
+
+		var id string
+		err := db.QueryRow(`
+			INSERT INTO secret_overrides (project_id, pattern, rule, reason, created_by)
+			VALUES ($1, $2, $3, $4, (SELECT id FROM users WHERE email = $5))
+			RETURNING id
+		`, projectID, req.Pattern, req.Rule, req.Reason, user.Email).Scan(&id)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("🔓 Secret override %s created by %s for project %s: rule %s on %s (%s)", id, user.Email, projectID, req.Rule, req.Pattern, req.Reason)
+
+		overrides, _ := loadSecretOverrides(db, projectID, false)
+		for _, o := range overrides {
+			if o.ID == id {
+				respondJSON(w, o, http.StatusCreated)
+				return
+			}
+		}
+		respondJSON(w, map[string]string{"id": id}, http.StatusCreated)
+	}
+}
+
+// RevokeSecretOverride revokes an override. It stays listed for the record.
+func RevokeSecretOverride(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		vars := mux.Vars(r)
+		projectID := vars["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE secret_overrides
+			SET revoked_at = NOW(), revoked_by = (SELECT id FROM users WHERE email = $3)
+			WHERE id::text = $1 AND project_id = $2 AND revoked_at IS NULL
+		`, vars["overrideId"], projectID, user.Email)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			respondError(w, "Override not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("🔒 Secret override %s revoked by %s", vars["overrideId"], user.Email)
+		respondJSON(w, map[string]string{"message": "Override revoked"}, http.StatusOK)
+	}
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-backend/config"
+	"github.com/minio/minio-go/v7"
+)
+
+// ServeSite serves deployed sites on {project}.{DeployDomain}, their other
+// environments on {environment}.{project}.{DeployDomain} and their branch
+// previews on {branch}--{project}.{DeployDomain}. Every request is resolved
+// through the live deployment of the environment or preview, so files from a
+// deployment that is still uploading (or that failed) are never visible. The
+// deployment's _redirects and _headers rules are applied on top of its files.
+func ServeSite(db *sql.DB, minioClient *minio.Client, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		host, ok := siteFromHost(r.Host, cfg.DeployDomain)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		site := &site{bucket: host.project, acceptEncoding: r.Header.Get("Accept-Encoding")}
+		found, err := site.lookup(db, host)
+		if err == nil && !found && host.branch != "" {
+			// Projects named before branch previews may contain the separator
+			host = siteHost{project: host.branch + branchSeparator + host.project, environment: productionEnvironment}
+			site.bucket = host.project
+			found, err = site.lookup(db, host)
+		}
+		if err != nil {
+			log.Printf("Site lookup failed for %s: %v", r.Host, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		// Serving without the rules would drop the site's security headers
+		rules, err := loadSiteRules(db, site.deploymentID)
+		if err != nil {
+			log.Printf("Loading the rules of %s failed: %v", r.Host, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Files shadow redirect rules unless the rule is forced
+		redirect, destination := rules.redirectFor(r.URL.Path, r.URL.Query(), r.URL.RawQuery)
+		if redirect == nil || !redirect.Force {
+			if site.serve(ctx, w, r, db, minioClient, rules, candidatePaths(r.URL.Path), http.StatusOK) {
+				return
+			}
+		}
+
+		if redirect != nil {
+			if redirect.Status >= 300 && redirect.Status < 400 {
+				rules.applyHeaders(w, r.URL.Path)
+				http.Redirect(w, r, destination, redirect.Status)
+				return
+			}
+
+			// Rewrites and custom error pages serve the destination's file
+			target, _, _ := strings.Cut(destination, "?")
+			if site.serve(ctx, w, r, db, minioClient, rules, candidatePaths(target), redirect.Status) {
+				return
+			}
+		}
+
+		// Single-page apps route unknown pages client-side; missing assets
+		// still get a 404
+		if site.spa && !looksLikeAsset(r.URL.Path) {
+			if site.serve(ctx, w, r, db, minioClient, rules, []string{"index.html"}, http.StatusOK) {
+				return
+			}
+		}
+
+		// Fall back to the deployment's own 404 page when it ships one
+		if site.serve(ctx, w, r, db, minioClient, rules, []string{"404.html"}, http.StatusNotFound) {
+			return
+		}
+
+		http.NotFound(w, r)
+	}
+}
+
+// site is the deployment a request is served from
+type site struct {
+	bucket       string
+	deploymentID string
+	// manifest is false for deployments stored under _deployments/{id}/
+	// before the blob store existed
+	manifest bool
+	// acceptEncoding is the request's Accept-Encoding header
+	acceptEncoding string
+	// spa serves index.html for unknown pages
+	spa bool
+}
+
+// lookup finds the deployment live at a site host, reporting false if there
+// is none
+func (s *site) lookup(db *sql.DB, host siteHost) (bool, error) {
+	var deploymentID sql.NullString
+	err := db.QueryRow(`
+		SELECT live.id,
+			EXISTS(SELECT 1 FROM deployment_files f WHERE f.deployment_id = live.id),
+			COALESCE(p.spa_mode, d.spa_mode, FALSE)
+		FROM projects p
+		CROSS JOIN LATERAL (
+			SELECT CASE
+				WHEN $3 <> '' THEN (SELECT b.active_deployment_id FROM branch_aliases b WHERE b.project_id = p.id AND b.slug = $3)
+				WHEN $2 = 'production' THEN p.active_deployment_id
+				ELSE (SELECT e.active_deployment_id FROM project_environments e WHERE e.project_id = p.id AND e.name = $2)
+			END AS id
+		) live
+		LEFT JOIN deployments d ON d.id = live.id
+		WHERE p.name = $1
+	`, host.project, host.environment, host.branch).Scan(&deploymentID, &s.manifest, &s.spa)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	s.deploymentID = deploymentID.String
+	return deploymentID.Valid, nil
+}
+
+// serve writes the first of the candidate files that exists with the given
+// status, reporting false if none does
+func (s *site) serve(ctx context.Context, w http.ResponseWriter, r *http.Request, db *sql.DB, minioClient *minio.Client, rules *siteRules, candidates []string, status int) bool {
+	for _, candidate := range candidates {
+		obj, info, ok := s.open(ctx, db, minioClient, candidate)
+		if !ok {
+			continue
+		}
+		defer obj.Close()
+
+		s.setHeaders(w, info)
+		rules.applyHeaders(w, r.URL.Path)
+
+		if status == http.StatusOK {
+			w.Header().Set("ETag", info.ETag)
+			http.ServeContent(w, r, candidate, info.LastModified, obj)
+			return true
+		}
+
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			io.Copy(w, obj)
+		}
+		return true
+	}
+	return false
+}
+
+// setHeaders sets the representation headers of an opened file
+func (s *site) setHeaders(w http.ResponseWriter, info minio.ObjectInfo) {
+	w.Header().Set("Content-Type", info.ContentType)
+	// The content type was verified at deploy time; browsers must not guess
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if s.manifest {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if encoding := info.Metadata.Get("Content-Encoding"); encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Cache-Control", info.Metadata.Get("Cache-Control"))
+}
+
+// open opens a file of the site's deployment, reporting false if it doesn't exist
+func (s *site) open(ctx context.Context, db *sql.DB, minioClient *minio.Client, path string) (*minio.Object, minio.ObjectInfo, bool) {
+	// Rules files configure the site and aren't part of it
+	if path == headersFile || path == redirectsFile {
+		return nil, minio.ObjectInfo{}, false
+	}
+
+	if !s.manifest {
+		obj, info, ok := openSiteObject(ctx, minioClient, s.bucket, deploymentPrefix(s.deploymentID)+path)
+		info.Metadata = http.Header{"Cache-Control": []string{cacheControlFor(nil, path)}}
+		return obj, info, ok
+	}
+
+	entry, ok, err := lookupManifestEntry(db, s.deploymentID, path)
+	if err != nil {
+		log.Printf("Manifest lookup failed for %s (deployment=%s): %v", path, s.deploymentID, err)
+	}
+	if !ok {
+		return nil, minio.ObjectInfo{}, false
+	}
+	if entry.CacheControl == "" {
+		entry.CacheControl = cacheControlFor(nil, path)
+	}
+
+	// Serve a precompressed variant when the client accepts one
+	if encoding := negotiateEncoding(s.acceptEncoding, entry.Encodings); encoding != "" {
+		if obj, info, ok := openSiteObject(ctx, minioClient, s.bucket, variantKey(entry.Hash, encoding)); ok {
+			info.ContentType = entry.ContentType
+			info.ETag = `"` + entry.Hash + "-" + encoding + `"`
+			info.Metadata = http.Header{
+				"Content-Encoding": []string{encoding},
+				"Cache-Control":    []string{entry.CacheControl},
+			}
+			return obj, info, true
+		}
+		log.Printf("Missing %s variant of blob %s (deployment=%s)", encoding, entry.Hash, s.deploymentID)
+	}
+
+	obj, info, ok := openSiteObject(ctx, minioClient, s.bucket, blobKey(entry.Hash))
+	if !ok {
+		log.Printf("Missing blob %s for %s (deployment=%s)", entry.Hash, path, s.deploymentID)
+		return nil, minio.ObjectInfo{}, false
+	}
+	info.ContentType = entry.ContentType
+	info.ETag = `"` + entry.Hash + `"`
+	info.Metadata = http.Header{"Cache-Control": []string{entry.CacheControl}}
+	return obj, info, true
+}
+
+// siteHost is what a site's hostname names: a project and either one of its
+// environments or the slug of one of its branch previews
+type siteHost struct {
+	project     string
+	environment string
+	branch      string
+}
+
+// siteFromHost parses a {project}.{domain} host, which is production, an
+// {environment}.{project}.{domain} host or a {branch}--{project}.{domain} host
+func siteFromHost(host, domain string) (siteHost, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	suffix := "." + strings.ToLower(domain)
+	if !strings.HasSuffix(host, suffix) {
+		return siteHost{}, false
+	}
+
+	site := siteHost{project: strings.TrimSuffix(host, suffix), environment: productionEnvironment}
+	if env, project, ok := strings.Cut(site.project, "."); ok {
+		site.environment, site.project = env, project
+	} else if branch, project, ok := strings.Cut(site.project, branchSeparator); ok && branch != "" {
+		site.branch, site.project = branch, project
+	}
+	if !validProjectName(site.project) || site.environment == "" {
+		return siteHost{}, false
+	}
+	return site, true
+}
+
+// candidatePaths lists the object paths (relative to a deployment prefix) that
+// may satisfy a request path, in order of preference
+func candidatePaths(requestPath string) []string {
+	cleaned := strings.TrimPrefix(path.Clean("/"+requestPath), "/")
+
+	if cleaned == "" {
+		return []string{"index.html"}
+	}
+	if strings.HasSuffix(requestPath, "/") {
+		return []string{cleaned + "/index.html"}
+	}
+	return []string{cleaned, cleaned + "/index.html", cleaned + ".html"}
+}
+
+// looksLikeAsset reports whether a request path names a file rather than a
+// client-side route: its last segment has an extension other than .html
+func looksLikeAsset(requestPath string) bool {
+	ext := strings.ToLower(path.Ext(path.Base(requestPath)))
+	return ext != "" && ext != ".html" && ext != ".htm"
+}
+
+// openSiteObject opens an object for serving, reporting false if it doesn't exist
+func openSiteObject(ctx context.Context, minioClient *minio.Client, bucket, key string) (*minio.Object, minio.ObjectInfo, bool) {
+	obj, err := minioClient.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, false
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			log.Printf("Failed to stat %s/%s: %v", bucket, key, err)
+		}
+		obj.Close()
+		return nil, minio.ObjectInfo{}, false
+	}
+
+	info.ETag = `"` + info.ETag + `"`
+	return obj, info, true
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import "testing"
+
+func TestSiteFromHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want siteHost
+		ok   bool
+	}{
+		{"shop.deploy.test", siteHost{project: "shop", environment: productionEnvironment}, true},
+		{"shop.deploy.test:8080", siteHost{project: "shop", environment: productionEnvironment}, true},
+		{"Shop.Deploy.Test", siteHost{project: "shop", environment: productionEnvironment}, true},
+		{"staging.shop.deploy.test", siteHost{project: "shop", environment: "staging"}, true},
+		{"feature-login--shop.deploy.test", siteHost{project: "shop", environment: productionEnvironment, branch: "feature-login"}, true},
+		// Project names contain neither . nor --, so each host has one reading
+		{"a--b.deploy.test", siteHost{project: "b", environment: productionEnvironment, branch: "a"}, true},
+		{"a.b.deploy.test", siteHost{project: "b", environment: "a"}, true},
+		{"staging.a--b.deploy.test", siteHost{}, false},
+		{"a--b--c.deploy.test", siteHost{}, false},
+		{"--shop.deploy.test", siteHost{}, false},
+		{"shop--.deploy.test", siteHost{}, false},
+		{"shop_1.deploy.test", siteHost{}, false},
+		{"deploy.test", siteHost{}, false},
+		{".deploy.test", siteHost{}, false},
+		{"a.b.shop.deploy.test", siteHost{}, false},
+		{"staging..deploy.test", siteHost{}, false},
+		{".shop.deploy.test", siteHost{}, false},
+		{"shop.example.com", siteHost{}, false},
+		{"shopdeploy.test", siteHost{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			site, ok := siteFromHost(tt.host, "deploy.test")
+			if site != tt.want || ok != tt.ok {
+				t.Errorf("siteFromHost = %+v, %v, want %+v, %v", site, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/gorilla/mux"
+	"github.com/minio/minio-go/v7"
+)
+
+// An incremental deployment that is still uploading is an upload session. A
+// missing blob can be sent in chunks, each addressed by its byte offset:
+//
+//	HEAD  /api/deployments/{id}/blobs/{hash}  -> Upload-Offset: bytes received
+//	PATCH /api/deployments/{id}/blobs/{hash}  (Upload-Offset: N, body = chunk)
+//
+// A chunk at the wrong offset is answered with 409 and the current offset, so
+// a client that lost a response simply continues from there. Sessions expire
+// after uploadSessionTTL without activity and are then cancelled as abandoned.
+
+const (
+	// uploadSessionTTL is how long a session stays open without activity
+	uploadSessionTTL = 24 * time.Hour
+	// maxChunkSize caps a single chunk of a resumable blob upload
+	maxChunkSize = 16 << 20
+)
+
+// chunkPrefix returns the object prefix holding a session's partial uploads
+func chunkPrefix(deploymentID string) string {
+	return fmt.Sprintf("_uploads/%s/", deploymentID)
+}
+
+func chunkKey(deploymentID, hash string, offset int64) string {
+	return fmt.Sprintf("%s%s/%d", chunkPrefix(deploymentID), hash, offset)
+}
+
+// BlobUploadOffset reports how many bytes of a blob the session has received
+func BlobUploadOffset(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		upload, hash, size, err := loadSessionBlob(r.Context(), db, minioClient, user.Email, mux.Vars(r))
+		if err != nil {
+			respondUploadError(w, err)
+			return
+		}
+
+		offset, err := upload.blobOffset(hash, size)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// UploadBlobChunk appends one chunk of a blob at the offset given in the
+// Upload-Offset header. The blob is assembled and verified once complete.
+func UploadBlobChunk(db *sql.DB, minioClient *minio.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			respondError(w, "Missing or invalid Upload-Offset header", http.StatusBadRequest)
+			return
+		}
+
+		upload, hash, size, err := loadSessionBlob(r.Context(), db, minioClient, user.Email, mux.Vars(r))
+		if err != nil {
+			respondUploadError(w, err)
+			return
+		}
+
+		current, err := upload.blobOffset(hash, size)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+		if offset != current {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+			respondError(w, fmt.Sprintf("Upload offset mismatch: expected %d", current), http.StatusConflict)
+			return
+		}
+
+		if current == size {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+			respondJSON(w, map[string]interface{}{
+				"hash":       hash,
+				"offset":     current,
+				"size_bytes": size,
+				"complete":   true,
+			}, http.StatusOK)
+			return
+		}
+
+		remaining := size - current
+		if remaining > maxChunkSize {
+			remaining = maxChunkSize
+		}
+		limited := &limitedReader{r: r.Body, fileLimit: remaining, totalLimit: remaining}
+		chunk, err := spoolUpload(limited)
+		if limited.fileExceeded {
+			respondError(w, fmt.Sprintf("Chunk too large: at most %d bytes expected at offset %d", remaining, current), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			respondError(w, "Failed to read chunk", http.StatusBadRequest)
+			return
+		}
+		defer chunk.Close()
+
+		if chunk.Size > 0 {
+			if err := upload.putChunk(hash, current, chunk); err != nil {
+				log.Printf("Failed to store chunk of %s at %d: %v", hash, current, err)
+				respondError(w, "Failed to store chunk", http.StatusInternalServerError)
+				return
+			}
+			current += chunk.Size
+		}
+
+		if current == size {
+			if err := upload.assembleBlob(hash, size); err != nil {
+				w.Header().Set("Upload-Offset", "0")
+				respondUploadError(w, err)
+				return
+			}
+		}
+
+		upload.touchSession()
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		respondJSON(w, map[string]interface{}{
+			"hash":       hash,
+			"offset":     current,
+			"size_bytes": size,
+			"complete":   current == size,
+		}, http.StatusOK)
+	}
+}
+
+// loadSessionBlob resolves the session and the declared size of a blob in its
+// manifest from the {id} and {hash} route variables
+func loadSessionBlob(ctx context.Context, db *sql.DB, minioClient *minio.Client, email string, vars map[string]string) (*deploymentUpload, string, int64, error) {
+	hash := vars["hash"]
+	if !manifest.ValidHash(hash) {
+		return nil, "", 0, &uploadError{Status: http.StatusBadRequest, Message: "Invalid hash"}
+	}
+
+	upload, err := loadDeploymentUpload(ctx, db, minioClient, email, vars["id"])
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	var size int64
+	err = db.QueryRow(`
+		SELECT size_bytes FROM deployment_files
+		WHERE deployment_id = $1 AND hash = $2
+		LIMIT 1
+	`, upload.deploymentID, hash).Scan(&size)
+	if err == sql.ErrNoRows {
+		return nil, "", 0, &uploadError{Status: http.StatusNotFound, Message: "Hash is not part of this deployment's manifest"}
+	} else if err != nil {
+		return nil, "", 0, &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+	}
+
+	return upload, hash, size, nil
+}
+
+// blobOffset is the number of bytes of a blob received so far. A blob the
+// project already stores counts as fully received.
+func (u *deploymentUpload) blobOffset(hash string, size int64) (int64, error) {
+	exists, err := blobExists(u.db, u.projectID, hash)
+	if err != nil || exists {
+		return size, err
+	}
+
+	var offset int64
+	err = u.db.QueryRow(`
+		SELECT COALESCE(SUM(size_bytes), 0) FROM upload_chunks
+		WHERE deployment_id = $1 AND hash = $2
+	`, u.deploymentID, hash).Scan(&offset)
+	return offset, err
+}
+
+// putChunk stores one chunk of a blob at offset
+func (u *deploymentUpload) putChunk(hash string, offset int64, chunk *spooledFile) error {
+	_, err := u.minioClient.PutObject(u.ctx, u.projectName, chunkKey(u.deploymentID, hash, offset),
+		chunk, chunk.Size, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+
+	_, err = u.db.Exec(`
+		INSERT INTO upload_chunks (deployment_id, hash, offset_bytes, size_bytes)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (deployment_id, hash, offset_bytes) DO UPDATE SET size_bytes = EXCLUDED.size_bytes
+	`, u.deploymentID, hash, offset, chunk.Size)
+	return err
+}
+
+// assembleBlob concatenates the chunks of a blob, verifies the result against
+// its hash and stores it. The chunks are dropped either way; on a mismatch the
+// client starts that blob over from offset 0.
+func (u *deploymentUpload) assembleBlob(hash string, size int64) error {
+	defer u.dropChunks(hash)
+
+	rows, err := u.db.Query(`
+		SELECT offset_bytes FROM upload_chunks
+		WHERE deployment_id = $1 AND hash = $2
+		ORDER BY offset_bytes
+	`, u.deploymentID, hash)
+	if err != nil {
+		return &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+	}
+
+	var readers []io.Reader
+	for rows.Next() {
+		var offset int64
+		if err := rows.Scan(&offset); err != nil {
+			rows.Close()
+			return &uploadError{Status: http.StatusInternalServerError, Message: "Database error"}
+		}
+		obj, err := u.minioClient.GetObject(u.ctx, u.projectName, chunkKey(u.deploymentID, hash, offset), minio.GetObjectOptions{})
+		if err != nil {
+			rows.Close()
+			return &uploadError{Status: http.StatusInternalServerError, Message: "Failed to read uploaded chunks"}
+		}
+		defer obj.Close()
+		readers = append(readers, obj)
+	}
+	rows.Close()
+
+	return u.putManifestBlob(hash, size, getContentTypeForHash(u.db, u.deploymentID, hash), io.MultiReader(readers...))
+}
+
+// dropChunks removes the partial upload of a blob
+func (u *deploymentUpload) dropChunks(hash string) {
+	removeObjectsUnder(context.Background(), u.minioClient, u.projectName, chunkPrefix(u.deploymentID)+hash+"/")
+	u.db.Exec("DELETE FROM upload_chunks WHERE deployment_id = $1 AND hash = $2", u.deploymentID, hash)
+}
+
+// touchSession records activity and extends the session's expiry
+func (u *deploymentUpload) touchSession() {
+	u.db.Exec(`
+		UPDATE deployments SET session_expires_at = NOW() + $1 * INTERVAL '1 second', last_activity_at = NOW()
+		WHERE id = $2 AND status = 'uploading'
+	`, int(uploadSessionTTL.Seconds()), u.deploymentID)
+}
+
+// getContentTypeForHash returns the content type recorded for a hash in a
+// deployment's manifest
+func getContentTypeForHash(db *sql.DB, deploymentID, hash string) string {
+	var contentType string
+	err := db.QueryRow(`
+		SELECT content_type FROM deployment_files
+		WHERE deployment_id = $1 AND hash = $2
+		LIMIT 1
+	`, deploymentID, hash).Scan(&contentType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return contentType
+}
@@ -0,0 +1,508 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/minio/minio-go/v7"
+)
+
+// A deployment may ship Netlify-style _headers and _redirects files at its
+// root. They are parsed when the deployment is processed, stored in
+// deployment_rules and applied by the site server; the files themselves are
+// never served. A syntax error fails the deployment.
+//
+// _redirects holds one rule per line:
+//
+//	/from [param=value ...] /to [status][!]
+//
+// :name placeholders match one path segment and a trailing /* matches the
+// rest of the path as :splat. Query conditions are param=value pairs where
+// value may be a placeholder. The status defaults to 301; 200 rewrites,
+// 3xx redirects and 4xx serves the destination with that status. Unless the
+// status ends in !, a rule only applies when no file exists at the path.
+//
+// _headers holds a path line followed by indented Name: value lines.
+
+const (
+	headersFile   = "_headers"
+	redirectsFile = "_redirects"
+
+	ruleKindRedirect = "redirect"
+	ruleKindHeader   = "header"
+
+	// maxRulesFileSize caps the size of a _headers or _redirects file
+	maxRulesFileSize = 256 << 10
+	// maxSiteRules caps the rules of a single file
+	maxSiteRules = 1000
+	// siteRulesCacheSize bounds the deployments whose rules stay in memory
+	siteRulesCacheSize = 1024
+)
+
+// redirectRule is one line of a _redirects file
+type redirectRule struct {
+	Path        string
+	Destination string
+	Status      int
+	Force       bool
+	Query       map[string]string
+}
+
+// headerRule is one path block of a _headers file
+type headerRule struct {
+	Path    string
+	Headers map[string]string
+}
+
+// siteRules are the parsed _redirects and _headers of a deployment
+type siteRules struct {
+	redirects []redirectRule
+	headers   []headerRule
+}
+
+// ruleSyntaxError is a syntax error at a line of a rules file
+type ruleSyntaxError struct {
+	Line    int
+	Message string
+}
+
+var placeholderPattern = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)`)
+
+// protectedHeaders are managed by the site server and can't be set by rules.
+// Content types are verified at deploy time, so rules can't change them or
+// let browsers sniff.
+var protectedHeaders = map[string]bool{
+	"Content-Length":         true,
+	"Content-Encoding":       true,
+	"Content-Type":           true,
+	"X-Content-Type-Options": true,
+	"Transfer-Encoding":      true,
+	"Connection":             true,
+	"Location":               true,
+}
+
+// parseRedirects parses the content of a _redirects file
+func parseRedirects(data []byte) ([]redirectRule, []ruleSyntaxError) {
+	var rules []redirectRule
+	var errs []ruleSyntaxError
+
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, ruleSyntaxError{Line: n + 1, Message: fmt.Sprintf(format, args...)})
+		}
+
+		rule := redirectRule{Path: fields[0], Status: http.StatusMovedPermanently}
+		if msg := checkRulePath(rule.Path); msg != "" {
+			fail("%s", msg)
+			continue
+		}
+
+		i := 1
+		for ; i < len(fields) && !isRuleDestination(fields[i]); i++ {
+			key, value, ok := strings.Cut(fields[i], "=")
+			if !ok || key == "" {
+				break
+			}
+			if rule.Query == nil {
+				rule.Query = make(map[string]string)
+			}
+			rule.Query[key] = value
+		}
+		if i >= len(fields) {
+			fail("missing destination")
+			continue
+		}
+		if !isRuleDestination(fields[i]) {
+			fail("invalid destination %q: must be a path starting with / or an http(s) URL", fields[i])
+			continue
+		}
+		rule.Destination = fields[i]
+		i++
+
+		if i < len(fields) {
+			status := strings.TrimSuffix(fields[i], "!")
+			rule.Force = status != fields[i]
+			code, err := strconv.Atoi(status)
+			if err != nil || !isRuleStatus(code) {
+				fail("invalid status %q", fields[i])
+				continue
+			}
+			rule.Status = code
+			i++
+		}
+		if i < len(fields) {
+			fail("unsupported condition %q", fields[i])
+			continue
+		}
+
+		if (rule.Status == http.StatusOK || rule.Status >= 400) && !strings.HasPrefix(rule.Destination, "/") {
+			fail("rewrites (status 200) and error pages (4xx) must point to a path of the site")
+			continue
+		}
+
+		if len(rules) == maxSiteRules {
+			fail("more than %d rules", maxSiteRules)
+			break
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errs
+}
+
+// parseHeaders parses the content of a _headers file
+func parseHeaders(data []byte) ([]headerRule, []ruleSyntaxError) {
+	var rules []headerRule
+	var errs []ruleSyntaxError
+	var current *headerRule
+
+	for n, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, ruleSyntaxError{Line: n + 1, Message: fmt.Sprintf(format, args...)})
+		}
+
+		// Paths start at the beginning of the line, headers are indented
+		if line[0] != ' ' && line[0] != '\t' {
+			current = nil
+			if msg := checkRulePath(trimmed); msg != "" {
+				fail("%s", msg)
+				continue
+			}
+			if len(rules) == maxSiteRules {
+				fail("more than %d rules", maxSiteRules)
+				break
+			}
+			rules = append(rules, headerRule{Path: trimmed, Headers: make(map[string]string)})
+			current = &rules[len(rules)-1]
+			continue
+		}
+
+		if current == nil {
+			fail("header without a path above it")
+			continue
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			fail("expected \"Name: value\"")
+			continue
+		}
+		if protectedHeaders[name] {
+			fail("%s can't be set", name)
+			continue
+		}
+		if previous, ok := current.Headers[name]; ok {
+			value = previous + ", " + value
+		}
+		current.Headers[name] = value
+	}
+	return rules, errs
+}
+
+// checkRulePath returns why a rule path is invalid, or "" if it is fine
+func checkRulePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return fmt.Sprintf("invalid path %q: must start with /", p)
+	}
+	// A splat is a whole last segment: /foo/* matches below /foo, /foo* would
+	// never match
+	if i := strings.Index(p, "*"); i >= 0 && (i != len(p)-1 || p[i-1] != '/') {
+		return fmt.Sprintf("invalid path %q: * is only allowed as the last segment", p)
+	}
+	return ""
+}
+
+func isRuleDestination(s string) bool {
+	return strings.HasPrefix(s, "/") || strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func isRuleStatus(code int) bool {
+	switch code {
+	case 200, 301, 302, 303, 307, 308:
+		return true
+	}
+	return code >= 400 && code < 500
+}
+
+// parseSiteRules reads the deployment's _redirects and _headers files, if
+// any, and stores their rules. Syntax errors are logged with their line
+// numbers and fail the deployment.
+func (u *deploymentUpload) parseSiteRules() error {
+	var rules siteRules
+	var fileErrors []models.FileError
+
+	for _, name := range []string{redirectsFile, headersFile} {
+		data, ok, err := u.readDeploymentFile(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		var errs []ruleSyntaxError
+		if name == redirectsFile {
+			rules.redirects, errs = parseRedirects(data)
+			u.logf(logInfo, "Parsed %d rules from %s", len(rules.redirects), name)
+		} else {
+			rules.headers, errs = parseHeaders(data)
+			u.logf(logInfo, "Parsed %d rules from %s", len(rules.headers), name)
+		}
+		for _, e := range errs {
+			u.logf(logError, "%s line %d: %s", name, e.Line, e.Message)
+			fileErrors = append(fileErrors, models.FileError{Path: name, Code: api.CodeRulesSyntax, Error: fmt.Sprintf("line %d: %s", e.Line, e.Message)})
+		}
+	}
+
+	if len(fileErrors) > 0 {
+		return &uploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    api.CodeRulesSyntax,
+			Message: fmt.Sprintf("%d syntax errors in _redirects or _headers", len(fileErrors)),
+			Files:   fileErrors,
+		}
+	}
+	u.siteRules = &rules
+	return storeSiteRules(u.db, u.deploymentID, rules)
+}
+
+// readDeploymentFile reads a small file of the deployment by path
+func (u *deploymentUpload) readDeploymentFile(name string) ([]byte, bool, error) {
+	entry, ok, err := lookupManifestEntry(u.db, u.deploymentID, name)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if entry.Size > maxRulesFileSize {
+		return nil, false, &uploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    api.CodeFileTooLarge,
+			Message: fmt.Sprintf("%s is larger than %d KB", name, maxRulesFileSize>>10),
+			Files:   []models.FileError{{Path: name, Code: api.CodeFileTooLarge, Error: "file too large"}},
+		}
+	}
+
+	obj, err := u.minioClient.GetObject(u.ctx, u.projectName, blobKey(entry.Hash), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj, maxRulesFileSize))
+	return data, err == nil, err
+}
+
+// storeSiteRules replaces the stored rules of a deployment
+func storeSiteRules(db *sql.DB, deploymentID string, rules siteRules) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM deployment_rules WHERE deployment_id = $1", deploymentID); err != nil {
+		return err
+	}
+	for i, rule := range rules.redirects {
+		query, _ := json.Marshal(rule.Query)
+		if _, err := tx.Exec(`
+			INSERT INTO deployment_rules (deployment_id, kind, position, path, destination, status, forced, query)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, deploymentID, ruleKindRedirect, i, rule.Path, rule.Destination, rule.Status, rule.Force, query); err != nil {
+			return err
+		}
+	}
+	for i, rule := range rules.headers {
+		headers, _ := json.Marshal(rule.Headers)
+		if _, err := tx.Exec(`
+			INSERT INTO deployment_rules (deployment_id, kind, position, path, headers)
+			VALUES ($1, $2, $3, $4, $5)
+		`, deploymentID, ruleKindHeader, i, rule.Path, headers); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// siteRulesCache keeps the rules of recently served deployments. Rules never
+// change once a deployment is live.
+var siteRulesCache = struct {
+	sync.Mutex
+	rules map[string]*siteRules
+}{rules: make(map[string]*siteRules)}
+
+// loadSiteRules returns the rules of a live deployment
+func loadSiteRules(db *sql.DB, deploymentID string) (*siteRules, error) {
+	siteRulesCache.Lock()
+	cached, ok := siteRulesCache.rules[deploymentID]
+	siteRulesCache.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT kind, path, COALESCE(destination, ''), COALESCE(status, 0), forced, query, headers
+		FROM deployment_rules
+		WHERE deployment_id = $1
+		ORDER BY kind, position
+	`, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := &siteRules{}
+	for rows.Next() {
+		var kind, path, destination string
+		var status int
+		var force bool
+		var query, headers []byte
+		if err := rows.Scan(&kind, &path, &destination, &status, &force, &query, &headers); err != nil {
+			return nil, err
+		}
+
+		if kind == ruleKindRedirect {
+			rule := redirectRule{Path: path, Destination: destination, Status: status, Force: force}
+			json.Unmarshal(query, &rule.Query)
+			rules.redirects = append(rules.redirects, rule)
+		} else {
+			rule := headerRule{Path: path}
+			json.Unmarshal(headers, &rule.Headers)
+			rules.headers = append(rules.headers, rule)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	siteRulesCache.Lock()
+	if len(siteRulesCache.rules) >= siteRulesCacheSize {
+		siteRulesCache.rules = make(map[string]*siteRules)
+	}
+	siteRulesCache.rules[deploymentID] = rules
+	siteRulesCache.Unlock()
+	return rules, nil
+}
+
+// matchRulePath matches a request path against a rule path, returning the
+// values of its placeholders and splat
+func matchRulePath(pattern, p string) (map[string]string, bool) {
+	patternSegments := splitRulePath(pattern)
+	pathSegments := splitRulePath(p)
+	params := make(map[string]string)
+
+	for i, segment := range patternSegments {
+		if segment == "*" && i == len(patternSegments)-1 {
+			params["splat"] = strings.Join(pathSegments[i:], "/")
+			return params, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		if strings.HasPrefix(segment, ":") {
+			params[segment[1:]] = pathSegments[i]
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return params, len(patternSegments) == len(pathSegments)
+}
+
+// splitRulePath splits a path into its segments. Empty segments are dropped,
+// so that they can't end up in a placeholder.
+func splitRulePath(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool { return r == '/' })
+}
+
+// redirectFor returns the first redirect rule matching the request and its
+// destination with placeholders filled in
+func (s *siteRules) redirectFor(p string, query url.Values, rawQuery string) (*redirectRule, string) {
+	for i := range s.redirects {
+		rule := &s.redirects[i]
+		params, ok := matchRulePath(rule.Path, p)
+		if !ok || !matchRuleQuery(rule.Query, query, params) {
+			continue
+		}
+
+		destination := placeholderPattern.ReplaceAllStringFunc(rule.Destination, func(m string) string {
+			if v, ok := params[m[1:]]; ok {
+				return escapeRuleParam(m[1:], v)
+			}
+			return m
+		})
+		// A path destination must stay on the site: browsers take //host and
+		// /\host for another host
+		if strings.HasPrefix(destination, "//") || strings.HasPrefix(destination, "/\\") {
+			continue
+		}
+		// Pass the query string on unless the rule consumed it
+		if len(rule.Query) == 0 && rawQuery != "" && !strings.Contains(destination, "?") {
+			destination += "?" + rawQuery
+		}
+		return rule, destination
+	}
+	return nil, ""
+}
+
+// escapeRuleParam escapes the value of a placeholder for a destination. The
+// splat keeps its slashes.
+func escapeRuleParam(name, value string) string {
+	if name != "splat" {
+		return url.PathEscape(value)
+	}
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// matchRuleQuery checks a rule's query conditions, capturing placeholders
+func matchRuleQuery(conditions map[string]string, query url.Values, params map[string]string) bool {
+	for key, want := range conditions {
+		if !query.Has(key) {
+			return false
+		}
+		got := query.Get(key)
+		if strings.HasPrefix(want, ":") {
+			params[want[1:]] = got
+		} else if got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// applyHeaders sets the headers of every _headers rule matching the path. A
+// later rule overrides a header set by an earlier one.
+func (s *siteRules) applyHeaders(w http.ResponseWriter, p string) {
+	for _, rule := range s.headers {
+		if _, ok := matchRulePath(rule.Path, p); !ok {
+			continue
+		}
+		for name, value := range rule.Headers {
+			// Rules stored before a header became protected are still live
+			if protectedHeaders[name] {
+				continue
+			}
+			w.Header().Set(name, value)
+		}
+	}
+}
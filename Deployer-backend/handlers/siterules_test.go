@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRedirects(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []redirectRule
+		wantLines []int
+	}{
+		{
+			name:  "defaults to 301",
+			input: "/old /new",
+			want:  []redirectRule{{Path: "/old", Destination: "/new", Status: 301}},
+		},
+		{
+			name: "status, force, query and comments",
+			input: "# moved\n" +
+				"/docs/*  /guide/:splat  302\n" +
+				"/search q=:term  /find?q=:term  200!\n" +
+				"\n" +
+				"/api/*  https://api.example.com/:splat  307",
+			want: []redirectRule{
+				{Path: "/docs/*", Destination: "/guide/:splat", Status: 302},
+				{Path: "/search", Destination: "/find?q=:term", Status: 200, Force: true, Query: map[string]string{"q": ":term"}},
+				{Path: "/api/*", Destination: "https://api.example.com/:splat", Status: 307},
+			},
+		},
+		{
+			name:  "custom 404 page",
+			input: "/*  /404.html  404",
+			want:  []redirectRule{{Path: "/*", Destination: "/404.html", Status: 404}},
+		},
+		{
+			name: "syntax errors are reported by line",
+			input: "old /new\n" +
+				"/missing\n" +
+				"/bad-status /new 500\n" +
+				"/proxy https://example.com 200\n" +
+				"/extra /new 301 Country=nl\n" +
+				"/gone https://example.com/404.html 404\n" +
+				"/ok /new",
+			want:      []redirectRule{{Path: "/ok", Destination: "/new", Status: 301}},
+			wantLines: []int{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:      "splat in the middle of a segment",
+			input:     "/foo* /bar\n/foo/*/bar /baz",
+			wantLines: []int{1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, errs := parseRedirects([]byte(tt.input))
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("rules = %+v, want %+v", rules, tt.want)
+			}
+			if lines := errorLines(errs); !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("error lines = %v, want %v (%+v)", lines, tt.wantLines, errs)
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      []headerRule
+		wantLines []int
+	}{
+		{
+			name: "headers below their path",
+			input: "/*\n" +
+				"  X-Frame-Options: DENY\n" +
+				"  cache-control: no-cache\n" +
+				"/assets/*\n" +
+				"\tCache-Control: public, max-age=31536000",
+			want: []headerRule{
+				{Path: "/*", Headers: map[string]string{"X-Frame-Options": "DENY", "Cache-Control": "no-cache"}},
+				{Path: "/assets/*", Headers: map[string]string{"Cache-Control": "public, max-age=31536000"}},
+			},
+		},
+		{
+			name: "repeated header is joined",
+			input: "/\n" +
+				"  Link: </a.css>; rel=preload\n" +
+				"  Link: </b.js>; rel=preload",
+			want: []headerRule{
+				{Path: "/", Headers: map[string]string{"Link": "</a.css>; rel=preload, </b.js>; rel=preload"}},
+			},
+		},
+		{
+			name: "protected headers",
+			input: "/*\n" +
+				"  Content-Type: text/html\n" +
+				"  x-content-type-options: none\n" +
+				"  Content-Length: 1\n" +
+				"  X-Robots-Tag: noindex",
+			want:      []headerRule{{Path: "/*", Headers: map[string]string{"X-Robots-Tag": "noindex"}}},
+			wantLines: []int{2, 3, 4},
+		},
+		{
+			name: "syntax errors are reported by line",
+			input: "  X-Orphan: 1\n" +
+				"no-slash\n" +
+				"/page\n" +
+				"  not a header",
+			want:      []headerRule{{Path: "/page", Headers: map[string]string{}}},
+			wantLines: []int{1, 2, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, errs := parseHeaders([]byte(tt.input))
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("rules = %+v, want %+v", rules, tt.want)
+			}
+			if lines := errorLines(errs); !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("error lines = %v, want %v (%+v)", lines, tt.wantLines, errs)
+			}
+		})
+	}
+}
+
+func errorLines(errs []ruleSyntaxError) []int {
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	return lines
+}
+
+func TestMatchRulePath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    map[string]string
+		ok      bool
+	}{
+		{"/", "/", map[string]string{}, true},
+		{"/about", "/about", map[string]string{}, true},
+		{"/about", "/about/", map[string]string{}, true},
+		{"/about", "/about/team", nil, false},
+		{"/about", "/", nil, false},
+		{"/blog/:year/:slug", "/blog/2024/hello", map[string]string{"year": "2024", "slug": "hello"}, true},
+		{"/blog/:year/:slug", "/blog/2024", nil, false},
+		{"/*", "/", map[string]string{"splat": ""}, true},
+		{"/*", "/a/b/c", map[string]string{"splat": "a/b/c"}, true},
+		{"/docs/*", "/docs", map[string]string{"splat": ""}, true},
+		{"/docs/*", "/docs/a/b", map[string]string{"splat": "a/b"}, true},
+		{"/docs/*", "/guide/a", nil, false},
+		{"/:lang/*", "/en/docs/intro", map[string]string{"lang": "en", "splat": "docs/intro"}, true},
+		// Empty segments never reach a placeholder
+		{"/docs/*", "/docs//evil.com", map[string]string{"splat": "evil.com"}, true},
+		{"/docs/*", "/docs///evil.com//x", map[string]string{"splat": "evil.com/x"}, true},
+		{"/:page", "//evil.com", map[string]string{"page": "evil.com"}, true},
+		{"/docs/:page", "/docs//", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			params, ok := matchRulePath(tt.pattern, tt.path)
+			if ok != tt.ok {
+				t.Fatalf("matched = %v, want %v", ok, tt.ok)
+			}
+			if ok && !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("params = %v, want %v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedirectFor(t *testing.T) {
+	rules := &siteRules{redirects: []redirectRule{
+		{Path: "/old/*", Destination: "/:splat", Status: 301},
+		{Path: "/user/:name", Destination: "/profiles/:name", Status: 302},
+		{Path: "/ext/*", Destination: "https://example.com/:splat", Status: 302},
+	}}
+
+	tests := []struct {
+		path string
+		// want is the destination, "" for no redirect
+		want string
+	}{
+		{"/old/docs/intro", "/docs/intro"},
+		{"/old//evil.com", "/evil.com"},
+		{"/old/\\evil.com", "/%5Cevil.com"},
+		{"/old/a b", "/a%20b"},
+		{"/user/a?b", "/profiles/a%3Fb"},
+		{"/user/..", "/profiles/.."},
+		{"/ext/a/b", "https://example.com/a/b"},
+		{"/other", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, destination := rules.redirectFor(tt.path, nil, "")
+			if destination != tt.want {
+				t.Errorf("destination = %q, want %q", destination, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedirectForStaysOnSite(t *testing.T) {
+	// A destination made of placeholders alone can't be turned into //host
+	rules := &siteRules{redirects: []redirectRule{
+		{Path: "/go", Destination: "/:to", Status: 302, Query: map[string]string{"to": ":to"}},
+		{Path: "/*", Destination: "/:splat", Status: 301},
+	}}
+
+	for _, to := range []string{"/evil.com", "\\evil.com"} {
+		_, destination := rules.redirectFor("/go", url.Values{"to": {to}}, "to="+url.QueryEscape(to))
+		if strings.HasPrefix(destination, "//") || strings.HasPrefix(destination, "/\\") {
+			t.Errorf("to=%q redirects to %q", to, destination)
+		}
+	}
+}
+
+func TestApplyHeadersSkipsProtected(t *testing.T) {
+	rules := &siteRules{headers: []headerRule{
+		{Path: "/*", Headers: map[string]string{"Content-Type": "text/html", "X-Frame-Options": "DENY"}},
+	}}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "image/png")
+	rules.applyHeaders(w, "/logo.png")
+
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want DENY", got)
+	}
+}
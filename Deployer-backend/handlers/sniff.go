@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
+	"github.com/minio/minio-go/v7"
+)
+
+// The content type of every file is verified against its first bytes
+// before the deployment goes live, whatever the client declared. Files whose
+// extension promises binary media but whose bytes are markup or text, such
+// as HTML saved as .png, fail the deployment. Otherwise the file is served
+// with the verified type: the one its extension maps to, refined by the
+// sniffed type within the same family (a JPEG saved as .png is served as
+// image/jpeg), or the sniffed type for files without a known extension.
+// Sniffed types are cached per blob.
+
+// sniffLength is how much of a file content sniffing reads
+const sniffLength = 512
+
+// isBinaryType reports whether files of a media type always start with
+// binary data
+func isBinaryType(mediaType string) bool {
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "font/"):
+		return true
+	}
+	switch mediaType {
+	case "application/pdf", "application/wasm", "application/vnd.ms-fontobject", "model/gltf-binary":
+		return true
+	}
+	return false
+}
+
+// verifyContentType resolves the content type of a file from its extension
+// and its sniffed type. It returns a reason instead when the content is a
+// serious mismatch for the extension.
+func verifyContentType(p, sniffed string) (string, string) {
+	expected := mimetype.ForPath(p)
+	if sniffed == "" {
+		return expected, ""
+	}
+
+	sniffedMedia, _, err := mime.ParseMediaType(sniffed)
+	if err != nil {
+		return expected, ""
+	}
+	ext := strings.ToLower(path.Ext(p))
+
+	var kind string
+	switch sniffedMedia {
+	case "text/html":
+		kind = "HTML"
+	case "text/xml":
+		kind = "XML"
+	case "text/plain":
+		kind = "text"
+	}
+
+	switch {
+	case expected == "application/octet-stream":
+		// No known extension: the content decides
+		return sniffed, ""
+	case isBinaryType(expected) && kind != "":
+		return "", fmt.Sprintf("%s content in a %s file", kind, ext)
+	case expected == "image/svg+xml" && sniffedMedia == "text/html":
+		return "", "HTML content in a .svg file"
+	case isBinaryType(sniffedMedia) && mediaFamily(sniffedMedia) == mediaFamily(expected):
+		return sniffedMedia, ""
+	}
+	return expected, ""
+}
+
+func mediaFamily(mediaType string) string {
+	family, _, _ := strings.Cut(mediaType, "/")
+	return family
+}
+
+// verifyContentTypes sniffs the deployment's files, fails it on serious
+// mismatches and stores the verified content types
+func (u *deploymentUpload) verifyContentTypes() error {
+	rows, err := u.db.Query(`
+		SELECT f.path, f.hash, f.size_bytes, f.content_type, b.sniffed_type
+		FROM deployment_files f
+		JOIN blobs b ON b.project_id = $2 AND b.hash = f.hash
+		WHERE f.deployment_id = $1
+		ORDER BY f.path
+	`, u.deploymentID, u.projectID)
+	if err != nil {
+		return err
+	}
+
+	type sniffedFile struct {
+		path, hash, contentType string
+		size                    int64
+		sniffed                 sql.NullString
+	}
+	var files []sniffedFile
+	for rows.Next() {
+		var f sniffedFile
+		if err := rows.Scan(&f.path, &f.hash, &f.size, &f.contentType, &f.sniffed); err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	u.enterPhase(phaseValidate, "Verifying the content types of %d files", len(files))
+
+	sniffed := make(map[string]string)
+	corrected := 0
+	for _, f := range files {
+		if f.size == 0 {
+			continue
+		}
+
+		sniffedType, ok := sniffed[f.hash]
+		if !ok && f.sniffed.Valid {
+			sniffedType, ok = f.sniffed.String, true
+		}
+		if !ok {
+			if sniffedType, err = u.sniffBlob(f.hash); err != nil {
+				if u.ctx.Err() != nil {
+					return u.ctx.Err()
+				}
+				return fmt.Errorf("content sniffing of %s: %w", f.path, err)
+			}
+		}
+		sniffed[f.hash] = sniffedType
+
+		verified, reason := verifyContentType(f.path, sniffedType)
+		if reason != "" {
+			u.failFile(f.path, api.CodeContentMismatch, reason)
+			continue
+		}
+		if verified == f.contentType {
+			continue
+		}
+
+		_, err := u.db.Exec(`
+			UPDATE deployment_files SET content_type = $1 WHERE deployment_id = $2 AND path = $3
+		`, verified, u.deploymentID, f.path)
+		if err != nil {
+			return err
+		}
+		corrected++
+	}
+
+	if len(u.fileErrors) > 0 {
+		return u.fileErrorsError()
+	}
+	if corrected > 0 {
+		u.logf(logInfo, "Corrected the declared content type of %d files", corrected)
+	}
+	return nil
+}
+
+// sniffBlob detects the content type of a blob from its first bytes and
+// caches it on the blob
+func (u *deploymentUpload) sniffBlob(hash string) (string, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, sniffLength-1); err != nil {
+		return "", err
+	}
+	obj, err := u.minioClient.GetObject(u.ctx, u.projectName, blobKey(hash), opts)
+	if err != nil {
+		return "", err
+	}
+	head, err := io.ReadAll(io.LimitReader(obj, sniffLength))
+	obj.Close()
+	if err != nil {
+		return "", err
+	}
+
+	sniffed := http.DetectContentType(head)
+	_, err = u.db.Exec(`
+		UPDATE blobs SET sniffed_type = $1 WHERE project_id = $2 AND hash = $3
+	`, sniffed, u.projectID, hash)
+	if err != nil {
+		log.Printf("Failed to cache sniffed type of blob %s: %v", hash, err)
+	}
+	return sniffed, nil
+}
@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-backend/middleware"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
+	"github.com/gorilla/mux"
+)
+
+// Deployments are checked by a chain of validators. Each one sees every file
+// as it arrives and then the deployment as a whole, and rejects with a
+// machine-readable reason code. The built-in validators run in a fixed order
+// with default settings; an instance admin can change them with a JSON file
+// (VALIDATION_CONFIG) and a project can override them further. A project
+// may only tighten the settings: lower the size and file count limits,
+// narrow the allowed extensions, but not disable a validator, unless the
+// admin sets projects_may_widen on it. The size validator also bounds the
+// upload streams, so it can't be disabled at all.
+
+// requestOverhead is the room left for form fields on top of the deployment
+// size limit in a deploy request
+const requestOverhead = 10 << 20
+
+// Validator is one check of the validation pipeline. A validator is created
+// per deployment and may keep state between calls.
+type Validator interface {
+	// CheckFile is called for every file once its path and size are known
+	CheckFile(path string, size int64) *Rejection
+	// CheckDeployment is called once every file has been received
+	CheckDeployment(filesCount int, totalSize int64) *Rejection
+}
+
+// Rejection is why a validator refused a file or a deployment
+type Rejection = manifest.Rejection
+
+// validatorSettings configures a built-in validator. Each validator reads
+// only the fields it knows; zero values keep the inherited setting.
+type validatorSettings struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// extensions: Allow replaces the allowed extensions, Extra adds to them
+	Allow []string `json:"allow,omitempty"`
+	Extra []string `json:"extra,omitempty"`
+	// size
+	MaxFileBytes       int64 `json:"max_file_bytes,omitempty"`
+	MaxDeploymentBytes int64 `json:"max_deployment_bytes,omitempty"`
+	// entrypoint: file names of which at least one must be deployed
+	Files []string `json:"files,omitempty"`
+	// file_count
+	MaxFiles int `json:"max_files,omitempty"`
+	// ProjectsMayWiden lets projects disable or loosen a validator other than
+	// size and file_count. Only the admin can set it.
+	ProjectsMayWiden bool `json:"projects_may_widen,omitempty"`
+}
+
+// validationSettings maps validator names to their settings
+type validationSettings map[string]validatorSettings
+
+// builtinValidator describes a validator of the chain
+type builtinValidator struct {
+	name string
+	// limit validators can only be tightened by a project
+	limit bool
+	build func(s validatorSettings) Validator
+}
+
+var builtinValidators = []builtinValidator{
+	{name: "extensions", build: newExtensionValidator},
+	{name: "size", limit: true, build: newSizeValidator},
+	{name: "entrypoint", build: newEntrypointValidator},
+	{name: "file_count", limit: true, build: newFileCountValidator},
+}
+
+// defaultValidation are the settings when the admin configures nothing
+var defaultValidation = validationSettings{
+	"size":       {MaxFileBytes: manifest.MaxFileSize, MaxDeploymentBytes: manifest.MaxDeploymentSize},
+	"entrypoint": {Files: manifest.DefaultEntrypoints},
+	"file_count": {MaxFiles: manifest.MaxFiles},
+}
+
+// instanceValidation is the default chain of this instance
+var instanceValidation = defaultValidation
+
+// LoadValidationConfig reads the admin's validation settings from a JSON
+// file, e.g. {"entrypoint": {"files": ["index.html", "200.html"]}}. An empty
+// path keeps the defaults.
+func LoadValidationConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings validationSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("invalid validation config %s: %w", path, err)
+	}
+	if err := checkValidatorNames(settings); err != nil {
+		return err
+	}
+	if settings["size"].Disabled {
+		return fmt.Errorf("the size validator can't be disabled")
+	}
+
+	instanceValidation = mergeValidation(defaultValidation, settings, false)
+	return nil
+}
+
+func checkValidatorNames(settings validationSettings) error {
+	for name := range settings {
+		known := false
+		for _, b := range builtinValidators {
+			known = known || b.name == name
+		}
+		if !known {
+			return fmt.Errorf("unknown validator %q", name)
+		}
+	}
+	return nil
+}
+
+// mergeValidation applies overrides to base. With restricted set, the
+// overrides come from a project: limits may only go down, and other settings
+// may only narrow unless base allows widening them.
+func mergeValidation(base, overrides validationSettings, restricted bool) validationSettings {
+	merged := make(validationSettings, len(builtinValidators))
+	for _, b := range builtinValidators {
+		s := base[b.name]
+		o, ok := overrides[b.name]
+		if !ok {
+			merged[b.name] = s
+			continue
+		}
+
+		widen := !restricted || (s.ProjectsMayWiden && !b.limit)
+		if o.Disabled && b.name != "size" && widen {
+			s.Disabled = true
+		}
+		if widen {
+			if o.Allow != nil {
+				s.Allow = o.Allow
+			}
+			if o.Extra != nil {
+				s.Extra = o.Extra
+			}
+		} else if o.Allow != nil {
+			// Extra can't add anything here, it only counts as part of Allow
+			allowed := allowedExtensions(s)
+			s.Allow = append(narrowExtensions(o.Allow, allowed), narrowExtensions(o.Extra, allowed)...)
+			s.Extra = nil
+		}
+		// An empty list would accept any deployment
+		if o.Files != nil && (len(o.Files) > 0 || widen) {
+			s.Files = o.Files
+		}
+		s.MaxFileBytes = mergeLimit(s.MaxFileBytes, o.MaxFileBytes, restricted)
+		s.MaxDeploymentBytes = mergeLimit(s.MaxDeploymentBytes, o.MaxDeploymentBytes, restricted)
+		s.MaxFiles = int(mergeLimit(int64(s.MaxFiles), int64(o.MaxFiles), restricted))
+		if !restricted {
+			s.ProjectsMayWiden = o.ProjectsMayWiden
+		}
+		merged[b.name] = s
+	}
+	return merged
+}
+
+// narrowExtensions keeps the extensions that are in allowed
+func narrowExtensions(exts []string, allowed map[string]bool) []string {
+	narrowed := []string{}
+	for _, ext := range exts {
+		if allowed[normalizeExtension(ext)] {
+			narrowed = append(narrowed, ext)
+		}
+	}
+	return narrowed
+}
+
+func mergeLimit(base, override int64, restricted bool) int64 {
+	if override <= 0 || (restricted && base > 0 && override > base) {
+		return base
+	}
+	return override
+}
+
+// validationPipeline is the validator chain of one deployment
+type validationPipeline struct {
+	validators []Validator
+	// maxFileBytes and maxDeploymentBytes bound the upload streams
+	maxFileBytes       int64
+	maxDeploymentBytes int64
+}
+
+func newValidationPipeline(settings validationSettings) *validationPipeline {
+	size := settings["size"]
+	p := &validationPipeline{maxFileBytes: size.MaxFileBytes, maxDeploymentBytes: size.MaxDeploymentBytes}
+	for _, b := range builtinValidators {
+		if s := settings[b.name]; !s.Disabled {
+			p.validators = append(p.validators, b.build(s))
+		}
+	}
+	return p
+}
+
+// checkFile returns the first rejection of a file, if any
+func (p *validationPipeline) checkFile(path string, size int64) *Rejection {
+	var first *Rejection
+	for _, v := range p.validators {
+		// Every validator sees every file, so stateful ones stay accurate
+		if r := v.CheckFile(path, size); r != nil && first == nil {
+			first = r
+		}
+	}
+	return first
+}
+
+// checkDeployment returns the first rejection of the deployment, if any
+func (p *validationPipeline) checkDeployment(filesCount int, totalSize int64) *Rejection {
+	for _, v := range p.validators {
+		if r := v.CheckDeployment(filesCount, totalSize); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// requestLimit caps the request body of a single deploy
+func requestLimit() int64 {
+	return instanceValidation["size"].MaxDeploymentBytes + requestOverhead
+}
+
+// checkFile runs the pipeline on a file and records its rejection, if any
+func (u *deploymentUpload) checkFile(path string, size int64) bool {
+	if r := u.validation().checkFile(path, size); r != nil {
+		u.failFile(path, r.Code, r.Message)
+		return false
+	}
+	return true
+}
+
+// rejectionError reports a rejection of the whole deployment
+func rejectionError(r *Rejection) error {
+	return &uploadError{Status: http.StatusBadRequest, Code: r.Code, Message: r.Message}
+}
+
+// validation returns the deployment's pipeline, built from the instance
+// chain and the project's overrides on first use
+func (u *deploymentUpload) validation() *validationPipeline {
+	if u.pipeline == nil {
+		overrides, err := loadProjectValidation(u.db, u.projectID)
+		if err != nil {
+			u.logf(logWarn, "Could not load the project's validation settings, using the defaults: %v", err)
+		}
+		u.pipeline = newValidationPipeline(mergeValidation(instanceValidation, overrides, true))
+	}
+	return u.pipeline
+}
+
+// loadProjectValidation returns a project's validator overrides
+func loadProjectValidation(db *sql.DB, projectID string) (validationSettings, error) {
+	var data []byte
+	if err := db.QueryRow("SELECT validation FROM projects WHERE id = $1", projectID).Scan(&data); err != nil {
+		return nil, err
+	}
+	settings := validationSettings{}
+	if data != nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// extensionValidator accepts files with an allowed extension and files
+// without one (e.g. CNAME, LICENSE)
+type extensionValidator struct {
+	allowed map[string]bool
+}
+
+func newExtensionValidator(s validatorSettings) Validator {
+	return &extensionValidator{allowed: allowedExtensions(s)}
+}
+
+// allowedExtensions returns the extensions the settings allow
+func allowedExtensions(s validatorSettings) map[string]bool {
+	allowed := mimetype.AllowedExtensions
+	if s.Allow != nil {
+		allowed = make(map[string]bool, len(s.Allow))
+		for _, ext := range s.Allow {
+			allowed[normalizeExtension(ext)] = true
+		}
+	}
+	if len(s.Extra) > 0 {
+		extended := make(map[string]bool, len(allowed)+len(s.Extra))
+		for ext := range allowed {
+			extended[ext] = true
+		}
+		for _, ext := range s.Extra {
+			extended[normalizeExtension(ext)] = true
+		}
+		allowed = extended
+	}
+	return allowed
+}
+
+func normalizeExtension(ext string) string {
+	return "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+}
+
+func (v *extensionValidator) CheckFile(path string, size int64) *Rejection {
+	return manifest.CheckExtension(path, v.allowed)
+}
+
+func (v *extensionValidator) CheckDeployment(filesCount int, totalSize int64) *Rejection {
+	return nil
+}
+
+// sizeValidator limits the size of single files and of the deployment
+type sizeValidator struct {
+	maxFileBytes       int64
+	maxDeploymentBytes int64
+}
+
+func newSizeValidator(s validatorSettings) Validator {
+	return &sizeValidator{maxFileBytes: s.MaxFileBytes, maxDeploymentBytes: s.MaxDeploymentBytes}
+}
+
+func (v *sizeValidator) CheckFile(path string, size int64) *Rejection {
+	return manifest.CheckFileSize(size, v.maxFileBytes)
+}
+
+func (v *sizeValidator) CheckDeployment(filesCount int, totalSize int64) *Rejection {
+	if totalSize > v.maxDeploymentBytes {
+		return manifest.DeploymentTooLarge(v.maxDeploymentBytes)
+	}
+	return nil
+}
+
+// entrypointValidator requires at least one of the entrypoint files, at the
+// root or in a subdirectory
+type entrypointValidator struct {
+	files []string
+	found bool
+}
+
+func newEntrypointValidator(s validatorSettings) Validator {
+	return &entrypointValidator{files: s.Files}
+}
+
+func (v *entrypointValidator) CheckFile(path string, size int64) *Rejection {
+	if manifest.IsEntrypoint(path, v.files) {
+		v.found = true
+	}
+	return nil
+}
+
+func (v *entrypointValidator) CheckDeployment(filesCount int, totalSize int64) *Rejection {
+	if v.found || len(v.files) == 0 {
+		return nil
+	}
+	return manifest.MissingEntrypoint(v.files)
+}
+
+// fileCountValidator limits the number of files of a deployment
+type fileCountValidator struct {
+	maxFiles int
+}
+
+func newFileCountValidator(s validatorSettings) Validator {
+	return &fileCountValidator{maxFiles: s.MaxFiles}
+}
+
+func (v *fileCountValidator) CheckFile(path string, size int64) *Rejection {
+	return nil
+}
+
+func (v *fileCountValidator) CheckDeployment(filesCount int, totalSize int64) *Rejection {
+	return manifest.CheckFileCount(filesCount, v.maxFiles)
+}
+
+// GetProjectValidation returns a project's validator overrides and the
+// settings that result from them
+func GetProjectValidation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		overrides, err := loadProjectValidation(db, projectID)
+		if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"overrides": overrides,
+			"effective": mergeValidation(instanceValidation, overrides, true),
+		}, http.StatusOK)
+	}
+}
+
+// SetProjectValidation replaces a project's validator overrides
+func SetProjectValidation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := middleware.GetUserFromContext(r)
+		if user == nil {
+			respondError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		projectID := mux.Vars(r)["id"]
+		if err := userProjectID(db, projectID, user.Email); err == sql.ErrNoRows {
+			respondError(w, "Project not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		var overrides validationSettings
+		if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := checkValidatorNames(overrides); err != nil {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for name, o := range overrides {
+			if o.ProjectsMayWiden {
+				respondError(w, fmt.Sprintf("projects_may_widen of %q can only be set by the instance admin", name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		data, _ := json.Marshal(overrides)
+		if _, err := db.Exec("UPDATE projects SET validation = $1, updated_at = NOW() WHERE id = $2", data, projectID); err != nil {
+			respondError(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, map[string]interface{}{
+			"overrides": overrides,
+			"effective": mergeValidation(instanceValidation, overrides, true),
+		}, http.StatusOK)
+	}
+}
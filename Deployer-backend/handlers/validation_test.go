@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeValidationRestricted(t *testing.T) {
+	base := validationSettings{
+		"extensions": {Allow: []string{".html", ".css", ".js"}, Extra: []string{".wasm"}},
+		"size":       {MaxFileBytes: 100, MaxDeploymentBytes: 1000},
+		"entrypoint": {Files: []string{"index.html"}},
+		"file_count": {MaxFiles: 10},
+	}
+	widenable := validationSettings{
+		"extensions": {Allow: []string{".html"}, ProjectsMayWiden: true},
+		"entrypoint": {Files: []string{"index.html"}, ProjectsMayWiden: true},
+	}
+
+	tests := []struct {
+		name      string
+		base      validationSettings
+		overrides validationSettings
+		want      validationSettings
+	}{
+		{
+			name:      "limits only go down",
+			base:      base,
+			overrides: validationSettings{"size": {MaxFileBytes: 50, MaxDeploymentBytes: 5000}, "file_count": {MaxFiles: 20}},
+			want: validationSettings{
+				"size":       {MaxFileBytes: 50, MaxDeploymentBytes: 1000},
+				"file_count": {MaxFiles: 10},
+			},
+		},
+		{
+			name: "validators can't be disabled",
+			base: base,
+			overrides: validationSettings{
+				"extensions": {Disabled: true},
+				"size":       {Disabled: true},
+				"entrypoint": {Disabled: true},
+				"file_count": {Disabled: true},
+			},
+			want: validationSettings{},
+		},
+		{
+			name:      "allow only narrows",
+			base:      base,
+			overrides: validationSettings{"extensions": {Allow: []string{"HTML", ".php"}, Extra: []string{".wasm", ".exe"}}},
+			want:      validationSettings{"extensions": {Allow: []string{"HTML", ".wasm"}}},
+		},
+		{
+			name:      "extra alone adds nothing",
+			base:      base,
+			overrides: validationSettings{"extensions": {Extra: []string{".php"}}},
+			want:      validationSettings{},
+		},
+		{
+			name:      "entrypoints can't be emptied",
+			base:      base,
+			overrides: validationSettings{"entrypoint": {Files: []string{}}},
+			want:      validationSettings{},
+		},
+		{
+			name:      "entrypoints can be changed",
+			base:      base,
+			overrides: validationSettings{"entrypoint": {Files: []string{"200.html"}}},
+			want:      validationSettings{"entrypoint": {Files: []string{"200.html"}}},
+		},
+		{
+			name:      "projects can't allow themselves to widen",
+			base:      base,
+			overrides: validationSettings{"extensions": {Allow: []string{".php"}, ProjectsMayWiden: true}},
+			want:      validationSettings{"extensions": {Allow: []string{}}},
+		},
+		{
+			name: "widening allowed by the admin",
+			base: widenable,
+			overrides: validationSettings{
+				"extensions": {Allow: []string{".php"}, Extra: []string{".exe"}},
+				"entrypoint": {Disabled: true},
+			},
+			want: validationSettings{
+				"extensions": {Allow: []string{".php"}, Extra: []string{".exe"}},
+				"entrypoint": {Disabled: true, Files: []string{"index.html"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := mergeValidation(tt.base, tt.overrides, true)
+			for _, b := range builtinValidators {
+				want, ok := tt.want[b.name]
+				if !ok {
+					want = tt.base[b.name]
+				} else {
+					want.ProjectsMayWiden = tt.base[b.name].ProjectsMayWiden
+				}
+				if got := merged[b.name]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %+v, want %+v", b.name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/dhruvsingh/deployer-backend/config"
 	"github.com/dhruvsingh/deployer-backend/database"
@@ -25,6 +26,10 @@ func main() {
 		log.Fatalf("Configuration validation failed: %v", err)
 	}
 
+	if err := handlers.LoadValidationConfig(cfg.ValidationConfig); err != nil {
+		log.Fatalf("Failed to load validation config: %v", err)
+	}
+
 	// Connect to database
 	db, err := sql.Open("postgres", cfg.DatabaseURL)
 	if err != nil {
@@ -76,14 +81,42 @@ func main() {
 	api.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
 
 	api.HandleFunc("/buckets/check", handlers.CheckBucketAvailability(db)).Methods("POST")
-	api.HandleFunc("/deploy", handlers.DeployProject(db, minioClient, cfg)).Methods("POST")
+	api.HandleFunc("/deploy", handlers.DeployProject(db, minioClient)).Methods("POST")
+	api.HandleFunc("/deployments", handlers.CreateDeployment(db, minioClient)).Methods("POST")
+	api.HandleFunc("/deployments/{id}/blobs/{hash}", handlers.UploadBlob(db, minioClient)).Methods("PUT")
+	api.HandleFunc("/deployments/{id}/blobs/{hash}", handlers.BlobUploadOffset(db, minioClient)).Methods("HEAD")
+	api.HandleFunc("/deployments/{id}/blobs/{hash}", handlers.UploadBlobChunk(db, minioClient)).Methods("PATCH")
+	api.HandleFunc("/deployments/{id}/finalize", handlers.FinalizeDeployment(db, minioClient)).Methods("POST")
+	api.HandleFunc("/deployments/{id}/cancel", handlers.CancelDeployment(db, minioClient)).Methods("POST")
 	api.HandleFunc("/projects", handlers.ListProjects(db)).Methods("GET")
 	api.HandleFunc("/projects/{id}", handlers.GetProject(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}", handlers.UpdateProjectSettings(db)).Methods("PATCH")
 	api.HandleFunc("/projects/{id}", handlers.DeleteProject(db, minioClient)).Methods("DELETE")
+	api.HandleFunc("/projects/{id}/cache-rules", handlers.GetCacheRules(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}/cache-rules", handlers.SetCacheRules(db)).Methods("PUT")
+	api.HandleFunc("/projects/{id}/validation", handlers.GetProjectValidation(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}/validation", handlers.SetProjectValidation(db)).Methods("PUT")
+	api.HandleFunc("/projects/{id}/retention", handlers.GetRetentionPolicy(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}/retention", handlers.SetRetentionPolicy(db)).Methods("PUT")
+	api.HandleFunc("/projects/{id}/retention/dry-run", handlers.PreviewRetention(db)).Methods("POST")
+	api.HandleFunc("/projects/{id}/secret-overrides", handlers.ListSecretOverrides(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}/secret-overrides", handlers.CreateSecretOverride(db)).Methods("POST")
+	api.HandleFunc("/projects/{id}/secret-overrides/{overrideId}", handlers.RevokeSecretOverride(db)).Methods("DELETE")
 	api.HandleFunc("/projects/{id}/deployments", handlers.ListProjectDeployments(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}/deployments/{deployment}", handlers.UpdateDeployment(db)).Methods("PATCH")
+	api.HandleFunc("/projects/{id}/deployments/{deployment}", handlers.DeleteDeployment(db, minioClient)).Methods("DELETE")
+	api.HandleFunc("/projects/{id}/deployments/{deployment}/files", handlers.ListDeploymentFiles(db)).Methods("GET")
+	api.HandleFunc("/projects/{id}/deployments/{from}/diff/{to}", handlers.DiffDeployments(db, minioClient)).Methods("GET")
+	api.HandleFunc("/projects/{id}/environments", handlers.ListEnvironments(db, cfg)).Methods("GET")
+	api.HandleFunc("/projects/{id}/environments/{env}", handlers.DeleteEnvironment(db)).Methods("DELETE")
+	api.HandleFunc("/projects/{id}/environments/{env}/promote", handlers.PromoteDeployment(db, cfg)).Methods("POST")
+	api.HandleFunc("/projects/{id}/branches", handlers.ListBranches(db, cfg)).Methods("GET")
+	api.HandleFunc("/projects/{id}/branches/{branch:.+}", handlers.DeleteBranch(db, minioClient)).Methods("DELETE")
 	api.HandleFunc("/projects/{id}/rollback/{deploymentId}", handlers.RollbackDeployment(db, minioClient, cfg)).Methods("POST")
-	api.HandleFunc("/deployments/{id}", handlers.GetDeploymentStatus(db)).Methods("GET")
+	api.HandleFunc("/deployments/{id}", handlers.GetDeploymentStatus(db, cfg)).Methods("GET")
 	api.HandleFunc("/deployments/{id}/logs", handlers.GetDeploymentLogs(db)).Methods("GET")
+	api.HandleFunc("/deployments/{id}/logs/stream", handlers.StreamDeploymentLogs(db)).Methods("GET").Name(middleware.LogStreamRoute)
+	api.HandleFunc("/deployments/{id}/logs/stream-ticket", handlers.CreateLogStreamTicket(db, cfg)).Methods("POST")
 
 	// CORS
 	c := cors.New(cors.Options{
@@ -93,13 +126,37 @@ func main() {
 			cfg.AuthPageURL,
 			cfg.FrontendURL,
 		},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{"Upload-Offset", "Upload-Length"},
 		AllowCredentials: true,
 	})
 
 	handler := c.Handler(r)
 
+	// Process queued deployments in the background
+	handlers.StartDeployWorkers(db, minioClient, cfg.DeployWorkers)
+
+	// Cancel uploads whose client went away before committing them
+	go func() {
+		for range time.Tick(15 * time.Minute) {
+			handlers.CollectAbandonedUploads(db, minioClient)
+		}
+	}()
+
+	// Remove the deployments each project's retention policy no longer keeps
+	go func() {
+		for range time.Tick(time.Hour) {
+			handlers.CollectExpiredDeployments(db, minioClient)
+		}
+	}()
+
+	// Site server: serves {project}.{DeployDomain} from each project's active deployment
+	go func() {
+		log.Printf("🌐 Site server starting on port %s", cfg.SitePort)
+		log.Fatal(http.ListenAndServe(":"+cfg.SitePort, handlers.ServeSite(db, minioClient, cfg)))
+	}()
+
 	log.Printf("🚀 Server starting on port %s", cfg.Port)
 	log.Fatal(http.ListenAndServe(":"+cfg.Port, handler))
 }
@@ -7,12 +7,23 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/gorilla/mux"
 )
 
 func AuthMiddleware(jwtSecret string, db *sql.DB) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
+			// EventSource can't set headers, so event streams may pass a stream ticket in the query
+			if ticket := r.URL.Query().Get("ticket"); authHeader == "" && ticket != "" && isLogStream(r) {
+				user, err := parseStreamTicket(jwtSecret, ticket, mux.Vars(r)["id"])
+				if err != nil {
+					respondError(w, "Invalid stream ticket", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(setUserContext(r.Context(), user)))
+				return
+			}
 			if authHeader == "" {
 				respondError(w, "Missing authorization header", http.StatusUnauthorized)
 				return
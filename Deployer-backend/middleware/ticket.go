@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// EventSource can't set headers, so a browser tailing a deployment's log
+// authenticates with a stream ticket in the query string instead of its
+// session token. A ticket is only good for one deployment's log stream and
+// expires quickly, so one that ends up in a proxy or access log is of little
+// use. Tickets are signed with a key derived from the JWT secret, so they
+// are never accepted as session tokens.
+
+// StreamTicketTTL is how long a stream ticket can be used to connect
+const StreamTicketTTL = time.Minute
+
+// LogStreamRoute names the route stream tickets are accepted on
+const LogStreamRoute = "deployment-log-stream"
+
+// isLogStream reports whether a request is for the log stream route
+func isLogStream(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && route.GetName() == LogStreamRoute && r.Header.Get("Accept") == "text/event-stream"
+}
+
+func streamTicketKey(jwtSecret string) []byte {
+	mac := hmac.New(sha256.New, []byte(jwtSecret))
+	mac.Write([]byte("log-stream-ticket"))
+	return mac.Sum(nil)
+}
+
+// NewStreamTicket issues a ticket to stream the log of one deployment
+func NewStreamTicket(jwtSecret string, user *models.JWTClaims, deploymentID string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(StreamTicketTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id":       user.UserID,
+		"email":         user.Email,
+		"deployment_id": deploymentID,
+		"exp":           expiresAt.Unix(),
+	})
+	ticket, err := token.SignedString(streamTicketKey(jwtSecret))
+	return ticket, expiresAt, err
+}
+
+// parseStreamTicket returns the user a ticket was issued to, if it is valid
+// for the deployment
+func parseStreamTicket(jwtSecret, ticket, deploymentID string) (*models.JWTClaims, error) {
+	token, err := jwt.Parse(ticket, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return streamTicketKey(jwtSecret), nil
+	}, jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid ticket")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || deploymentID == "" || getString(claims, "deployment_id") != deploymentID {
+		return nil, fmt.Errorf("ticket is for another deployment")
+	}
+	return &models.JWTClaims{
+		UserID: getString(claims, "user_id"),
+		Email:  getString(claims, "email"),
+	}, nil
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dhruvsingh/deployer-backend/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+func TestStreamTicket(t *testing.T) {
+	const secret = "test-secret"
+	user := &models.JWTClaims{UserID: "u1", Email: "dev@example.com"}
+
+	ticket, _, err := NewStreamTicket(secret, user, "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id":       user.UserID,
+		"email":         user.Email,
+		"deployment_id": "d1",
+		"exp":           time.Now().Add(-time.Minute).Unix(),
+	}).SignedString(streamTicketKey(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": user.UserID,
+		"email":   user.Email,
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *models.JWTClaims
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(AuthMiddleware(secret, nil))
+	handler := func(w http.ResponseWriter, r *http.Request) { got = GetUserFromContext(r) }
+	api.HandleFunc("/deployments/{id}/logs/stream", handler).Methods("GET").Name(LogStreamRoute)
+	api.HandleFunc("/deployments/{id}", handler).Methods("GET")
+
+	tests := []struct {
+		name   string
+		path   string
+		ticket string
+		want   int
+	}{
+		{"valid ticket", "/api/deployments/d1/logs/stream", ticket, http.StatusOK},
+		{"other deployment", "/api/deployments/d2/logs/stream", ticket, http.StatusUnauthorized},
+		{"other route", "/api/deployments/d1", ticket, http.StatusUnauthorized},
+		{"expired", "/api/deployments/d1/logs/stream", expired, http.StatusUnauthorized},
+		{"session token", "/api/deployments/d1/logs/stream", session, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest("GET", tt.path+"?ticket="+tt.ticket, nil)
+			req.Header.Set("Accept", "text/event-stream")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && (got == nil || got.Email != user.Email) {
+				t.Errorf("user = %+v, want %+v", got, user)
+			}
+		})
+	}
+
+	// A ticket is no session token
+	req := httptest.NewRequest("GET", "/api/deployments/d1", nil)
+	req.Header.Set("Authorization", "Bearer "+ticket)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("ticket as bearer token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
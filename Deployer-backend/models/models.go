@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+)
 
 type User struct {
 	ID         string    `json:"id"`
@@ -11,30 +15,15 @@ type User struct {
 	CreatedAt  time.Time `json:"created_at"`
 }
 
-type Project struct {
-	ID                 string    `json:"id"`
-	UserID             string    `json:"user_id"`
-	Name               string    `json:"name"`
-	RepoURL            *string   `json:"repo_url,omitempty"`
-	ActiveDeploymentID *string   `json:"active_deployment_id"`
-	CreatedAt          time.Time `json:"created_at"`
-	URL                string    `json:"url,omitempty"`
-}
-
-type Deployment struct {
-	ID            string    `json:"id"`
-	ProjectID     string    `json:"project_id"`
-	Version       int       `json:"version"`
-	Status        string    `json:"status"`
-	Source        string    `json:"source"`
-	CommitHash    *string   `json:"commit_hash,omitempty"`
-	CommitMessage *string   `json:"commit_message,omitempty"`
-	FilesCount    int       `json:"files_count"`
-	SizeBytes     int64     `json:"size_bytes"`
-	Logs          *string   `json:"logs,omitempty"`
-	IsActive      bool      `json:"is_active"`
-	CreatedAt     time.Time `json:"created_at"`
-}
+// The API types are shared with the CLI
+type (
+	Project        = api.Project
+	Deployment     = api.Deployment
+	CacheRule      = api.CacheRule
+	BrokenLink     = api.BrokenLink
+	SecretOverride = api.SecretOverride
+	FileError      = api.FileError
+)
 
 type JWTClaims struct {
 	UserID   string `json:"user_id"`
@@ -38,6 +38,9 @@ DEPLOY_DOMAIN=
 
 # Server Configuration
 PORT=8080
+SITE_PORT=8081
+DEPLOY_WORKERS=2
+VALIDATION_CONFIG=
 AUTH_PAGE_URL=http://localhost:3000
 
 # OAuth Configuration (Optional)
@@ -120,6 +123,9 @@ echo "⚙️  Setting up optional environment variables..."
 prompt_optional "MINIO_USE_SSL" "Use SSL for MinIO connection" "false"
 prompt_optional "AUTH_PAGE_URL" "Auth page URL" "http://localhost:3000"
 prompt_optional "PORT" "Server port" "8080"
+prompt_optional "SITE_PORT" "Site server port (serves deployed projects)" "8081"
+prompt_optional "DEPLOY_WORKERS" "Number of deploy workers" "2"
+prompt_optional "VALIDATION_CONFIG" "Deployment validation config file" ""
 
 echo
 echo "🔐 OAuth configuration (optional - press Enter to skip)..."
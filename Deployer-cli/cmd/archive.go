@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/briandowns/spinner"
+)
+
+// uploadArchive deploys the build directory as a single .tar.gz body instead
+// of the incremental manifest protocol and returns the queued deployment's ID
+func uploadArchive(token, projectName, buildDir string) (string, error) {
+	archive, fileCount, err := createArchive(buildDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	info, err := archive.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	for key, value := range deploymentMetadata(projectName) {
+		query.Set(key, fmt.Sprint(value))
+	}
+
+	req, _ := http.NewRequest("POST", apiURL+"/api/deploy?"+query.Encode(), archive)
+	req.ContentLength = info.Size()
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/gzip")
+
+	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
+	s.Suffix = fmt.Sprintf(" Uploading archive with %d files (%d KB)...", fileCount, info.Size()>>10)
+	s.Start()
+
+	resp, err := http.DefaultClient.Do(req)
+	s.Stop()
+
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("deployment failed: %w", apiError(resp))
+	}
+
+	var queued queuedDeployment
+	if err := json.NewDecoder(resp.Body).Decode(&queued); err != nil {
+		return "", err
+	}
+	trackDeployment(queued.DeploymentID)
+	queued.report()
+
+	return queued.DeploymentID, nil
+}
+
+// createArchive writes the regular files of buildDir to a temporary .tar.gz,
+// rewound and ready to be sent
+func createArchive(buildDir string) (*os.File, int, error) {
+	tmp, err := os.CreateTemp("", "deployer-*.tar.gz")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	fileCount := 0
+
+	err = filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		relPath, _ := filepath.Rel(buildDir, path)
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(relPath),
+			Mode:     0644,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, file); err != nil {
+			return err
+		}
+
+		fileCount++
+		return nil
+	})
+
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+
+	return tmp, fileCount, nil
+}
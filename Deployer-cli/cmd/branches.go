@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/spf13/cobra"
+)
+
+var branchesProject string
+
+var branchesCmd = &cobra.Command{
+	Use:   "branches",
+	Short: "List the branch previews of a project",
+	Long: "List the branch previews of the project in the current directory (or --project). " +
+		"Deploy a branch preview with 'deployer deploy --branch <name>'.",
+	Args: cobra.NoArgs,
+	RunE: runBranches,
+}
+
+var branchesDeleteCmd = &cobra.Command{
+	Use:   "delete [branch]",
+	Short: "Report a branch deleted and remove its preview",
+	Long:  "Remove the preview of a deleted branch along with its deployments. Pinned and protected deployments are kept.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runBranchesDelete,
+}
+
+func init() {
+	branchesCmd.PersistentFlags().StringVar(&branchesProject, "project", "", "Project name (defaults to the project in the current directory)")
+	branchesCmd.AddCommand(branchesDeleteCmd)
+}
+
+func runBranches(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(branchesProject)
+	if err != nil {
+		return err
+	}
+
+	var branches []api.BranchAlias
+	if err := getJSON(authToken, "/api/projects/"+projectID+"/branches", &branches); err != nil {
+		return err
+	}
+	if len(branches) == 0 {
+		printInfo("No branch previews yet")
+		return nil
+	}
+
+	fmt.Println()
+	for _, b := range branches {
+		live := "nothing live"
+		if b.Version != nil {
+			live = fmt.Sprintf("v%d", *b.Version)
+		}
+		fmt.Printf("  %s %-14s %s\n", bold(fmt.Sprintf("%-24s", b.Branch)), live, cyan(b.URL))
+	}
+	fmt.Println()
+	return nil
+}
+
+func runBranchesDelete(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(branchesProject)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		RemovedDeployments int `json:"removed_deployments"`
+	}
+	path := "/api/projects/" + projectID + "/branches/" + url.PathEscape(args[0])
+	if err := sendJSON(authToken, "DELETE", path, nil, &result); err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+
+	printSuccess(fmt.Sprintf("Preview of %s deleted (%d deployments removed)", args[0], result.RemovedDeployments))
+	return nil
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [deployment-id]",
+	Short: "Cancel a deployment that hasn't finished yet",
+	Long:  "Stop a deployment that is still uploading, queued or processing. Its partial uploads are removed and the live version is left untouched.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runCancel,
+}
+
+func runCancel(cmd *cobra.Command, args []string) error {
+	config, err := loadConfig()
+	authToken := os.Getenv("DEPLOYER_TOKEN")
+	if err == nil {
+		authToken = config.Token
+	} else if authToken == "" {
+		return err
+	}
+
+	if err := cancelDeployment(authToken, args[0]); err != nil {
+		return fmt.Errorf("cancel failed: %w", err)
+	}
+
+	printSuccess(fmt.Sprintf("Deployment %s cancelled", args[0]))
+	return nil
+}
+
+func cancelDeployment(token, deploymentID string) error {
+	return postJSON(token, "/api/deployments/"+deploymentID+"/cancel", nil, nil)
+}
+
+// inFlight is the deployment the running deploy has created, if any
+var inFlight struct {
+	sync.Mutex
+	deploymentID string
+}
+
+func trackDeployment(deploymentID string) {
+	inFlight.Lock()
+	inFlight.deploymentID = deploymentID
+	inFlight.Unlock()
+}
+
+// cancelOnInterrupt cancels the in-flight deployment when the deploy is
+// interrupted, so Ctrl+C doesn't leave it running on the backend. The
+// returned function stops watching.
+func cancelOnInterrupt(token string) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+
+		inFlight.Lock()
+		deploymentID := inFlight.deploymentID
+		inFlight.Unlock()
+
+		fmt.Println()
+		if deploymentID != "" {
+			printWarning(fmt.Sprintf("Interrupted, cancelling deployment %s...", deploymentID))
+			if err := cancelDeployment(token, deploymentID); err != nil {
+				printError(fmt.Sprintf("Could not cancel deployment: %v", err))
+			} else {
+				printInfo("Deployment cancelled")
+			}
+		}
+		os.Exit(130)
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -4,17 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
 
+	"github.com/dhruvsingh/deployer-shared/api"
 	"github.com/spf13/cobra"
 )
 
-type Project struct {
-	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
-}
-
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all your deployed projects",
@@ -49,7 +43,7 @@ func runList(cmd *cobra.Command, args []string) error {
 	}
 	defer resp.Body.Close()
 
-	var projects []Project
+	var projects []api.Project
 	if err := json.NewDecoder(resp.Body).Decode(&projects); err != nil {
 		return err
 	}
@@ -2,19 +2,24 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
-	"net/textproto"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/briandowns/spinner"
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
 	"github.com/spf13/cobra"
 )
 
@@ -25,8 +30,13 @@ type ProjectConfig struct {
 }
 
 var (
-	ciMode bool
-	token  string
+	ciMode      bool
+	token       string
+	archiveMode bool
+	spaMode     bool
+	skipChecks  bool
+	environment string
+	branch      string
 )
 
 var deployCmd = &cobra.Command{
@@ -39,6 +49,11 @@ var deployCmd = &cobra.Command{
 func init() {
 	deployCmd.Flags().BoolVar(&ciMode, "ci", false, "Run in non-interactive CI mode")
 	deployCmd.Flags().StringVar(&token, "token", "", "Authentication token (overrides config file)")
+	deployCmd.Flags().BoolVar(&archiveMode, "archive", false, "Upload the build directory as a single .tar.gz archive")
+	deployCmd.Flags().BoolVar(&spaMode, "spa", false, "Serve index.html for unknown pages (detected for Vite and Create React App)")
+	deployCmd.Flags().BoolVar(&skipChecks, "skip-checks", false, "Skip the local checks of the build (for servers with custom validation settings)")
+	deployCmd.Flags().StringVar(&environment, "env", "", "Environment to deploy to, e.g. staging (defaults to production)")
+	deployCmd.Flags().StringVar(&branch, "branch", "", "Git branch being deployed; branches other than the production branch get their own preview URL")
 }
 
 func runDeploy(cmd *cobra.Command, args []string) error {
@@ -78,6 +93,9 @@ func runDeploy(cmd *cobra.Command, args []string) error {
 	if !ciMode {
 		printSuccess(fmt.Sprintf("Detected %s project", projectType))
 	}
+	if !cmd.Flags().Changed("spa") {
+		spaMode = isSPAProjectType(projectType)
+	}
 
 	// Check for existing project config
 	localConfig, exists := loadProjectConfig()
@@ -119,18 +137,39 @@ func runDeploy(cmd *cobra.Command, args []string) error {
 		printSuccess("Build completed successfully")
 	}
 
+	// Catch what the backend would reject before uploading anything
+	if !skipChecks {
+		if err := checkBuildDir(buildDir); err != nil {
+			return err
+		}
+	}
+
 	// Upload files
 	if !ciMode {
 		printInfo(fmt.Sprintf("[3/6] Uploading files from %s...", buildDir))
 	}
-	deploymentID, url, err := uploadFiles(authToken, projectName, buildDir)
+	// Ctrl+C from here on also cancels the deployment on the backend
+	stopWatching := cancelOnInterrupt(authToken)
+	upload := uploadFiles
+	if archiveMode {
+		upload = uploadArchive
+	}
+	deploymentID, err := upload(authToken, projectName, buildDir)
 	if err != nil {
+		stopWatching()
 		return fmt.Errorf("upload failed: %w", err)
 	}
 	if !ciMode {
 		printSuccess(fmt.Sprintf("Uploaded files to MinIO"))
 	}
 
+	// The backend processes the deployment in the background
+	url, err := waitForDeployment(authToken, deploymentID)
+	stopWatching()
+	if err != nil {
+		return err
+	}
+
 	// Save project config
 	if !ciMode {
 		printInfo("[4/6] Saving project configuration...")
@@ -192,6 +231,12 @@ func detectProjectType() (string, string, error) {
 	return "", "", fmt.Errorf("unsupported project type - please use Next.js, Vite, or Create React App")
 }
 
+// isSPAProjectType reports whether builds of a project type are single-page
+// apps that route client-side, so unknown pages must fall back to index.html
+func isSPAProjectType(projectType string) bool {
+	return projectType == "Vite" || projectType == "Create React App"
+}
+
 func buildProject(projectType string) error {
 	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
 	s.Suffix = " Building project..."
@@ -234,107 +279,359 @@ func checkBucketAvailability(token, name string) error {
 	return nil
 }
 
-func uploadFiles(token, projectName, buildDir string) (string, string, error) {
-	// Create multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+const (
+	// uploadChunkSize is the size of each resumable upload request
+	uploadChunkSize = 8 << 20
+	// maxUploadRetries is how often a chunk is retried without progress
+	maxUploadRetries = 5
+)
 
-	// Add project name
-	writer.WriteField("project_name", projectName)
+// uploadFiles deploys the build directory incrementally: it sends a manifest
+// of path and hash pairs, uploads only the hashes the backend doesn't have
+// yet, then finalizes the deployment. It returns the queued deployment's ID.
+func uploadFiles(token, projectName, buildDir string) (string, error) {
+	files, localPaths, err := buildManifest(buildDir)
+	if err != nil {
+		return "", err
+	}
 
-	// Add CI/metadata info if available
-	source := "cli"
-	if ciMode || os.Getenv("GITHUB_ACTIONS") == "true" {
-		source = "ci"
+	// Phase 1: send the manifest
+	req := deploymentMetadata(projectName)
+	req["files"] = files
+
+	var created api.DeploymentCreated
+	if err := postJSON(token, "/api/deployments", req, &created); err != nil {
+		return "", fmt.Errorf("deployment failed: %w", err)
 	}
-	writer.WriteField("source", source)
+	trackDeployment(created.DeploymentID)
 
-	// Try to get git info
-	if repoURL, err := exec.Command("git", "remote", "get-url", "origin").Output(); err == nil {
-		writer.WriteField("repo_url", strings.TrimSpace(string(repoURL)))
+	// Phase 2: upload only what the backend is missing
+	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
+	s.Start()
+	for i, hash := range created.Missing {
+		s.Suffix = fmt.Sprintf(" Uploading %d/%d changed files (%d unchanged)...", i+1, len(created.Missing), len(files)-len(created.Missing))
+		if err := uploadBlob(token, created.DeploymentID, hash, localPaths[hash]); err != nil {
+			s.Stop()
+			return "", fmt.Errorf("deployment failed: %w", err)
+		}
 	}
-	if commitHash, err := exec.Command("git", "rev-parse", "HEAD").Output(); err == nil {
-		writer.WriteField("commit_hash", strings.TrimSpace(string(commitHash)))
+	s.Stop()
+
+	if !ciMode {
+		printInfo(fmt.Sprintf("Uploaded %d of %d files (%d unchanged)", len(created.Missing), len(files), len(files)-len(created.Missing)))
 	}
-	if commitMsg, err := exec.Command("git", "log", "-1", "--format=%s").Output(); err == nil {
-		writer.WriteField("commit_message", strings.TrimSpace(string(commitMsg)))
+
+	// Phase 3: commit the session; the backend queues it to go live
+	var queued queuedDeployment
+	if err := postJSON(token, "/api/deployments/"+created.DeploymentID+"/finalize", nil, &queued); err != nil {
+		return "", fmt.Errorf("deployment failed: %w", err)
 	}
+	queued.report()
+
+	return created.DeploymentID, nil
+}
+
+// buildManifest hashes every file under buildDir. It also returns a local
+// path for each distinct hash so missing content can be uploaded later.
+func buildManifest(buildDir string) ([]manifest.File, map[string]string, error) {
+	var files []manifest.File
+	localPaths := make(map[string]string)
 
-	// Walk build directory and add files
-	fileCount := 0
 	err := filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
 			return err
 		}
-		
-		// Get relative path
+
 		relPath, _ := filepath.Rel(buildDir, path)
-		
-		// Open file
+
 		file, err := os.Open(path)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		
-		// Detect content type from extension
-		contentType := getContentTypeFromPath(relPath)
-		
-		// Create form part with proper Content-Type header and custom path header
-		h := make(textproto.MIMEHeader)
-		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, relPath))
-		h.Set("Content-Type", contentType)
-		h.Set("X-File-Path", relPath) // Add custom header to preserve full path
-		part, err := writer.CreatePart(h)
+
+		hasher := sha256.New()
+		size, err := io.Copy(hasher, file)
 		if err != nil {
 			return err
 		}
-		
-		// Copy file content
-		if _, err := io.Copy(part, file); err != nil {
+		hash := hex.EncodeToString(hasher.Sum(nil))
+
+		files = append(files, manifest.File{
+			Path:        filepath.ToSlash(relPath),
+			Hash:        hash,
+			Size:        size,
+			ContentType: mimetype.ForPath(relPath),
+		})
+		localPaths[hash] = path
+		return nil
+	})
+
+	return files, localPaths, err
+}
+
+// checkBuildDir runs the backend's default checks on the build directory, so
+// files it would reject are reported before anything is uploaded
+func checkBuildDir(buildDir string) error {
+	var files []manifest.File
+	err := filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
 			return err
 		}
-		
-		fileCount++
+		relPath, _ := filepath.Rel(buildDir, path)
+		files = append(files, manifest.File{Path: filepath.ToSlash(relPath), Size: info.Size()})
 		return nil
 	})
-	
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	
-	writer.Close()
-	
-	// Create request
-	req, _ := http.NewRequest("POST", apiURL+"/api/deploy", body)
+
+	if problems := manifest.Check(files); len(problems) > 0 {
+		return fmt.Errorf("the build can't be deployed (use --skip-checks to let the server decide):%s", formatFileErrors(problems))
+	}
+	return nil
+}
+
+// deploymentMetadata collects the project name plus CI and git details sent
+// with every deployment
+func deploymentMetadata(projectName string) map[string]interface{} {
+	meta := map[string]interface{}{
+		"project_name": projectName,
+	}
+
+	source := "cli"
+	if ciMode || os.Getenv("GITHUB_ACTIONS") == "true" {
+		source = "ci"
+	}
+	meta["source"] = source
+	meta["spa"] = spaMode
+	if environment != "" {
+		meta["environment"] = environment
+	}
+	if branch != "" {
+		meta["branch"] = branch
+	}
+
+	// Try to get git info
+	if repoURL, err := exec.Command("git", "remote", "get-url", "origin").Output(); err == nil {
+		meta["repo_url"] = strings.TrimSpace(string(repoURL))
+	}
+	if commitHash, err := exec.Command("git", "rev-parse", "HEAD").Output(); err == nil {
+		meta["commit_hash"] = strings.TrimSpace(string(commitHash))
+	}
+	if commitMsg, err := exec.Command("git", "log", "-1", "--format=%s").Output(); err == nil {
+		meta["commit_message"] = strings.TrimSpace(string(commitMsg))
+	}
+
+	return meta
+}
+
+// uploadBlob sends a file's content in chunks. After a network error it asks
+// the backend how much arrived and resumes from there, giving up after
+// maxUploadRetries attempts without progress.
+func uploadBlob(token, deploymentID, hash, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	blobURL := apiURL + "/api/deployments/" + deploymentID + "/blobs/" + hash
+	offset := int64(0)
+	retries := 0
+
+	for {
+		next, complete, err := uploadChunk(token, blobURL, file, offset, size)
+		if err == nil {
+			if complete {
+				return nil
+			}
+			offset, retries = next, 0
+			continue
+		}
+
+		var apiErr *offsetMismatchError
+		if errors.As(err, &apiErr) {
+			offset = apiErr.offset
+			continue
+		}
+
+		if !isRetryable(err) || retries >= maxUploadRetries {
+			return err
+		}
+		retries++
+		time.Sleep(time.Duration(retries) * time.Second)
+
+		if resumed, err := blobOffset(token, blobURL); err == nil {
+			offset = resumed
+		}
+	}
+}
+
+// uploadChunk PATCHes the chunk of file starting at offset and returns the
+// offset the backend acknowledged
+func uploadChunk(token, blobURL string, file *os.File, offset, size int64) (int64, bool, error) {
+	length := size - offset
+	if length > uploadChunkSize {
+		length = uploadChunkSize
+	}
+
+	req, _ := http.NewRequest("PATCH", blobURL, io.NewSectionReader(file, offset, length))
+	req.ContentLength = length
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	
-	// Send request
-	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
-	s.Suffix = fmt.Sprintf(" Uploading %d files...", fileCount)
-	s.Start()
-	
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
 	resp, err := http.DefaultClient.Do(req)
-	s.Stop()
-	
 	if err != nil {
-		return "", "", err
+		return 0, false, &networkError{err}
 	}
 	defer resp.Body.Close()
-	
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", "", fmt.Errorf("deployment failed: %s", string(bodyBytes))
+
+	switch {
+	case resp.StatusCode == http.StatusConflict && resp.Header.Get("Upload-Offset") != "":
+		current, _ := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+		return 0, false, &offsetMismatchError{offset: current}
+	case resp.StatusCode >= 500:
+		return 0, false, &networkError{apiError(resp)}
+	case resp.StatusCode != http.StatusOK:
+		return 0, false, apiError(resp)
 	}
-	
+
 	var result struct {
-		DeploymentID string `json:"deployment_id"`
-		URL          string `json:"url"`
+		Offset   int64 `json:"offset"`
+		Complete bool  `json:"complete"`
 	}
-	json.NewDecoder(resp.Body).Decode(&result)
-	
-	return result.DeploymentID, result.URL, nil
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, false, &networkError{err}
+	}
+	return result.Offset, result.Complete, nil
+}
+
+// blobOffset asks the backend how many bytes of a blob it has received
+func blobOffset(token, blobURL string) (int64, error) {
+	req, _ := http.NewRequest("HEAD", blobURL, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// networkError marks a failure worth retrying: the connection dropped or the
+// backend had a transient problem
+type networkError struct{ err error }
+
+func (e *networkError) Error() string { return e.err.Error() }
+func (e *networkError) Unwrap() error { return e.err }
+
+// offsetMismatchError is returned when the backend expects a different offset
+type offsetMismatchError struct{ offset int64 }
+
+func (e *offsetMismatchError) Error() string {
+	return fmt.Sprintf("upload offset mismatch: server expects %d", e.offset)
+}
+
+func isRetryable(err error) bool {
+	var netErr *networkError
+	return errors.As(err, &netErr)
+}
+
+// postJSON sends payload as JSON and decodes the response into out
+func postJSON(token, path string, payload, out interface{}) error {
+	return sendJSON(token, "POST", path, payload, out)
+}
+
+// sendJSON sends payload as JSON with the given method and decodes the
+// response into out
+func sendJSON(token, method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequest(method, apiURL+path, body)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// getJSON fetches a backend resource into out
+func getJSON(token, path string, out interface{}) error {
+	req, _ := http.NewRequest("GET", apiURL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// formatFileErrors lists failed files, one per line, with the reason code.
+// Problems of the deployment as a whole have no path.
+func formatFileErrors(files []api.FileError) string {
+	var b strings.Builder
+	for _, f := range files {
+		if f.Path == "" {
+			fmt.Fprintf(&b, "\n  %s %s", red("✗"), f.Error)
+		} else {
+			fmt.Fprintf(&b, "\n  %s %s: %s", red("✗"), f.Path, f.Error)
+		}
+		if f.Code != "" {
+			fmt.Fprintf(&b, " (%s)", f.Code)
+		}
+	}
+	return b.String()
+}
+
+// apiError turns an unsuccessful backend response into an error
+func apiError(resp *http.Response) error {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	var apiErr api.ErrorResponse
+	if json.Unmarshal(bodyBytes, &apiErr) == nil && apiErr.Error != "" {
+		if len(apiErr.Files) > 0 {
+			return fmt.Errorf("%s%s", apiErr.Error, formatFileErrors(apiErr.Files))
+		}
+		return fmt.Errorf("%s", apiErr.Error)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(bodyBytes)))
 }
 
 func loadProjectConfig() (*ProjectConfig, bool) {
@@ -369,35 +666,3 @@ func saveProjectConfig(bucketName, deploymentID string) error {
 	
 	return os.WriteFile(".deployer/config.json", data, 0644)
 }
-
-func getContentTypeFromPath(filename string) string {
-	ext := filepath.Ext(filename)
-	contentTypes := map[string]string{
-		".html": "text/html; charset=utf-8",
-		".css":  "text/css; charset=utf-8",
-		".js":   "application/javascript; charset=utf-8",
-		".mjs":  "application/javascript; charset=utf-8",
-		".json": "application/json",
-		".png":  "image/png",
-		".jpg":  "image/jpeg",
-		".jpeg": "image/jpeg",
-		".gif":  "image/gif",
-		".svg":  "image/svg+xml",
-		".ico":  "image/x-icon",
-		".woff": "font/woff",
-		".woff2": "font/woff2",
-		".ttf":  "font/ttf",
-		".eot":  "application/vnd.ms-fontobject",
-		".pdf":  "application/pdf",
-		".txt":  "text/plain; charset=utf-8",
-		".xml":  "application/xml",
-		".webp": "image/webp",
-		".mp4":  "video/mp4",
-		".webm": "video/webm",
-	}
-
-	if ct, ok := contentTypes[ext]; ok {
-		return ct
-	}
-	return "application/octet-stream"
-}
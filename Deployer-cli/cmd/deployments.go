@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/spf13/cobra"
+)
+
+var deploymentsProject string
+
+var deploymentsCmd = &cobra.Command{
+	Use:   "deployments",
+	Short: "List and manage the deployments of a project",
+	Long: "List the deployments of the project in the current directory (or --project) and pin, protect or delete them. " +
+		"Deployments are given by version number, e.g. 'deployer deployments pin 12'.",
+}
+
+var deploymentsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the deployments of the project",
+	Args:  cobra.NoArgs,
+	RunE:  runDeploymentsList,
+}
+
+var deploymentsPinCmd = &cobra.Command{
+	Use:   "pin [version]",
+	Short: "Keep a deployment from retention and any other cleanup",
+	Args:  cobra.ExactArgs(1),
+	RunE:  setDeploymentFlag("pinned", true),
+}
+
+var deploymentsUnpinCmd = &cobra.Command{
+	Use:   "unpin [version]",
+	Short: "Let retention remove a deployment again",
+	Args:  cobra.ExactArgs(1),
+	RunE:  setDeploymentFlag("pinned", false),
+}
+
+var deploymentsProtectCmd = &cobra.Command{
+	Use:   "protect [version]",
+	Short: "Keep a deployment, and its project, from being deleted",
+	Args:  cobra.ExactArgs(1),
+	RunE:  setDeploymentFlag("protected", true),
+}
+
+var deploymentsUnprotectCmd = &cobra.Command{
+	Use:   "unprotect [version]",
+	Short: "Allow a deployment to be deleted again",
+	Args:  cobra.ExactArgs(1),
+	RunE:  setDeploymentFlag("protected", false),
+}
+
+var deploymentsDeleteCmd = &cobra.Command{
+	Use:   "delete [version]",
+	Short: "Delete a finished deployment and its files",
+	Long:  "Delete a deployment that is not live. Pinned and protected deployments have to be unpinned or unprotected first.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runDeploymentsDelete,
+}
+
+func init() {
+	deploymentsCmd.PersistentFlags().StringVar(&deploymentsProject, "project", "", "Project name (defaults to the project in the current directory)")
+	deploymentsCmd.AddCommand(deploymentsListCmd, deploymentsPinCmd, deploymentsUnpinCmd,
+		deploymentsProtectCmd, deploymentsUnprotectCmd, deploymentsDeleteCmd)
+}
+
+// projectTarget returns the token and the ID of the named project, or of the
+// project in the current directory if name is empty
+func projectTarget(name string) (string, string, error) {
+	config, err := loadConfig()
+	authToken := os.Getenv("DEPLOYER_TOKEN")
+	if err == nil {
+		authToken = config.Token
+	} else if authToken == "" {
+		return "", "", err
+	}
+
+	if name == "" {
+		localConfig, exists := loadProjectConfig()
+		if !exists {
+			return "", "", fmt.Errorf("no project found in current directory - use --project or run 'deployer deploy' first")
+		}
+		name = localConfig.BucketName
+	}
+
+	projectID, err := findProjectID(authToken, name)
+	if err != nil {
+		return "", "", err
+	}
+	return authToken, projectID, nil
+}
+
+func runDeploymentsList(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(deploymentsProject)
+	if err != nil {
+		return err
+	}
+
+	var deployments []api.Deployment
+	if err := getJSON(authToken, "/api/projects/"+projectID+"/deployments", &deployments); err != nil {
+		return err
+	}
+	if len(deployments) == 0 {
+		printInfo("No deployments yet")
+		return nil
+	}
+
+	fmt.Println()
+	for _, d := range deployments {
+		var flags []string
+		if d.Environment != "" && d.Environment != "production" {
+			flags = append(flags, d.Environment)
+		} else if d.Environment == "" && d.Branch != "" {
+			flags = append(flags, "preview of "+d.Branch)
+		}
+		if d.IsActive {
+			flags = append(flags, green("active"))
+		}
+		if d.Pinned {
+			flags = append(flags, cyan("pinned"))
+		}
+		if d.Protected {
+			flags = append(flags, yellow("protected"))
+		}
+		fmt.Printf("  %s  %-10s %s  %5d files  %10s  %s\n", bold(fmt.Sprintf("v%-4d", d.Version)), d.Status,
+			d.CreatedAt.Format("2006-01-02 15:04"), d.FilesCount, formatSize(d.SizeBytes), strings.Join(flags, " "))
+	}
+	fmt.Println()
+	return nil
+}
+
+// setDeploymentFlag returns a command that sets the pinned or protected flag
+// of a deployment
+func setDeploymentFlag(flag string, value bool) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		authToken, projectID, err := projectTarget(deploymentsProject)
+		if err != nil {
+			return err
+		}
+
+		var updated api.DeploymentRef
+		path := "/api/projects/" + projectID + "/deployments/" + url.PathEscape(args[0])
+		if err := sendJSON(authToken, "PATCH", path, map[string]bool{flag: value}, &updated); err != nil {
+			return err
+		}
+
+		state := flag
+		if !value {
+			state = "un" + flag
+		}
+		printSuccess(fmt.Sprintf("v%d is %s", updated.Version, state))
+		return nil
+	}
+}
+
+func runDeploymentsDelete(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(deploymentsProject)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Are you sure you want to delete deployment %s? [y/N]: ", args[0])
+	confirm := promptUser("")
+	if confirm != "y" && confirm != "Y" {
+		printInfo("Deletion cancelled")
+		return nil
+	}
+
+	path := "/api/projects/" + projectID + "/deployments/" + url.PathEscape(args[0])
+	if err := sendJSON(authToken, "DELETE", path, nil, nil); err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+
+	printSuccess(fmt.Sprintf("Deployment %s deleted", args[0]))
+	return nil
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/manifest"
+	"github.com/spf13/cobra"
+)
+
+var diffProject string
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [from] [to]",
+	Short: "Show what a deploy would change",
+	Long: "Compare the local build directory with the live deployment without uploading anything. " +
+		"With two versions (e.g. 'deployer diff 12 13') show what changed between them, including the content of modified text files.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return fmt.Errorf("expected no arguments or two versions, got %d arguments", len(args))
+		}
+		return nil
+	},
+	RunE: runDiff,
+}
+
+func init() {
+	diffCmd.Flags().StringVar(&diffProject, "project", "", "Project name (defaults to the project in the current directory)")
+}
+
+// deploymentFiles is the answer of GET /api/projects/{id}/deployments/{deployment}/files
+type deploymentFiles struct {
+	Deployment api.DeploymentRef `json:"deployment"`
+	Files      []manifest.File   `json:"files"`
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(diffProject)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 2 {
+		var diff api.DeploymentDiff
+		path := fmt.Sprintf("/api/projects/%s/deployments/%s/diff/%s", projectID, url.PathEscape(args[0]), url.PathEscape(args[1]))
+		if err := getJSON(authToken, path, &diff); err != nil {
+			return fmt.Errorf("diff failed: %w", err)
+		}
+		printDiff(diff, fmt.Sprintf("v%d", diff.From.Version), fmt.Sprintf("v%d", diff.To.Version))
+		return nil
+	}
+
+	_, buildDir, err := detectProjectType()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(buildDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("build directory %s not found - build the project first", buildDir)
+	}
+	local, _, err := buildManifest(buildDir)
+	if err != nil {
+		return err
+	}
+
+	var live deploymentFiles
+	if err := getJSON(authToken, "/api/projects/"+projectID+"/deployments/active/files", &live); err != nil {
+		return fmt.Errorf("diff failed: %w", err)
+	}
+
+	diff := manifest.Diff(live.Files, local)
+	diff.From = live.Deployment
+	printDiff(diff, fmt.Sprintf("v%d", live.Deployment.Version), buildDir)
+	return nil
+}
+
+// findProjectID looks up the ID of one of the user's projects by name
+func findProjectID(token, name string) (string, error) {
+	var projects []api.Project
+	if err := getJSON(token, "/api/projects", &projects); err != nil {
+		return "", err
+	}
+	for _, p := range projects {
+		if p.Name == name {
+			return p.ID, nil
+		}
+	}
+	return "", fmt.Errorf("project '%s' not found", name)
+}
+
+// printDiff lists the changed files followed by the content diffs
+func printDiff(d api.DeploymentDiff, from, to string) {
+	changed := len(d.Added) + len(d.Removed) + len(d.Modified)
+	if changed == 0 {
+		printInfo(fmt.Sprintf("No changes between %s and %s", from, to))
+		return
+	}
+
+	fmt.Println()
+	fmt.Println(bold(fmt.Sprintf("Changes from %s to %s:", from, to)))
+	fmt.Println()
+	for _, c := range d.Added {
+		fmt.Printf("  %s %s (%s)\n", green("+"), c.Path, formatSize(c.NewSize))
+	}
+	for _, c := range d.Removed {
+		fmt.Printf("  %s %s (%s)\n", red("-"), c.Path, formatSize(c.OldSize))
+	}
+	for _, c := range d.Modified {
+		fmt.Printf("  %s %s (%s)\n", yellow("~"), c.Path, formatSizeDelta(c.SizeDelta))
+	}
+	fmt.Println()
+	fmt.Printf("  %d added, %d removed, %d modified (%s)\n", len(d.Added), len(d.Removed), len(d.Modified), formatSizeDelta(d.SizeDelta))
+
+	for _, c := range d.Modified {
+		if c.Diff == "" {
+			continue
+		}
+		fmt.Println()
+		for _, line := range strings.Split(strings.TrimSuffix(c.Diff, "\n"), "\n") {
+			switch {
+			case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+				fmt.Println(bold(line))
+			case strings.HasPrefix(line, "@@"):
+				fmt.Println(cyan(line))
+			case strings.HasPrefix(line, "+"):
+				fmt.Println(green(line))
+			case strings.HasPrefix(line, "-"):
+				fmt.Println(red(line))
+			default:
+				fmt.Println(line)
+			}
+		}
+	}
+	fmt.Println()
+}
+
+func formatSize(bytes int64) string {
+	switch {
+	case bytes < 1<<10:
+		return fmt.Sprintf("%d B", bytes)
+	case bytes < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
+
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + formatSize(-delta)
+	}
+	return "+" + formatSize(delta)
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/spf13/cobra"
+)
+
+var environmentsProject string
+
+var environmentsCmd = &cobra.Command{
+	Use:   "environments",
+	Short: "List the environments of a project and what is live in them",
+	Long: "List the environments of the project in the current directory (or --project). " +
+		"Deploy to an environment with 'deployer deploy --env staging' and move a deployment on with 'deployer promote staging'.",
+	Args: cobra.NoArgs,
+	RunE: runEnvironments,
+}
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote [from] [to]",
+	Short: "Make the deployment live in one environment live in another",
+	Long:  "Promote the deployment live in an environment to another one, production by default, without uploading it again.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE:  runPromote,
+}
+
+func init() {
+	environmentsCmd.Flags().StringVar(&environmentsProject, "project", "", "Project name (defaults to the project in the current directory)")
+	promoteCmd.Flags().StringVar(&environmentsProject, "project", "", "Project name (defaults to the project in the current directory)")
+}
+
+func runEnvironments(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(environmentsProject)
+	if err != nil {
+		return err
+	}
+
+	var environments []api.Environment
+	if err := getJSON(authToken, "/api/projects/"+projectID+"/environments", &environments); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	for _, env := range environments {
+		live := "nothing live"
+		if env.Version != nil {
+			live = fmt.Sprintf("v%d", *env.Version)
+		}
+		fmt.Printf("  %s %-14s %s\n", bold(fmt.Sprintf("%-12s", env.Name)), live, cyan(env.URL))
+	}
+	fmt.Println()
+	return nil
+}
+
+func runPromote(cmd *cobra.Command, args []string) error {
+	authToken, projectID, err := projectTarget(environmentsProject)
+	if err != nil {
+		return err
+	}
+
+	to := "production"
+	if len(args) == 2 {
+		to = args[1]
+	}
+
+	var promoted api.Environment
+	path := "/api/projects/" + projectID + "/environments/" + url.PathEscape(args[0]) + "/promote"
+	if err := postJSON(authToken, path, map[string]string{"to": to}, &promoted); err != nil {
+		return fmt.Errorf("promote failed: %w", err)
+	}
+
+	printSuccess(fmt.Sprintf("v%d promoted from %s to %s", *promoted.Version, args[0], promoted.Name))
+	fmt.Printf("  %s %s\n", cyan("URL:"), promoted.URL)
+	return nil
+}
@@ -45,6 +45,12 @@ func init() {
 	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(deleteCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(cancelCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(deploymentsCmd)
+	rootCmd.AddCommand(environmentsCmd)
+	rootCmd.AddCommand(promoteCmd)
+	rootCmd.AddCommand(branchesCmd)
 }
 
 func printBanner() {
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/briandowns/spinner"
+	"github.com/dhruvsingh/deployer-shared/api"
+)
+
+// deploymentPollInterval is how often a queued deployment's status is checked
+const deploymentPollInterval = time.Second
+
+// reportBrokenLinks warns about the broken links and missing assets the
+// backend found in the deployed pages
+func reportBrokenLinks(links []api.BrokenLink) {
+	if len(links) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	for _, l := range links {
+		what := "broken link to"
+		if l.Kind == api.LinkKindAsset {
+			what = "missing asset"
+		}
+		fmt.Fprintf(&b, "\n  %s %s: %s %s", yellow("•"), l.Page, what, l.Link)
+	}
+	printWarning(fmt.Sprintf("%d broken links or missing assets:%s", len(links), b.String()))
+}
+
+// queuedDeployment is the backend's answer to an accepted deploy
+type queuedDeployment api.QueuedDeployment
+
+// report tells the user when the deployment waits for earlier ones and how
+// to stop it
+func (q queuedDeployment) report() {
+	if q.QueuePosition > 0 {
+		printWarning(fmt.Sprintf("v%d is queued behind %d earlier deployments of this project", q.Version, q.QueuePosition))
+	}
+	if !ciMode {
+		printInfo(fmt.Sprintf("Press Ctrl+C or run 'deployer cancel %s' to cancel it", q.DeploymentID))
+	}
+}
+
+// waitForDeployment follows a queued deployment until the backend has
+// finished processing it and returns its URL. The deployment's log is tailed
+// as it runs; if the log stream is unavailable, the status is polled instead.
+func waitForDeployment(token, deploymentID string) (string, error) {
+	if err := tailDeploymentLogs(token, deploymentID); err != nil {
+		if err := pollDeployment(token, deploymentID); err != nil {
+			return "", err
+		}
+	}
+
+	status, err := getDeploymentStatus(token, deploymentID)
+	if err != nil {
+		return "", err
+	}
+	if status.Status != "success" {
+		reason := status.Status
+		if status.Logs != nil && *status.Logs != "" {
+			reason = *status.Logs
+		}
+		if len(status.FileErrors) > 0 {
+			reason = fmt.Sprintf("%d files could not be deployed (the previous version stays live)%s",
+				len(status.FileErrors), formatFileErrors(status.FileErrors))
+		}
+		return "", fmt.Errorf("deployment %s: %s", status.Status, reason)
+	}
+	reportBrokenLinks(status.BrokenLinks)
+	return status.URL, nil
+}
+
+// tailDeploymentLogs prints a deployment's log lines as they are written and
+// returns once the deployment has finished. A dropped stream is resumed from
+// the last line received.
+func tailDeploymentLogs(token, deploymentID string) error {
+	var lastID int64
+	failures := 0
+
+	for {
+		done, err := readLogStream(token, deploymentID, &lastID)
+		if done {
+			return nil
+		}
+		if failures++; failures > maxUploadRetries {
+			return err
+		}
+		time.Sleep(time.Duration(failures) * time.Second)
+	}
+}
+
+// readLogStream reads the Server-Sent Events log stream until it ends. It
+// reports whether the stream ended because the deployment finished.
+func readLogStream(token, deploymentID string, lastID *int64) (bool, error) {
+	req, _ := http.NewRequest("GET", apiURL+"/api/deployments/"+deploymentID+"/logs/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatInt(*lastID, 10))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, apiError(resp)
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			switch event {
+			case "log":
+				var l api.LogLine
+				if json.Unmarshal([]byte(data), &l) == nil {
+					printLogLine(l)
+					*lastID = l.ID
+				}
+			case "done":
+				return true, nil
+			}
+			event, data = "", ""
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("log stream closed")
+}
+
+func printLogLine(l api.LogLine) {
+	if ciMode {
+		fmt.Printf("%s [%s] %s: %s\n", l.Timestamp.Format("15:04:05"), l.Phase, l.Level, l.Message)
+		return
+	}
+
+	message := l.Message
+	switch l.Level {
+	case "warn":
+		message = yellow(message)
+	case "error":
+		message = red(message)
+	}
+	fmt.Printf("  %s %s %s\n", l.Timestamp.Format("15:04:05"), cyan(fmt.Sprintf("%-9s", l.Phase)), message)
+}
+
+// pollDeployment polls the deployment's status until it has finished
+func pollDeployment(token, deploymentID string) error {
+	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
+	s.Suffix = " Waiting for deployment to start..."
+	s.Start()
+	defer s.Stop()
+
+	failures := 0
+	for {
+		status, err := getDeploymentStatus(token, deploymentID)
+		if err != nil {
+			// The upload is done; a flaky connection shouldn't abort the wait
+			if failures++; failures > maxUploadRetries {
+				return err
+			}
+			time.Sleep(time.Duration(failures) * time.Second)
+			continue
+		}
+		failures = 0
+
+		switch status.Status {
+		case "success", "failed", "cancelled":
+			return nil
+		case "queued":
+			s.Suffix = " Deployment queued..."
+		default:
+			s.Suffix = fmt.Sprintf(" Processing deployment v%d: %d files (%d KB)...", status.Version, status.FilesCount, status.SizeBytes>>10)
+		}
+
+		time.Sleep(deploymentPollInterval)
+	}
+}
+
+func getDeploymentStatus(token, deploymentID string) (*api.Deployment, error) {
+	req, _ := http.NewRequest("GET", apiURL+"/api/deployments/"+deploymentID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	var status api.Deployment
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
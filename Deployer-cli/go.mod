@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/briandowns/spinner v1.23.0
+	github.com/dhruvsingh/deployer-shared v0.0.0
 	github.com/fatih/color v1.16.0
 	github.com/spf13/cobra v1.8.0
 )
@@ -16,3 +17,5 @@ require (
 	golang.org/x/sys v0.14.0 // indirect
 	golang.org/x/term v0.1.0 // indirect
 )
+
+replace github.com/dhruvsingh/deployer-shared => ../Deployer-shared
@@ -0,0 +1,27 @@
+package api
+
+// Reason codes of rejected deployments, found in ErrorResponse.Code,
+// FileError.Code and Deployment.ErrorCode
+const (
+	CodeInvalidPath        = "invalid_path"
+	CodeDuplicatePath      = "duplicate_path"
+	CodeInvalidHash        = "invalid_hash"
+	CodeInvalidSize        = "invalid_size"
+	CodeSizeConflict       = "size_conflict"
+	CodeFileType           = "file_type_not_allowed"
+	CodeContentMismatch    = "content_type_mismatch"
+	CodeFileTooLarge       = "file_too_large"
+	CodeDeploymentTooLarge = "deployment_too_large"
+	CodeTooManyFiles       = "too_many_files"
+	CodeMissingEntrypoint  = "missing_entrypoint"
+	CodeInvalidFiles       = "invalid_files"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeInvalidArchive     = "invalid_archive"
+	CodeRulesSyntax        = "rules_syntax_error"
+	CodeSecretDetected     = "secret_detected"
+	CodeBrokenLinks        = "broken_links"
+	CodeBrokenLink         = "broken_link"
+	CodeMissingAsset       = "missing_asset"
+	CodeUploadInterrupted  = "upload_interrupted"
+	CodeStorageError       = "storage_error"
+)
@@ -0,0 +1,201 @@
+// Package api holds the request and response types of the Deployer HTTP
+// API, shared by the CLI and the backend.
+package api
+
+import "time"
+
+type Project struct {
+	ID                 string    `json:"id"`
+	UserID             string    `json:"user_id"`
+	Name               string    `json:"name"`
+	RepoURL            *string   `json:"repo_url,omitempty"`
+	ActiveDeploymentID *string   `json:"active_deployment_id"`
+	SPAMode            *bool     `json:"spa_mode"`
+	StrictLinks        bool      `json:"strict_links"`
+	ProductionBranch   string    `json:"production_branch,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	URL                string    `json:"url,omitempty"`
+}
+
+// Deployment is one version of a project. A pinned deployment is never
+// removed by retention or any other cleanup; a protected one can't be
+// deleted, nor can its project. Environment is the environment it was
+// deployed to, empty for a branch preview; IsActive reports whether it is
+// live in production.
+type Deployment struct {
+	ID              string       `json:"id"`
+	ProjectID       string       `json:"project_id"`
+	Version         int          `json:"version"`
+	Status          string       `json:"status"`
+	Environment     string       `json:"environment,omitempty"`
+	Branch          string       `json:"branch,omitempty"`
+	Source          string       `json:"source"`
+	CommitHash      *string      `json:"commit_hash,omitempty"`
+	CommitMessage   *string      `json:"commit_message,omitempty"`
+	FilesCount      int          `json:"files_count"`
+	SizeBytes       int64        `json:"size_bytes"`
+	StoredBytes     int64        `json:"stored_bytes"`
+	CompressedBytes int64        `json:"compressed_bytes"`
+	Logs            *string      `json:"logs,omitempty"`
+	ErrorCode       *string      `json:"error_code,omitempty"`
+	FileErrors      []FileError  `json:"file_errors,omitempty"`
+	BrokenLinks     []BrokenLink `json:"broken_links,omitempty"`
+	IsActive        bool         `json:"is_active"`
+	Pinned          bool         `json:"pinned"`
+	Protected       bool         `json:"protected"`
+	URL             string       `json:"url,omitempty"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// CacheRule sets the Cache-Control header of the files matching a glob
+type CacheRule struct {
+	Pattern      string `json:"pattern"`
+	CacheControl string `json:"cache_control"`
+}
+
+// Kinds of broken links
+const (
+	LinkKindPage  = "page"
+	LinkKindAsset = "asset"
+)
+
+// BrokenLink is a reference of a deployed page that resolves to nothing.
+// Kind is "page" for links and "asset" for embedded resources.
+type BrokenLink struct {
+	Page string `json:"page"`
+	Link string `json:"link"`
+	Kind string `json:"kind"`
+}
+
+// SecretOverride lets a secret scanning rule's findings on the paths
+// matching a glob through
+type SecretOverride struct {
+	ID        string     `json:"id"`
+	Pattern   string     `json:"pattern"`
+	Rule      string     `json:"rule"`
+	Reason    string     `json:"reason"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedBy *string    `json:"revoked_by,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// FileError reports why a single file could not be deployed. Code is one of
+// the Code constants.
+type FileError struct {
+	Path  string `json:"path"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// ErrorResponse is the body of an unsuccessful response. Code and Files are
+// set when a deployment was rejected.
+type ErrorResponse struct {
+	Error string      `json:"error"`
+	Code  string      `json:"code,omitempty"`
+	Files []FileError `json:"files,omitempty"`
+}
+
+// LogLine is one line of a deployment's log
+type LogLine struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	Phase     string    `json:"phase"`
+	Message   string    `json:"message"`
+}
+
+// QueuedDeployment is the answer to a deployment that was accepted and
+// queued for processing
+type QueuedDeployment struct {
+	DeploymentID  string `json:"deployment_id"`
+	ProjectName   string `json:"project_name"`
+	Version       int    `json:"version"`
+	Status        string `json:"status"`
+	QueuePosition int    `json:"queue_position"`
+	StatusURL     string `json:"status_url"`
+}
+
+// DeploymentCreated is the answer to an incremental deploy's manifest: the
+// hashes the client still has to upload before finalizing
+type DeploymentCreated struct {
+	DeploymentID string    `json:"deployment_id"`
+	Version      int       `json:"version"`
+	Missing      []string  `json:"missing"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// DeploymentRef identifies one side of a diff
+type DeploymentRef struct {
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+}
+
+// FileChange is a file added, removed or modified between two deployments.
+// Diff is a unified diff of a modified text file; DiffOmitted says why a
+// modified file has none.
+type FileChange struct {
+	Path        string `json:"path"`
+	OldSize     int64  `json:"old_size"`
+	NewSize     int64  `json:"new_size"`
+	SizeDelta   int64  `json:"size_delta"`
+	Diff        string `json:"diff,omitempty"`
+	DiffOmitted string `json:"diff_omitted,omitempty"`
+}
+
+// DeploymentDiff lists what changed from one deployment to another
+type DeploymentDiff struct {
+	From      DeploymentRef `json:"from"`
+	To        DeploymentRef `json:"to"`
+	Added     []FileChange  `json:"added"`
+	Removed   []FileChange  `json:"removed"`
+	Modified  []FileChange  `json:"modified"`
+	SizeDelta int64         `json:"size_delta"`
+}
+
+// RetentionPolicy decides which finished deployments of a project are kept:
+// the last KeepLast successful versions and everything from the last
+// KeepDays days. A deployment is kept if either rule keeps it; zero turns a
+// rule off, and with both off every deployment is kept.
+type RetentionPolicy struct {
+	KeepLast int `json:"keep_last"`
+	KeepDays int `json:"keep_days"`
+}
+
+// ExpiredDeployment is a deployment a retention policy removes
+type ExpiredDeployment struct {
+	ID        string    `json:"id"`
+	Version   int       `json:"version"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RetentionPlan lists the deployments a retention policy removes and the
+// storage that frees
+type RetentionPlan struct {
+	Policy      RetentionPolicy     `json:"policy"`
+	Deployments []ExpiredDeployment `json:"deployments"`
+	FreedBytes  int64               `json:"freed_bytes"`
+}
+
+// Environment is a named slot of a project with its own live deployment and
+// hostname. Production is served at {project}.{domain}, any other
+// environment at {environment}.{project}.{domain}.
+type Environment struct {
+	Name         string     `json:"name"`
+	DeploymentID *string    `json:"deployment_id"`
+	Version      *int       `json:"version,omitempty"`
+	URL          string     `json:"url"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+// BranchAlias is the preview of a branch of a project, served at
+// {slug}--{project}.{domain} with the branch's latest deployment
+type BranchAlias struct {
+	Branch       string    `json:"branch"`
+	Slug         string    `json:"slug"`
+	DeploymentID *string   `json:"deployment_id"`
+	Version      *int      `json:"version,omitempty"`
+	URL          string    `json:"url"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
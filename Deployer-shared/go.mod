@@ -0,0 +1,3 @@
+module github.com/dhruvsingh/deployer-shared
+
+go 1.22
@@ -0,0 +1,49 @@
+package manifest
+
+import (
+	"sort"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+)
+
+// Diff compares two manifests by path. A file whose hash changed is
+// modified; the changes are sorted by path.
+func Diff(from, to []File) api.DeploymentDiff {
+	d := api.DeploymentDiff{
+		Added:    []api.FileChange{},
+		Removed:  []api.FileChange{},
+		Modified: []api.FileChange{},
+	}
+
+	old := make(map[string]File, len(from))
+	for _, f := range from {
+		old[f.Path] = f
+	}
+	current := make(map[string]bool, len(to))
+	for _, f := range to {
+		current[f.Path] = true
+		prev, ok := old[f.Path]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, api.FileChange{Path: f.Path, NewSize: f.Size, SizeDelta: f.Size})
+		case prev.Hash != f.Hash:
+			d.Modified = append(d.Modified, api.FileChange{
+				Path: f.Path, OldSize: prev.Size, NewSize: f.Size, SizeDelta: f.Size - prev.Size,
+			})
+		default:
+			continue
+		}
+		d.SizeDelta += f.Size - prev.Size
+	}
+	for _, f := range from {
+		if !current[f.Path] {
+			d.Removed = append(d.Removed, api.FileChange{Path: f.Path, OldSize: f.Size, SizeDelta: -f.Size})
+			d.SizeDelta -= f.Size
+		}
+	}
+
+	for _, changes := range [][]api.FileChange{d.Added, d.Removed, d.Modified} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	}
+	return d
+}
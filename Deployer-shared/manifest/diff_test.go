@@ -0,0 +1,82 @@
+package manifest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		from []File
+		to   []File
+		want api.DeploymentDiff
+	}{
+		{
+			name: "empty",
+			want: api.DeploymentDiff{Added: []api.FileChange{}, Removed: []api.FileChange{}, Modified: []api.FileChange{}},
+		},
+		{
+			name: "unchanged",
+			from: []File{{Path: "index.html", Hash: "a", Size: 10}},
+			to:   []File{{Path: "index.html", Hash: "a", Size: 10}},
+			want: api.DeploymentDiff{Added: []api.FileChange{}, Removed: []api.FileChange{}, Modified: []api.FileChange{}},
+		},
+		{
+			name: "added, removed and modified, sorted by path",
+			from: []File{
+				{Path: "old.js", Hash: "o", Size: 30},
+				{Path: "index.html", Hash: "a", Size: 10},
+				{Path: "app.css", Hash: "c", Size: 20},
+				{Path: "logo.png", Hash: "l", Size: 50},
+			},
+			to: []File{
+				{Path: "index.html", Hash: "b", Size: 15},
+				{Path: "z.js", Hash: "z", Size: 5},
+				{Path: "app.css", Hash: "d", Size: 12},
+				{Path: "b.js", Hash: "x", Size: 7},
+				{Path: "logo.png", Hash: "l", Size: 50},
+			},
+			want: api.DeploymentDiff{
+				Added: []api.FileChange{
+					{Path: "b.js", NewSize: 7, SizeDelta: 7},
+					{Path: "z.js", NewSize: 5, SizeDelta: 5},
+				},
+				Removed: []api.FileChange{
+					{Path: "old.js", OldSize: 30, SizeDelta: -30},
+				},
+				Modified: []api.FileChange{
+					{Path: "app.css", OldSize: 20, NewSize: 12, SizeDelta: -8},
+					{Path: "index.html", OldSize: 10, NewSize: 15, SizeDelta: 5},
+				},
+				SizeDelta: 7 + 5 - 30 - 8 + 5,
+			},
+		},
+		{
+			name: "same content at another path",
+			from: []File{{Path: "a.html", Hash: "h", Size: 10}},
+			to:   []File{{Path: "b.html", Hash: "h", Size: 10}},
+			want: api.DeploymentDiff{
+				Added:    []api.FileChange{{Path: "b.html", NewSize: 10, SizeDelta: 10}},
+				Removed:  []api.FileChange{{Path: "a.html", OldSize: 10, SizeDelta: -10}},
+				Modified: []api.FileChange{},
+			},
+		},
+		{
+			name: "a size change alone is no modification",
+			from: []File{{Path: "index.html", Hash: "a", Size: 10}},
+			to:   []File{{Path: "index.html", Hash: "a", Size: 11}},
+			want: api.DeploymentDiff{Added: []api.FileChange{}, Removed: []api.FileChange{}, Modified: []api.FileChange{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Package manifest is the format of incremental deploy manifests and the
+// checks the backend runs on the files of a deployment. The CLI runs the
+// same checks with the default limits before uploading anything.
+package manifest
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/dhruvsingh/deployer-shared/api"
+	"github.com/dhruvsingh/deployer-shared/mimetype"
+)
+
+// Default limits of a deployment; a server may be configured with others
+const (
+	MaxFileSize       = 50 << 20
+	MaxDeploymentSize = 200 << 20
+	MaxFiles          = 10000
+)
+
+// DefaultEntrypoints are the files of which a deployment must contain one
+var DefaultEntrypoints = []string{"index.html"}
+
+// File is one file of a manifest, identified by the SHA-256 of its content
+type File struct {
+	Path        string `json:"path"`
+	Hash        string `json:"hash"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Request is the body of POST /api/deployments. SPA is the client's guess
+// whether the build is a single-page app; nil leaves it to the server.
+type Request struct {
+	ProjectName   string `json:"project_name"`
+	RepoURL       string `json:"repo_url,omitempty"`
+	Source        string `json:"source,omitempty"`
+	CommitHash    string `json:"commit_hash,omitempty"`
+	CommitMessage string `json:"commit_message,omitempty"`
+	SPA           *bool  `json:"spa,omitempty"`
+	Environment   string `json:"environment,omitempty"`
+	Branch        string `json:"branch,omitempty"`
+	Files         []File `json:"files"`
+}
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidHash reports whether a hash is a lower-case hex SHA-256
+func ValidHash(hash string) bool {
+	return hashPattern.MatchString(hash)
+}
+
+// NormalizePath cleans a relative file path, rejecting absolute paths and
+// anything that escapes the deployment root
+func NormalizePath(p string) (string, bool) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if p == "" || strings.HasPrefix(p, "/") || strings.ContainsRune(p, 0) {
+		return "", false
+	}
+
+	cleaned := path.Clean(p)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// Rejection is why a file or a whole deployment is refused
+type Rejection struct {
+	Code    string
+	Message string
+}
+
+// CheckExtension refuses files whose extension isn't allowed. Files without
+// an extension are always allowed.
+func CheckExtension(p string, allowed map[string]bool) *Rejection {
+	ext := mimetype.Extension(p)
+	if ext == "" || allowed[ext] {
+		return nil
+	}
+	return &Rejection{Code: api.CodeFileType, Message: fmt.Sprintf("file type %s is not allowed", ext)}
+}
+
+// CheckFileSize refuses files larger than the limit
+func CheckFileSize(size, limit int64) *Rejection {
+	if size > limit {
+		return &Rejection{Code: api.CodeFileTooLarge, Message: fmt.Sprintf("exceeds the %s file size limit", formatMB(limit))}
+	}
+	return nil
+}
+
+// DeploymentTooLarge is the rejection of a deployment over the size limit
+func DeploymentTooLarge(limit int64) *Rejection {
+	return &Rejection{Code: api.CodeDeploymentTooLarge, Message: fmt.Sprintf("Total deployment size exceeds %s limit", formatMB(limit))}
+}
+
+// CheckFileCount refuses deployments with more files than the limit; zero
+// means no limit
+func CheckFileCount(count, limit int) *Rejection {
+	if limit > 0 && count > limit {
+		return &Rejection{Code: api.CodeTooManyFiles, Message: fmt.Sprintf("Deployment has %d files, the limit is %d", count, limit)}
+	}
+	return nil
+}
+
+// IsEntrypoint reports whether a path is one of the entrypoints, at the root
+// or in a subdirectory
+func IsEntrypoint(p string, entrypoints []string) bool {
+	for _, e := range entrypoints {
+		if p == e || strings.HasSuffix(p, "/"+e) {
+			return true
+		}
+	}
+	return false
+}
+
+// MissingEntrypoint is the rejection of a deployment without any of the
+// entrypoints
+func MissingEntrypoint(entrypoints []string) *Rejection {
+	required := "one of " + strings.Join(entrypoints, ", ")
+	if len(entrypoints) == 1 {
+		required = entrypoints[0]
+	}
+	return &Rejection{
+		Code:    api.CodeMissingEntrypoint,
+		Message: fmt.Sprintf("Deployment must contain %s. Only static websites can be deployed.", required),
+	}
+}
+
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%dMB", bytes>>20)
+}
+
+// Check runs the backend's default checks on the files of a deployment and
+// returns every problem found. Problems with the deployment as a whole
+// have no path.
+func Check(files []File) []api.FileError {
+	var problems []api.FileError
+	reject := func(p string, r *Rejection) {
+		problems = append(problems, api.FileError{Path: p, Code: r.Code, Error: r.Message})
+	}
+
+	seen := make(map[string]bool, len(files))
+	hasEntrypoint := false
+	var total int64
+	for _, f := range files {
+		p, ok := NormalizePath(f.Path)
+		switch {
+		case !ok:
+			reject(f.Path, &Rejection{Code: api.CodeInvalidPath, Message: "invalid file path"})
+			continue
+		case seen[p]:
+			reject(p, &Rejection{Code: api.CodeDuplicatePath, Message: "duplicate path in manifest"})
+			continue
+		case f.Size < 0:
+			reject(p, &Rejection{Code: api.CodeInvalidSize, Message: "invalid size"})
+			continue
+		}
+		seen[p] = true
+		hasEntrypoint = hasEntrypoint || IsEntrypoint(p, DefaultEntrypoints)
+
+		if r := CheckExtension(p, mimetype.AllowedExtensions); r != nil {
+			reject(p, r)
+		} else if r := CheckFileSize(f.Size, MaxFileSize); r != nil {
+			reject(p, r)
+		}
+		total += f.Size
+	}
+
+	if total > MaxDeploymentSize {
+		reject("", DeploymentTooLarge(MaxDeploymentSize))
+	}
+	if r := CheckFileCount(len(files), MaxFiles); r != nil {
+		reject("", r)
+	}
+	if !hasEntrypoint {
+		reject("", MissingEntrypoint(DefaultEntrypoints))
+	}
+	return problems
+}
@@ -0,0 +1,132 @@
+// Package mimetype is the content-type registry and upload allowlist shared
+// by the CLI and the backend.
+package mimetype
+
+import (
+	"path"
+	"strings"
+)
+
+// Default is the content type of files with an unknown extension
+const Default = "application/octet-stream"
+
+// types maps extensions to the content type files are served with
+var types = map[string]string{
+	// Markup & Data
+	".html": "text/html; charset=utf-8",
+	".htm":  "text/html; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".js":   "application/javascript; charset=utf-8",
+	".mjs":  "application/javascript; charset=utf-8",
+	".json": "application/json",
+	".xml":  "application/xml",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".map":  "application/json",
+	// Images
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".svg":  "image/svg+xml",
+	".ico":  "image/x-icon",
+	".cur":  "image/x-icon",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".tiff": "image/tiff",
+	".tif":  "image/tiff",
+	// Fonts
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+	// Audio
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".aac":  "audio/aac",
+	".m4a":  "audio/mp4",
+	// Video
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	// 3D & Misc
+	".glb":  "model/gltf-binary",
+	".gltf": "model/gltf+json",
+	".pdf":  "application/pdf",
+	".wasm": "application/wasm",
+	// Web manifest & config
+	".webmanifest": "application/manifest+json",
+	".manifest":    "text/cache-manifest",
+}
+
+// AllowedExtensions are the static web extensions accepted in a deployment
+// unless the server is configured otherwise. Files without an extension
+// (e.g. CNAME, LICENSE) are always accepted.
+var AllowedExtensions = map[string]bool{
+	// Markup & Data
+	".html": true, ".htm": true, ".css": true, ".scss": true, ".less": true,
+	".js": true, ".mjs": true, ".jsx": true, ".ts": true, ".tsx": true,
+	".json": true, ".xml": true, ".txt": true, ".md": true, ".csv": true,
+	".map": true, ".yaml": true, ".yml": true, ".toml": true,
+	// Images
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true,
+	".ico": true, ".webp": true, ".avif": true, ".bmp": true,
+	".tiff": true, ".tif": true, ".cur": true,
+	// Fonts
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	// Audio
+	".mp3": true, ".ogg": true, ".wav": true, ".flac": true,
+	".aac": true, ".m4a": true, ".opus": true,
+	// Video
+	".mp4": true, ".webm": true, ".ogv": true, ".mov": true,
+	// 3D Models
+	".glb": true, ".gltf": true, ".obj": true, ".fbx": true, ".stl": true,
+	// Documents & Misc
+	".pdf": true, ".wasm": true,
+	// Web manifest & config
+	".webmanifest": true, ".manifest": true,
+	// Misc
+	".license": true,
+}
+
+// Extension returns the lower-cased extension of a path, dot included
+func Extension(p string) string {
+	return strings.ToLower(path.Ext(strings.ReplaceAll(p, "\\", "/")))
+}
+
+// ForPath returns the content type of a file from its extension
+func ForPath(p string) string {
+	if ct, ok := types[Extension(p)]; ok {
+		return ct
+	}
+	return Default
+}
+
+// IsAllowed reports whether a file's extension may be deployed by default
+func IsAllowed(p string) bool {
+	ext := Extension(p)
+	return ext == "" || AllowedExtensions[ext]
+}
+
+// IsText reports whether files of a content type are text
+func IsText(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml":
+		return true
+	}
+	return false
+}